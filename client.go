@@ -0,0 +1,615 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Client downloads files from and uploads files to a TFTP server.
+type Client struct {
+	// Addr is the address of the server that requests are sent to.
+	// The default value is ":tftp". A link-local IPv6 address must
+	// carry the zone of the interface to reach it through, as in
+	// "[fe80::1%eth0]:69", which is kept when the address is resolved.
+	Addr string
+
+	// Timeout is how long the client waits for a packet from the
+	// server before retransmitting the last block of an upload, or
+	// before abandoning the transfer.
+	// If zero, a timeout of 5 seconds is used.
+	Timeout time.Duration
+
+	// MaxRetransmissions is the number of times a transfer retransmits
+	// its request, or the DATA block or ACK it sent last, when the
+	// server does not answer it in time before it gives up, so that a
+	// lost packet, such as the ACK of the final block of an upload or
+	// the first block of a download, does not fail the transfer. If
+	// zero, a packet is retransmitted up to 5 times, and if negative,
+	// it is never retransmitted.
+	MaxRetransmissions int
+
+	// ErrorLog specifies an optional logger for unexpected packets
+	// and errors closing the local file or connection.
+	// If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	// BlockSize is the number of data bytes per DATA packet that the
+	// client asks the server to use, with the blksize option defined
+	// in RFC 2348. The server may agree to a smaller size, and sizes
+	// larger than the client can receive in one datagram are reduced.
+	// If zero, no option is sent and blocks of 512 bytes are used.
+	BlockSize int
+
+	// Mode is the transfer mode of the client's transfers. Netascii
+	// transfers convert between the line separators of the local
+	// system and the CR LF that netascii sends over the network. The
+	// default is ModeOctet, which transfers files byte for byte. The
+	// byte counts returned and reported to OnProgress are those of the
+	// local file or stream, after conversion, rather than those of the
+	// data sent over the network.
+	Mode Mode
+
+	// OnProgress specifies an optional function that is called after
+	// each block is transferred, with the number of bytes of the file
+	// transferred so far and the size of the whole file, or -1 if the
+	// size is not known. A download learns the size by asking the
+	// server for it with the tsize option defined in RFC 2349. It is
+	// called from the goroutine performing the transfer, and the
+	// number of bytes transferred never decreases within a transfer.
+	OnProgress func(transferred, total int64)
+
+	// VerifySize makes each download ask the server for the size of
+	// the file with the tsize option defined in RFC 2349, as is done
+	// for OnProgress. Whenever the server announces the size of an
+	// octet download, the download fails with an error wrapping
+	// ErrTransferSizeMismatch if it receives a different number of
+	// bytes, so a truncated file is not mistaken for a whole one.
+	VerifySize bool
+
+	// packetReader listens for packets from the server.
+	packetReader *Conn
+
+	// in is the outstanding read from packetReader. It is kept across calls to readResponse until it delivers,
+	// so that a packet arriving just after a wait for it timed out is not lost to an abandoned read.
+	in <-chan Packet
+
+	// remoteAddr is the address at which the server can be reached. It starts as Addr
+	// and becomes the server's TID once the first response is received.
+	remoteAddr net.Addr
+
+	// tidEstablished is set once the first response of a transfer has fixed remoteAddr to the server's TID.
+	tidEstablished bool
+
+	// fileHandler interfaces with the local file that the client is reading from or writing to.
+	fileHandler fileHandler
+
+	// lastSent is the last request, DATA or ACK packet sent by the current transfer, which is retransmitted
+	// if the server does not answer it.
+	lastSent []byte
+
+	// blockSize is the block size of the current transfer, which the server may change in its OACK.
+	blockSize int
+
+	// transferred is the number of bytes of the file downloaded or uploaded so far by the current transfer.
+	transferred int64
+
+	// total is the size of the file of the current transfer, or -1 if it is not known.
+	total int64
+}
+
+// Mode is the transfer mode of a Client or a request, as defined in RFC 1350.
+type Mode int
+
+const (
+	// ModeOctet transfers files as raw 8-bit bytes.
+	ModeOctet Mode = iota
+
+	// ModeNetascii transfers text files as netascii, as defined in RFC 764.
+	ModeNetascii
+)
+
+// encodingFlag returns the encodingFlag of the client's Mode.
+func (client *Client) encodingFlag() encodingFlag {
+	if client.Mode == ModeNetascii {
+		return netascii
+	}
+	return octet
+}
+
+func NewClient(addr string, errorLog *log.Logger) *Client {
+	client := &Client{
+		Addr:     addr,
+		ErrorLog: errorLog,
+	}
+	return client
+}
+
+// Download reads the file named remote from the server and writes it to w. It returns the number
+// of bytes written to w before any error, which for a netascii transfer is counted after conversion.
+func (client *Client) Download(remote string, w io.Writer) (n int64, err error) {
+	req := createRequestPacket(read, remote, client.encodingFlag())
+	return client.transfer(&req, &streamHandler{writer: w, netascii: client.Mode == ModeNetascii})
+}
+
+// Upload reads r until io.EOF and writes it to the server as the file named remote. It returns the
+// number of bytes read from r and sent to the server, which for a netascii transfer is counted before
+// conversion.
+func (client *Client) Upload(r io.Reader, remote string) (n int64, err error) {
+	req := createRequestPacket(write, remote, client.encodingFlag())
+	return client.transfer(&req, &streamHandler{reader: r, netascii: client.Mode == ModeNetascii})
+}
+
+// DownloadFile reads the file named remote from the server and writes it to the local file named local,
+// which must not exist yet. If the transfer fails, the partially written local file is removed.
+// It returns the number of bytes written to the local file.
+func (client *Client) DownloadFile(remote, local string) (n int64, err error) {
+	req := createRequestPacket(read, remote, client.encodingFlag())
+	return client.transfer(&req, newBlockStreamer(local, write, client.encodingFlag()))
+}
+
+// UploadFile reads the local file named local and writes it to the server as the file named remote.
+// It returns the number of bytes of the local file sent.
+func (client *Client) UploadFile(local, remote string) (n int64, err error) {
+	req := createRequestPacket(write, remote, client.encodingFlag())
+	return client.transfer(&req, newBlockStreamer(local, read, client.encodingFlag()))
+}
+
+// transfer performs the transfer described by req, reading the data to upload from fh or writing the downloaded
+// data to it, and returns the number of bytes transferred.
+func (client *Client) transfer(req *RequestPacket, fh fileHandler) (n int64, err error) {
+	client.transferred = 0
+	client.total = -1
+	req.options, err = client.requestedOptions(req.openFlag)
+	if err != nil {
+		return 0, err
+	}
+	err = client.setup(fh)
+	if err != nil {
+		return 0, err
+	}
+	if sizer, ok := fh.(interface{ size() (int64, error) }); ok && req.openFlag == write {
+		if size, err := sizer.size(); err == nil {
+			client.total = size // an upload knows the size of its own file
+		}
+	}
+	defer func() {
+		if err != nil {
+			client.abort()
+		} else {
+			err = client.close()
+		}
+		client.countTransferred(0) // closing a netascii download writes out a CR held back by its decoder
+		n = client.transferred
+	}()
+
+	err = client.sendRequest(req)
+	if err != nil {
+		return 0, err
+	}
+
+	switch req.openFlag {
+	case read:
+		return 0, client.download(req)
+	case write:
+		return 0, client.upload(req)
+	default:
+		panic(req.openFlag)
+	}
+}
+
+func (client *Client) setup(fh fileHandler) error { // setup() is an instance of Sequential coupling...
+	err := client.setupRemoteAddr()
+	if err != nil {
+		return err
+	}
+
+	err = client.setupPacketReader()
+	if err != nil {
+		return err
+	}
+
+	err = client.setupFileHandler(fh)
+	if err != nil {
+		_ = client.packetReader.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (client *Client) setupRemoteAddr() error {
+	addr := client.Addr
+	if addr == "" {
+		addr = ":tftp"
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	client.remoteAddr = remoteAddr
+	client.tidEstablished = false
+	return nil
+}
+
+func (client *Client) setupPacketReader() error {
+	conn, err := NewConn(":0") // :0 tells the OS to assign an ephemeral port
+	if err != nil {
+		return err
+	}
+	client.packetReader = conn
+	client.in = nil
+	return nil
+}
+
+// setupFileHandler opens the local side of the transfer. It is opened in the opposite direction of the
+// request: a download (RRQ) writes the received data to it, and an upload (WRQ) reads the data to send from it.
+func (client *Client) setupFileHandler(fh fileHandler) error {
+	err := fh.Open()
+	if err != nil {
+		return err
+	}
+	client.fileHandler = fh
+	return nil
+}
+
+// requestedOptions returns the options the client requests for a transfer, as defined in RFC 2347.
+func (client *Client) requestedOptions(openFlag openFlag) (map[string]string, error) {
+	client.blockSize = defaultBlockSize
+	options := make(map[string]string)
+	if client.BlockSize != 0 {
+		if client.BlockSize < minBlockSize || client.BlockSize > maxBlockSize {
+			return nil, fmt.Errorf("tftp: block size %v is outside of the range %v to %v", client.BlockSize, minBlockSize, maxBlockSize)
+		}
+		blockSize := client.BlockSize
+		if blockSize > maxAcceptedBlockSize {
+			blockSize = maxAcceptedBlockSize // larger DATA packets would not fit in the client's read buffer
+		}
+		options[blksizeOption] = strconv.Itoa(blockSize)
+	}
+	if (client.OnProgress != nil || client.VerifySize) && openFlag == read {
+		options[tsizeOption] = "0" // asks the server for the size of the file, to report progress against
+	}
+	return options, nil
+}
+
+// acceptOptions applies the options the server acknowledged in an OACK. RFC 2347 requires the client to
+// reject an OACK holding an option it did not request, or a value it cannot accept.
+func (client *Client) acceptOptions(req *RequestPacket, oackPacket *OackPacket) error {
+	for name, value := range oackPacket.options {
+		requested, ok := req.options[name]
+		if !ok {
+			return fmt.Errorf("tftp: server acknowledged option %v, which was not requested", name)
+		}
+		switch name {
+		case blksizeOption:
+			blockSize, err := strconv.Atoi(value)
+			maxSize, _ := strconv.Atoi(requested)
+			if err != nil || blockSize < minBlockSize || blockSize > maxSize {
+				return fmt.Errorf("tftp: server acknowledged invalid block size %q", value)
+			}
+			client.blockSize = blockSize
+		case tsizeOption:
+			total, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || total < 0 {
+				return fmt.Errorf("tftp: server acknowledged invalid transfer size %q", value)
+			}
+			client.total = total
+		}
+	}
+	return nil
+}
+
+// countTransferred counts n more bytes of the file as transferred. A netascii transfer counts the bytes of the
+// local file instead, as its file handler has converted them, so n is counted only by an octet transfer.
+func (client *Client) countTransferred(n int) {
+	if counter, ok := client.fileHandler.(interface{ decodedBytes() (int64, bool) }); ok {
+		if decoded, ok := counter.decodedBytes(); ok {
+			client.transferred = decoded
+			return
+		}
+	}
+	client.transferred += int64(n)
+}
+
+// progress reports the progress of the transfer to OnProgress, if it is set.
+func (client *Client) progress() {
+	if client.OnProgress != nil {
+		client.OnProgress(client.transferred, client.total)
+	}
+}
+
+// rejectOptions tells the server that the client does not accept the options in its OACK with the
+// option negotiation error defined in RFC 2347, and returns err.
+func (client *Client) rejectOptions(err error) error {
+	pak, packetErr := createErrorPacket(errOptions.fmt("%v", err))
+	if packetErr == nil {
+		_ = client.sendPacket(pak.raw)
+	}
+	return err
+}
+
+func (client *Client) sendRequest(req *RequestPacket) error {
+	raw, err := req.bytes()
+	if err != nil {
+		return err
+	}
+	client.lastSent = raw
+	return client.sendPacket(raw)
+}
+
+// download receives DATA packets from the server, writing each new block to the local file and
+// acknowledging it, until a block shorter than the block size marks the end of the file.
+func (client *Client) download(req *RequestPacket) error {
+	expectedBlockNumber := uint16(1)
+	retransmissions := 0
+	for {
+		packet, err := client.readResponse()
+		if errors.Is(err, context.DeadlineExceeded) && retransmissions < client.maxRetransmissions() {
+			// The request, the last ACK, or the block answering it was lost, so the request or ACK is sent again.
+			retransmissions++
+			err = client.sendPacket(client.lastSent)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if oackPacket, err := parseOackPacket(packet); err == nil && expectedBlockNumber == 1 {
+			err = client.acceptOptions(req, oackPacket)
+			if err != nil {
+				return client.rejectOptions(err)
+			}
+			err = client.sendAck(0) // ACK(0) acknowledges the OACK, and the server answers it with DATA(1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		dataPacket, err := parseDataPacket(packet)
+		if err != nil {
+			client.logf("tftp: ignoring unexpected packet from %v - %v", packet.from, err)
+			continue
+		}
+
+		switch dataPacket.blockNumber {
+		case expectedBlockNumber:
+			retransmissions = 0
+			n, err := client.fileHandler.Write(dataPacket.data)
+			client.countTransferred(n)
+			if err != nil {
+				return err
+			}
+			client.progress()
+			err = client.sendAck(dataPacket.blockNumber)
+			if err != nil {
+				return err
+			}
+			if len(dataPacket.data) < client.blockSize {
+				return client.checkTransferSize(req)
+			}
+			expectedBlockNumber++
+		case expectedBlockNumber - 1: // our ACK was lost, so the server resent the previous block
+			err = client.sendAck(dataPacket.blockNumber)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkTransferSize returns an error if the server announced the size of the file of an octet download, and the
+// download received a different number of bytes. The sizes of netascii transfers change in conversion, so they
+// are not checked.
+func (client *Client) checkTransferSize(req *RequestPacket) error {
+	if client.total < 0 || req.encodingFlag != octet {
+		return nil
+	}
+	if client.transferred != client.total {
+		return fmt.Errorf("tftp: %w: received %v bytes, but the server announced %v", ErrTransferSizeMismatch, client.transferred, client.total)
+	}
+	return nil
+}
+
+// upload sends the local file to the server one block at a time, waiting for each block to be
+// acknowledged before sending the next, until a block shorter than the block size has been acknowledged.
+func (client *Client) upload(req *RequestPacket) error {
+	blockNumber := uint16(0) // the server acknowledges a WRQ with block number 0, or with an OACK
+	finished := false
+	retransmissions := 0
+	for {
+		packet, err := client.readResponse()
+		if errors.Is(err, context.DeadlineExceeded) && retransmissions < client.maxRetransmissions() {
+			// The block or its ACK was lost. The final block is retransmitted too, as the
+			// upload has not succeeded until the server acknowledges it.
+			retransmissions++
+			err = client.sendPacket(client.lastSent)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var ackBlockNumber uint16
+		if oackPacket, err := parseOackPacket(packet); err == nil && blockNumber == 0 {
+			err = client.acceptOptions(req, oackPacket)
+			if err != nil {
+				return client.rejectOptions(err)
+			}
+			ackBlockNumber = 0 // the OACK takes the place of ACK(0)
+		} else {
+			ackPacket, err := parseAckPacket(packet)
+			if err != nil {
+				client.logf("tftp: ignoring unexpected packet from %v - %v", packet.from, err)
+				continue
+			}
+			ackBlockNumber = ackPacket.blockNumber
+		}
+		if ackBlockNumber != blockNumber {
+			continue // never respond to a duplicate ACK, see the Sorcerer's Apprentice Syndrome in RFC 1123
+		}
+		retransmissions = 0
+
+		if finished {
+			return nil
+		}
+
+		data := make([]byte, client.blockSize)
+		n, err := client.fileHandler.Read(data)
+		if err == io.EOF {
+			finished = true
+		} else if err != nil {
+			return err
+		}
+
+		blockNumber++
+		err = client.sendData(blockNumber, data[:n])
+		if err != nil {
+			return err
+		}
+		client.countTransferred(n)
+		client.progress()
+	}
+}
+
+// readResponse waits up to the client's timeout for the next packet from the server. The first
+// packet received establishes the server's TID, and ERROR packets are returned as errors. Packets
+// from any other TID are answered with an unknown transfer ID error and otherwise ignored.
+func (client *Client) readResponse() (Packet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.timeout())
+	defer cancel()
+
+	var packet Packet
+	for {
+		if client.in == nil {
+			client.in = client.packetReader.Read(context.Background()) // outlives ctx, see Client.in
+		}
+		select {
+		case packet = <-client.in:
+			client.in = nil
+			if packet.error != nil {
+				return packet, packet.error
+			}
+		case <-ctx.Done():
+			return packet, ctx.Err()
+		}
+
+		if !client.tidEstablished {
+			client.remoteAddr = packet.from
+			client.tidEstablished = true
+			break
+		}
+		if packet.from.String() == client.remoteAddr.String() {
+			break
+		}
+		client.rejectUnknownTID(packet.from)
+	}
+
+	if op, err := packet.readOpCode(); err == nil && op == ERROR {
+		errorPacket, err := parseErrorPacket(packet)
+		if err != nil {
+			return packet, err
+		}
+		return packet, errorPacket.tftpError
+	}
+	return packet, nil
+}
+
+// rejectUnknownTID sends an unknown transfer ID error to addr, which sent a packet that is not
+// part of the transfer, as RFC 1350 requires. The transfer itself is unaffected.
+func (client *Client) rejectUnknownTID(addr net.Addr) {
+	client.logf("tftp: ignoring packet from unknown transfer ID %v", addr)
+	tidError := errTID.fmt("expected packets from %v", client.remoteAddr)
+	pak, err := createErrorPacket(tidError)
+	if err != nil {
+		return
+	}
+	err = client.packetReader.writeTo(pak.raw, addr, client.timeout())
+	if err != nil {
+		client.logf("tftp: error sending error packet to %v - %v", addr, err)
+	}
+}
+
+func (client *Client) timeout() time.Duration {
+	if client.Timeout > 0 {
+		return client.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (client *Client) maxRetransmissions() int {
+	switch {
+	case client.MaxRetransmissions < 0:
+		return 0
+	case client.MaxRetransmissions == 0:
+		return defaultMaxRetransmissions
+	default:
+		return client.MaxRetransmissions
+	}
+}
+
+func (client *Client) sendAck(blockNumber uint16) error {
+	raw, err := createAckPacket(blockNumber).bytes()
+	if err != nil {
+		return err
+	}
+	client.lastSent = raw
+	return client.sendPacket(raw)
+}
+
+func (client *Client) sendData(blockNumber uint16, data []byte) error {
+	raw, err := createDataPacket(blockNumber, data).bytes()
+	if err != nil {
+		return err
+	}
+	client.lastSent = raw
+	return client.sendPacket(raw)
+}
+
+func (client *Client) sendPacket(pak []byte) error {
+	return client.packetReader.writeTo(pak, client.remoteAddr, client.timeout())
+}
+
+func (client *Client) close() error {
+	packetReaderErr := client.packetReader.Close()
+	fileHandlerErr := client.fileHandler.Close()
+
+	if packetReaderErr != nil {
+		return packetReaderErr
+	}
+	return fileHandlerErr
+}
+
+// abort closes the connection after a failed transfer, discarding a partially downloaded local file.
+func (client *Client) abort() {
+	_ = client.packetReader.Close()
+	err := client.fileHandler.Abort()
+	if err != nil {
+		client.logf("tftp: error aborting transfer - %v", err)
+	}
+}
+
+func (client *Client) logf(format string, args ...interface{}) {
+	if client.ErrorLog != nil {
+		client.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
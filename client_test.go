@@ -0,0 +1,626 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyProxy relays packets between a client and a server, dropping those that drop selects. The client
+// sends everything to the proxy, which forwards requests to the server's address and everything else to
+// the server's TID, so that the client sees a single TID throughout.
+type lossyProxy struct {
+	front, back net.PacketConn
+	server      net.Addr
+	drop        func(toServer bool, pak []byte) bool
+
+	mu     sync.Mutex
+	client net.Addr // client is the address of the client, once it has sent a packet.
+	tid    net.Addr // tid is the server's TID, once it has answered.
+}
+
+func newLossyProxy(t *testing.T, server net.Addr, drop func(toServer bool, pak []byte) bool) *lossyProxy {
+	t.Helper()
+	front, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &lossyProxy{front: front, back: back, server: server, drop: drop}
+	go proxy.relay(front, true)
+	go proxy.relay(back, false)
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+	return proxy
+}
+
+func (proxy *lossyProxy) Addr() string {
+	return proxy.front.LocalAddr().String()
+}
+
+func (proxy *lossyProxy) relay(from net.PacketConn, toServer bool) {
+	buffer := make([]byte, bufferSize)
+	for {
+		n, addr, err := from.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		pak := buffer[:n]
+
+		proxy.mu.Lock()
+		var to net.Addr
+		var via net.PacketConn
+		if toServer {
+			proxy.client = addr
+			to, via = proxy.tid, proxy.back
+			if op := opCode(binary.BigEndian.Uint16(pak)); op == RRQ || op == WRQ || to == nil {
+				to = proxy.server
+			}
+		} else {
+			proxy.tid = addr
+			to, via = proxy.client, proxy.front
+		}
+		dropped := proxy.drop(toServer, pak)
+		proxy.mu.Unlock()
+
+		if !dropped {
+			_, _ = via.WriteTo(pak, to)
+		}
+	}
+}
+
+// dropOnce returns a drop function for lossyProxy that drops the first packet matching the direction and
+// leading bytes given.
+func dropOnce(toServer bool, prefix ...byte) func(bool, []byte) bool {
+	dropped := false
+	return func(direction bool, pak []byte) bool {
+		if dropped || direction != toServer || !bytes.HasPrefix(pak, prefix) {
+			return false
+		}
+		dropped = true
+		return true
+	}
+}
+
+// startPatientServer starts a server that never retransmits, so that a transfer only survives a lost
+// packet if the client retransmits.
+func startPatientServer(t *testing.T) *Server {
+	return startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+		srv.MaxRetransmissions = -1
+	})
+}
+
+func newTestClient(addr string) *Client {
+	client := NewClient(addr, log.New(io.Discard, "", 0))
+	client.Timeout = 100 * time.Millisecond
+	return client
+}
+
+func TestClientRetransmitsAfterLostPacket(t *testing.T) {
+	data := testData(3*512 + 100)
+	tests := []struct {
+		name     string
+		upload   bool
+		toServer bool
+		prefix   []byte
+	}{
+		{"upload lost WRQ", true, true, []byte{0, byte(WRQ)}},
+		{"upload lost ACK(2)", true, false, []byte{0, byte(ACK), 0, 2}},
+		{"upload lost DATA(3)", true, true, []byte{0, byte(DATA), 0, 3}},
+		{"download lost RRQ", false, true, []byte{0, byte(RRQ)}},
+		{"download lost DATA(1)", false, false, []byte{0, byte(DATA), 0, 1}},
+		{"download lost ACK(2)", false, true, []byte{0, byte(ACK), 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startPatientServer(t)
+			proxy := newLossyProxy(t, srv.LocalAddr(), dropOnce(tt.toServer, tt.prefix...))
+			client := newTestClient(proxy.Addr())
+
+			if tt.upload {
+				n, err := client.Upload(bytes.NewReader(data), "f")
+				if err != nil || n != int64(len(data)) {
+					t.Fatalf("Upload = %v, %v, want %v, nil", n, err, len(data))
+				}
+				waitForContent(t, filepath.Join(srv.Root, "f"), data)
+				return
+			}
+
+			writeFile(t, srv.Root, "f", data)
+			var buf bytes.Buffer
+			n, err := client.Download("f", &buf)
+			if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("Download = %v, %v, want %v, nil", n, err, len(data))
+			}
+		})
+	}
+}
+
+func TestClientRetransmitsAfterLostOACK(t *testing.T) {
+	srv := startPatientServer(t)
+	data := testData(3000)
+	writeFile(t, srv.Root, "f", data)
+	proxy := newLossyProxy(t, srv.LocalAddr(), dropOnce(true, 0, byte(ACK), 0, 0)) // the ACK(0) of the OACK
+	client := newTestClient(proxy.Addr())
+	client.BlockSize = 1024
+
+	var buf bytes.Buffer
+	n, err := client.Download("f", &buf)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("Download = %v, %v, want %v, nil", n, err, len(data))
+	}
+}
+
+// TestUploadFinalAckLost runs an upload against a scripted server that ignores the final block the first
+// time it arrives, as if its ACK had been lost, and acknowledges it when it is retransmitted.
+func TestUploadFinalAckLost(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	finalBlocks := make(chan int, 1)
+	go func() {
+		buffer := make([]byte, bufferSize)
+		_, client, err := listener.ReadFrom(buffer) // WRQ
+		if err != nil {
+			return
+		}
+		tid, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer tid.Close()
+		_, _ = tid.WriteTo([]byte{0, byte(ACK), 0, 0}, client)
+
+		received := 0
+		_ = tid.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			n, _, err := tid.ReadFrom(buffer)
+			if err != nil {
+				break
+			}
+			if opCode(binary.BigEndian.Uint16(buffer)) != DATA {
+				continue
+			}
+			block := buffer[2:4]
+			if n-4 == 512 {
+				_, _ = tid.WriteTo([]byte{0, byte(ACK), block[0], block[1]}, client)
+				continue
+			}
+			received++
+			if received == 1 {
+				_, _ = tid.WriteTo([]byte{0, byte(ACK), 0, 0}, client) // a stale ACK must not end the upload
+				continue
+			}
+			_, _ = tid.WriteTo([]byte{0, byte(ACK), block[0], block[1]}, client)
+			break
+		}
+		finalBlocks <- received
+	}()
+
+	client := newTestClient(listener.LocalAddr().String())
+	data := testData(512 + 5)
+	n, err := client.Upload(bytes.NewReader(data), "f")
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Upload = %v, %v, want %v, nil", n, err, len(data))
+	}
+	if received := <-finalBlocks; received != 2 {
+		t.Errorf("server received the final block %v times, want 2", received)
+	}
+}
+
+func TestClientGivesUpAfterMaxRetransmissions(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0") // never answers
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client := newTestClient(listener.LocalAddr().String())
+	client.MaxRetransmissions = 2
+	start := time.Now()
+	_, err = client.Download("f", io.Discard)
+	if err == nil {
+		t.Fatal("Download from a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed < 3*client.Timeout {
+		t.Errorf("Download gave up after %v, before retransmitting twice", elapsed)
+	}
+}
+
+func TestNetasciiByteCounts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the client converts LF line separators to CR LF on Windows")
+	}
+	srv := startServer(t, nil)
+	text := []byte(strings.Repeat("line\n", 300)) // each LF is sent as CR LF, so 1800 bytes are transferred
+	writeFile(t, srv.Root, "text", text)
+
+	client := newTestClient(srv.LocalAddr().String())
+	client.Mode = ModeNetascii
+	var lastProgress int64
+	client.OnProgress = func(transferred, total int64) {
+		lastProgress = transferred
+	}
+
+	var buf bytes.Buffer
+	n, err := client.Download("text", &buf)
+	if err != nil || n != int64(len(text)) || lastProgress != n {
+		t.Fatalf("Download = %v, %v with progress %v, want %v, nil", n, err, lastProgress, len(text))
+	}
+	if !bytes.Equal(buf.Bytes(), text) {
+		t.Errorf("downloaded %q, want %q", buf.Bytes(), text)
+	}
+
+	n, err = client.Upload(bytes.NewReader(text), "uploaded")
+	if err != nil || n != int64(len(text)) || lastProgress != n {
+		t.Fatalf("Upload = %v, %v with progress %v, want %v, nil", n, err, lastProgress, len(text))
+	}
+	waitForContent(t, filepath.Join(srv.Root, "uploaded"), text)
+}
+
+// scriptedServer answers each packet a client sends it with the next packet of script, sent from the address it
+// listens on, so that a test can play a server that misbehaves. It stops answering once script runs out.
+func scriptedServer(t *testing.T, script ...[]byte) net.Addr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, bufferSize)
+		for _, pak := range script {
+			_, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(pak, addr)
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+func TestVerifySize(t *testing.T) {
+	data := []byte("ten bytes!")
+	tests := []struct {
+		tsize string
+		want  error
+	}{
+		{"10", nil},
+		{"100", ErrTransferSizeMismatch},
+		{"5", ErrTransferSizeMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.tsize, func(t *testing.T) {
+			addr := scriptedServer(t,
+				mustBytes(createOackPacket(map[string]string{tsizeOption: test.tsize}).bytes()),
+				mustBytes(createDataPacket(1, data).bytes()),
+			)
+			client := newTestClient(addr.String())
+			client.VerifySize = true
+			var got bytes.Buffer
+			_, err := client.Download("f", &got)
+			if !errors.Is(err, test.want) {
+				t.Errorf("Download returned %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestClientRejectsForeignTID(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	stranger := newRawClient(t)
+	first, second := testData(defaultBlockSize), []byte("the rest")
+
+	go func() {
+		buffer := make([]byte, bufferSize)
+		_, client, err := server.ReadFrom(buffer) // the RRQ
+		if err != nil {
+			return
+		}
+		_, _ = server.WriteTo(mustBytes(createDataPacket(1, first).bytes()), client)
+		if _, _, err = server.ReadFrom(buffer); err != nil { // ACK(1), after which the client knows the server's TID
+			return
+		}
+		_, _ = stranger.conn.WriteTo(mustBytes(createDataPacket(2, []byte("forged")).bytes()), client)
+		time.Sleep(20 * time.Millisecond)
+		_, _ = server.WriteTo(mustBytes(createDataPacket(2, second).bytes()), client)
+	}()
+
+	var got bytes.Buffer
+	_, err = newTestClient(server.LocalAddr().String()).Download("f", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), first...), second...); !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("downloaded %q, want the server's %v bytes", got.Bytes(), len(want))
+	}
+	errorPacket := stranger.receiveError()
+	if errorPacket.errorCode != errTID.errorCode {
+		t.Errorf("stranger got ERROR %v, want %v (unknown transfer ID)", errorPacket.errorCode, errTID.errorCode)
+	}
+}
+
+func TestDownloadFileAndUploadFile(t *testing.T) {
+	srv := startServer(t, nil)
+	data := testData(3*defaultBlockSize + 10)
+	writeFile(t, srv.Root, "remote", data)
+	client := newTestClient(srv.LocalAddr().String())
+	local := filepath.Join(t.TempDir(), "local")
+
+	n, err := client.DownloadFile("remote", local)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("DownloadFile = %v, %v, want %v, nil", n, err, len(data))
+	}
+	got, err := os.ReadFile(local)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("local file holds %v bytes (%v), want %v", len(got), err, len(data))
+	}
+
+	_, err = client.DownloadFile("remote", local)
+	if !os.IsExist(err) {
+		t.Errorf("DownloadFile over an existing file returned %v, want an error that it exists", err)
+	}
+
+	n, err = client.UploadFile(local, "uploaded")
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("UploadFile = %v, %v, want %v, nil", n, err, len(data))
+	}
+	waitForContent(t, filepath.Join(srv.Root, "uploaded"), data)
+
+	_, err = client.UploadFile(filepath.Join(t.TempDir(), "missing"), "never")
+	if !os.IsNotExist(err) {
+		t.Errorf("UploadFile of a missing file returned %v, want an error that it does not exist", err)
+	}
+}
+
+func TestFailedDownloadFileRemovesPartialFile(t *testing.T) {
+	addr := scriptedServer(t,
+		mustBytes(createDataPacket(1, testData(defaultBlockSize)).bytes()),
+		rawErrorPacket(errNotDef.fmt("disk failed")),
+	)
+	local := filepath.Join(t.TempDir(), "local")
+
+	_, err := newTestClient(addr.String()).DownloadFile("f", local)
+	if err == nil {
+		t.Fatal("DownloadFile succeeded after the server failed")
+	}
+	if _, statErr := os.Stat(local); !os.IsNotExist(statErr) {
+		t.Errorf("the partial download was kept: %v", statErr)
+	}
+}
+
+func TestDownloadMissingFileMatchesErrFileNotFound(t *testing.T) {
+	srv := startServer(t, nil)
+	_, err := newTestClient(srv.LocalAddr().String()).Download("missing", io.Discard)
+	if err == nil {
+		t.Fatal("Download of a missing file succeeded")
+	}
+	wrapped := fmt.Errorf("fetching config: %w", err)
+	if !errors.Is(wrapped, ErrFileNotFound) || errors.Is(wrapped, ErrAccessViolation) {
+		t.Errorf("Download returned %v, which should match ErrFileNotFound alone once wrapped", err)
+	}
+	if code, ok := ErrorCodeOf(wrapped); !ok || code != CodeFileNotFound {
+		t.Errorf("ErrorCodeOf(%v) = %v, %v, want %v", wrapped, code, ok, CodeFileNotFound)
+	}
+}
+
+func TestDownloadAndUpload(t *testing.T) {
+	srv := startServer(t, nil)
+	for _, blockSize := range []int{0, 1024} {
+		for _, size := range []int{0, 1, defaultBlockSize - 1, defaultBlockSize, 2 * defaultBlockSize, 3000} {
+			t.Run(fmt.Sprintf("blksize %v, %v bytes", blockSize, size), func(t *testing.T) {
+				data := testData(size)
+				remote := fmt.Sprintf("f-%v-%v", blockSize, size)
+				writeFile(t, srv.Root, remote, data)
+				client := newTestClient(srv.LocalAddr().String())
+				client.BlockSize = blockSize
+
+				var got bytes.Buffer
+				n, err := client.Download(remote, &got)
+				if err != nil || n != int64(size) || !bytes.Equal(got.Bytes(), data) {
+					t.Fatalf("Download = %v, %v and received %v bytes, want %v bytes", n, err, got.Len(), size)
+				}
+
+				n, err = client.Upload(bytes.NewReader(data), remote+"-uploaded")
+				if err != nil || n != int64(size) {
+					t.Fatalf("Upload = %v, %v, want %v, nil", n, err, size)
+				}
+				waitForContent(t, filepath.Join(srv.Root, remote+"-uploaded"), data)
+			})
+		}
+	}
+}
+
+// progressRecorder records the calls made to a Client's OnProgress, and fails the test if the number of bytes
+// transferred ever decreases or the total changes.
+type progressRecorder struct {
+	t           *testing.T
+	calls       int
+	transferred int64
+	total       int64
+}
+
+func (recorder *progressRecorder) onProgress(transferred, total int64) {
+	if recorder.calls > 0 && (transferred < recorder.transferred || total != recorder.total) {
+		recorder.t.Errorf("OnProgress(%v, %v) after OnProgress(%v, %v)", transferred, total, recorder.transferred, recorder.total)
+	}
+	recorder.calls++
+	recorder.transferred = transferred
+	recorder.total = total
+}
+
+func TestOnProgress(t *testing.T) {
+	srv := startServer(t, nil)
+	for _, size := range []int{0, defaultBlockSize, 3000} {
+		t.Run(fmt.Sprintf("%v bytes", size), func(t *testing.T) {
+			data := testData(size)
+			remote := fmt.Sprintf("f-%v", size)
+			writeFile(t, srv.Root, remote, data)
+			local := filepath.Join(t.TempDir(), "local")
+			blocks := size/defaultBlockSize + 1
+			client := newTestClient(srv.LocalAddr().String())
+
+			transfers := []struct {
+				name      string
+				transfer  func() (int64, error)
+				wantTotal int64 // wantTotal is -1 when the size of an upload from a stream is not known
+			}{
+				{"DownloadFile", func() (int64, error) { return client.DownloadFile(remote, local) }, int64(size)},
+				{"UploadFile", func() (int64, error) { return client.UploadFile(local, remote+"-file") }, int64(size)},
+				{"Upload", func() (int64, error) { return client.Upload(bytes.NewReader(data), remote+"-stream") }, -1},
+			}
+			for _, transfer := range transfers {
+				recorder := &progressRecorder{t: t}
+				client.OnProgress = recorder.onProgress
+				n, err := transfer.transfer()
+				if err != nil || n != int64(size) {
+					t.Fatalf("%v = %v, %v, want %v, nil", transfer.name, n, err, size)
+				}
+				if recorder.calls != blocks || recorder.transferred != int64(size) || recorder.total != transfer.wantTotal {
+					t.Errorf("%v: last of %v calls was OnProgress(%v, %v), want call %v to be OnProgress(%v, %v)",
+						transfer.name, recorder.calls, recorder.transferred, recorder.total, blocks, size, transfer.wantTotal)
+				}
+			}
+		})
+	}
+}
+
+// linkLocalAddr returns a link-local IPv6 address of an interface that is up, with the interface as its zone,
+// skipping the test if there is none.
+func linkLocalAddr(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("cannot list the network interfaces: %v", err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return &net.UDPAddr{IP: ipNet.IP, Zone: iface.Name}
+			}
+		}
+	}
+	t.Skip("no interface has a link-local IPv6 address")
+	return nil
+}
+
+func TestClientZonedIPv6Addr(t *testing.T) {
+	local := linkLocalAddr(t)
+	srv := NewServer(t.TempDir(), local.String(), log.New(io.Discard, "", 0))
+	stop := make(chan CancelType)
+	done := srv.Serve(stop)
+	select {
+	case <-srv.Ready():
+	case err := <-done:
+		t.Skipf("cannot listen on %v: %v", local, err)
+	}
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	data := testData(1000)
+	writeFile(t, srv.Root, "f", data)
+
+	port := srv.LocalAddr().(*net.UDPAddr).Port
+	client := newTestClient(fmt.Sprintf("[%v%%%v]:%v", local.IP, local.Zone, port))
+	var got bytes.Buffer
+	if n, err := client.Download("f", &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("Download from %v = %v, %v", client.Addr, n, err)
+	}
+	if remote, ok := client.remoteAddr.(*net.UDPAddr); !ok || remote.Zone != local.Zone {
+		t.Errorf("the client last sent to %v, want an address with zone %q", client.remoteAddr, local.Zone)
+	}
+	if n, err := client.Upload(bytes.NewReader(data), "uploaded"); err != nil || n != int64(len(data)) {
+		t.Fatalf("Upload to %v = %v, %v", client.Addr, n, err)
+	}
+	waitForContent(t, filepath.Join(srv.Root, "uploaded"), data)
+}
+
+func TestClientMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the client converts LF line separators to CR LF on Windows")
+	}
+	var mu sync.Mutex
+	var requested []Mode
+	srv := startServer(t, func(srv *Server) {
+		srv.OnRequest = func(packet Packet) bool {
+			if req, err := parseRequestPacket(packet, false); err == nil {
+				mu.Lock()
+				requested = append(requested, req.Mode())
+				mu.Unlock()
+			}
+			return true
+		}
+	})
+	text := []byte("line\nbare\rcarriage return\n")
+	writeFile(t, srv.Root, "text", text)
+
+	tests := []struct {
+		name string
+		mode Mode
+	}{
+		{"default", 0},
+		{"octet", ModeOctet},
+		{"netascii", ModeNetascii},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			requested = nil
+			mu.Unlock()
+			client := newTestClient(srv.LocalAddr().String())
+			client.Mode = tt.mode
+
+			var got bytes.Buffer
+			if n, err := client.Download("text", &got); err != nil || n != int64(len(text)) || !bytes.Equal(got.Bytes(), text) {
+				t.Fatalf("Download = %v, %v and received %q, want %q", n, err, got.Bytes(), text)
+			}
+			if n, err := client.Upload(bytes.NewReader(text), "uploaded-"+tt.name); err != nil || n != int64(len(text)) {
+				t.Fatalf("Upload = %v, %v, want %v, nil", n, err, len(text))
+			}
+			waitForContent(t, filepath.Join(srv.Root, "uploaded-"+tt.name), text)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(requested) != 2 || requested[0] != tt.mode || requested[1] != tt.mode {
+				t.Errorf("requests were sent in modes %v, want %v", requested, tt.mode)
+			}
+		})
+	}
+}
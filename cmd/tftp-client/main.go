@@ -0,0 +1,134 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command tftp-client downloads files from and uploads files to a TFTP server.
+//
+// Usage:
+//
+//	tftp-client [flags] get remote [local]
+//	tftp-client [flags] put local [remote]
+//
+// The local file defaults to the base name of the remote file, and the remote file defaults to the
+// base name of the local file. A local file named "-" is standard output for get and standard input
+// for put, so that data can be piped through the client.
+//
+// Files are transferred byte for byte. With -mode netascii, text files are transferred as netascii,
+// converting between the line endings of the local host and those of netascii.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/benshields/tftp"
+)
+
+// stderr receives the usage and error messages of the client.
+var stderr io.Writer = os.Stderr
+
+// errUsage is returned by run for a command line that does not follow the usage, which has been printed.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	err := run(os.Args[1:])
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	default:
+		fmt.Fprintf(stderr, "tftp-client: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the client with the command line arguments args, which exclude the program name.
+func run(args []string) error {
+	flags := flag.NewFlagSet("tftp-client", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:tftp", "address of the TFTP server")
+	blockSize := flags.Int("blksize", 0, "block size to request from the server, or 0 for the default of 512 bytes")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each packet from the server")
+	mode := flags.String("mode", "octet", "transfer mode, octet or netascii")
+	flags.SetOutput(stderr)
+	flags.Usage = func() { usage(flags) }
+	err := flags.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage // the flag package has printed the error and the usage
+	}
+
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		usage(flags)
+		return errUsage
+	}
+
+	client := tftp.NewClient(*addr, nil)
+	client.BlockSize = *blockSize
+	client.Timeout = *timeout
+	switch *mode {
+	case "octet":
+		client.Mode = tftp.ModeOctet
+	case "netascii":
+		client.Mode = tftp.ModeNetascii
+	default:
+		fmt.Fprintf(stderr, "tftp-client: unknown mode %q\n", *mode)
+		usage(flags)
+		return errUsage
+	}
+
+	switch command := flags.Arg(0); command {
+	case "get":
+		remote, local := flags.Arg(1), flags.Arg(2)
+		if local == "" {
+			local = filepath.Base(remote)
+		}
+		return get(client, remote, local)
+	case "put":
+		local, remote := flags.Arg(1), flags.Arg(2)
+		if remote == "" {
+			if local == "-" {
+				fmt.Fprintf(stderr, "tftp-client: put from standard input needs a remote file name\n")
+				return errUsage
+			}
+			remote = filepath.Base(local)
+		}
+		return put(client, local, remote)
+	default:
+		fmt.Fprintf(stderr, "tftp-client: unknown command %q\n", command)
+		usage(flags)
+		return errUsage
+	}
+}
+
+func get(client *tftp.Client, remote, local string) error {
+	var err error
+	if local == "-" {
+		_, err = client.Download(remote, os.Stdout)
+	} else {
+		_, err = client.DownloadFile(remote, local)
+	}
+	return err
+}
+
+func put(client *tftp.Client, local, remote string) error {
+	var err error
+	if local == "-" {
+		_, err = client.Upload(os.Stdin, remote)
+	} else {
+		_, err = client.UploadFile(local, remote)
+	}
+	return err
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(stderr, "usage: tftp-client [flags] get remote [local]\n")
+	fmt.Fprintf(stderr, "       tftp-client [flags] put local [remote]\n")
+	flags.PrintDefaults()
+}
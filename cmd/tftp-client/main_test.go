@@ -0,0 +1,107 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benshields/tftp"
+)
+
+// startServer starts a server rooted at a new temporary directory on an unused loopback port, and stops it
+// when the test ends.
+func startServer(t *testing.T) *tftp.Server {
+	t.Helper()
+	srv := tftp.NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+	stop := make(chan tftp.CancelType)
+	done := srv.Serve(stop)
+	select {
+	case <-srv.Ready():
+	case err := <-done:
+		t.Fatalf("Serve failed: %v", err)
+	}
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return srv
+}
+
+// waitForContent waits up to two seconds for the file at path to hold want, as the server closes an uploaded
+// file only after sending the ACK that completes the upload.
+func waitForContent(t *testing.T, path string, want []byte) {
+	t.Helper()
+	var got []byte
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		var err error
+		got, err = os.ReadFile(path)
+		if err == nil && bytes.Equal(got, want) {
+			return
+		}
+	}
+	t.Fatalf("%v holds %q, want %q", path, got, want)
+}
+
+func TestGetAndPut(t *testing.T) {
+	for _, mode := range []string{"octet", "netascii"} {
+		t.Run(mode, func(t *testing.T) {
+			srv := startServer(t)
+			addr := srv.LocalAddr().String()
+			local := t.TempDir()
+			data := bytes.Repeat([]byte("a line of text\n"), 100)
+
+			put := filepath.Join(local, "put.txt")
+			err := os.WriteFile(put, data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = run([]string{"-addr", addr, "-mode", mode, "-blksize", "1024", "put", put, "remote.txt"})
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			waitForContent(t, filepath.Join(srv.Root, "remote.txt"), data)
+
+			got := filepath.Join(local, "got.txt")
+			err = run([]string{"-addr", addr, "-mode", mode, "get", "remote.txt", got})
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			waitForContent(t, got, data)
+
+			err = run([]string{"-addr", addr, "-mode", mode, "get", "missing.txt", filepath.Join(local, "missing.txt")})
+			if err == nil {
+				t.Error("get of a missing file succeeded")
+			}
+		})
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	stderr = io.Discard
+	defer func() { stderr = os.Stderr }()
+
+	tests := [][]string{
+		{},
+		{"get"},
+		{"get", "a", "b", "c"},
+		{"fetch", "a"},
+		{"-mode", "binary", "get", "a"},
+		{"-blksize", "large", "get", "a"},
+		{"put", "-"},
+	}
+	for _, args := range tests {
+		err := run(args)
+		if !errors.Is(err, errUsage) {
+			t.Errorf("run(%q) = %v, want %v", args, err, errUsage)
+		}
+	}
+}
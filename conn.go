@@ -7,7 +7,15 @@ package tftp
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Conn struct {
@@ -16,62 +24,296 @@ type Conn struct {
 	// to CloseNotifier callers.
 	rwc net.PacketConn
 
-	buffer []byte // buffer holds the raw last read from rwc
-
 	localAddr net.Addr // address from which the handler is serving the connection
+
+	captureDestination bool // set by CaptureDestination to record the local address each packet was sent to
+
+	closed    chan struct{}  // closed is closed by Close, to stop the goroutines reading from the connection
+	closeOnce sync.Once      // closeOnce makes Close idempotent
+	readers   sync.WaitGroup // readers counts the goroutines reading from the connection, which Close waits for
+}
+
+// readBufferSize is the size of the buffers datagrams are read into. It is one byte larger than the largest
+// packet the server accepts, as a datagram that fills the buffer may have been cut short by it, while a
+// packet of exactly bufferSize bytes is whole.
+const readBufferSize = bufferSize + 1
+
+// readBuffers holds the buffers that Read reads datagrams into.
+var readBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, readBufferSize)
+		return &buffer
+	},
 }
 
 func NewConn(addr string) (*Conn, error) {
-	pc, err := net.ListenPacket("udp", addr)
+	return listenConn(addr, net.ListenConfig{})
+}
+
+// NewReusePortConn is like NewConn, but sets SO_REUSEADDR and SO_REUSEPORT on the socket before it
+// is bound, so that other sockets with the option set can listen on the same address at the same
+// time, such as a new instance of a server starting while the old one finishes its transfers. It
+// returns an error on platforms without SO_REUSEPORT, which are those other than Linux and the BSDs.
+func NewReusePortConn(addr string) (*Conn, error) {
+	return listenConn(addr, net.ListenConfig{Control: setReusePort})
+}
+
+func listenConn(addr string, config net.ListenConfig) (*Conn, error) {
+	pc, err := config.ListenPacket(context.Background(), "udp", addr)
 	if err != nil {
 		return nil, err
 	}
 	c := &Conn{
 		rwc:       pc,
-		buffer:    make([]byte, bufferSize),
 		localAddr: pc.LocalAddr(),
+		closed:    make(chan struct{}),
 	}
 	return c, nil
 }
 
+// errPortRangeExhausted is returned by newConnInPortRange when every port in its range is in use.
+var errPortRangeExhausted = errors.New("every port in the range is in use")
+
+// newConnInPortRange listens on the first free port from minPort to maxPort inclusive. The ports are
+// tried starting from a random one, so that consecutive connections do not all contend for the lowest port.
+func newConnInPortRange(minPort, maxPort int) (*Conn, error) {
+	if minPort < 1 || maxPort > math.MaxUint16 || minPort > maxPort {
+		return nil, fmt.Errorf("invalid port range %v-%v", minPort, maxPort)
+	}
+	numPorts := maxPort - minPort + 1
+	start := rand.Intn(numPorts)
+	for i := 0; i < numPorts; i++ {
+		port := minPort + (start+i)%numPorts
+		conn, err := NewConn(":" + strconv.Itoa(port))
+		if err == nil {
+			return conn, nil
+		}
+		if !isAddrInUse(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed to listen on a port from %v to %v: %w", minPort, maxPort, errPortRangeExhausted)
+}
+
+// CaptureDestination makes every packet read from the connection record the local address it was
+// sent to, which Packet.To reports. On a host with several addresses this tells which of them a
+// client sent its request to, so that the reply can be sent from the same address. It returns an
+// error if the platform cannot report the destination address of a datagram.
+func (c *Conn) CaptureDestination() error {
+	udpConn, ok := c.rwc.(*net.UDPConn)
+	if !ok {
+		return errors.New("tftp: capturing the destination address requires a UDP connection")
+	}
+	err := enableDestinationCapture(udpConn)
+	if err != nil {
+		return err
+	}
+	c.captureDestination = true
+	return nil
+}
+
+// SetBufferSizes sets the sizes of the operating system's receive and send buffers for the connection,
+// so that a burst of datagrams arriving faster than they are read is not dropped. A size of zero leaves
+// that buffer at the system's default, and the system may round a size up or cap it at its own limit.
+func (c *Conn) SetBufferSizes(readBytes, writeBytes int) error {
+	udpConn, ok := c.rwc.(*net.UDPConn)
+	if !ok {
+		return errors.New("tftp: setting buffer sizes requires a UDP connection")
+	}
+	if readBytes > 0 {
+		err := udpConn.SetReadBuffer(readBytes)
+		if err != nil {
+			return err
+		}
+	}
+	if writeBytes > 0 {
+		err := udpConn.SetWriteBuffer(writeBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read reads the next packet from the connection. Each call reads into its own buffer, and a Read
+// that is abandoned when ctx is done keeps reading in the background, so a later Read never shares
+// a buffer with one that is still outstanding. The returned channel is buffered, so the goroutine
+// reading never blocks delivering its packet to a caller that has stopped listening: it ends as
+// soon as the read does, or when the connection is closed.
 func (c *Conn) Read(ctx context.Context) <-chan Packet {
-	out := make(chan Packet)
+	out := make(chan Packet, 1) // buffered so the read finishes even if nobody receives its packet
+	c.readers.Add(1)
 	go func() {
-		n, addr, err := c.rwc.ReadFrom(c.buffer)
-		data := make([]byte, n)
-		copy(data, c.buffer[:n])
-		if err != nil {
+		defer c.readers.Done()
+		buffer := readBuffers.Get().(*[]byte)
+		packet := c.readPacket(*buffer)
+		readBuffers.Put(buffer) // readPacket returns a copy of the packet, so the buffer is free again
+		if packet.error != nil {
 			select {
 			case <-ctx.Done():
-				out <- Packet{addr, data, ctx.Err()}
+				packet.error = ctx.Err()
 			default:
-				out <- Packet{addr, data, err}
 			}
-
 		}
-		out <- Packet{addr, data, nil}
+		out <- packet
 	}()
 	return out
 }
 
+// readPacket reads the next packet from the connection into buffer, and returns a copy of it. A read
+// that fails with a temporary error, such as one interrupted by a signal, is retried after a delay
+// that grows with each consecutive failure, as net/http does for Accept, rather than ending the read.
+func (c *Conn) readPacket(buffer []byte) Packet {
+	var tempDelay time.Duration
+	for {
+		packet := c.readPacketOnce(buffer)
+		if !isTemporary(packet.error) || c.isClosed() {
+			return packet
+		}
+		if tempDelay == 0 {
+			tempDelay = 5 * time.Millisecond
+		} else {
+			tempDelay *= 2
+		}
+		if max := 1 * time.Second; tempDelay > max {
+			tempDelay = max
+		}
+		select {
+		case <-time.After(tempDelay):
+		case <-c.closed:
+		}
+	}
+}
+
+// isTemporary reports whether err is a read error that a retry may not hit again. Timeouts are not
+// retried, as they are the deadline of the read expiring.
+func isTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isTemporaryErrno(err) {
+		return true
+	}
+	var temporary interface {
+		Temporary() bool
+		Timeout() bool
+	}
+	return errors.As(err, &temporary) && temporary.Temporary() && !temporary.Timeout()
+}
+
+// readPacketOnce reads the next packet from the connection into buffer, and returns a copy of it.
+func (c *Conn) readPacketOnce(buffer []byte) Packet {
+	if !c.captureDestination {
+		n, addr, err := c.rwc.ReadFrom(buffer)
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		return Packet{from: addr, data: data, truncated: n > bufferSize, error: err}
+	}
+
+	oob := make([]byte, controlMessageSize)
+	n, oobn, _, addr, err := c.rwc.(*net.UDPConn).ReadMsgUDP(buffer, oob)
+	data := make([]byte, n)
+	copy(data, buffer[:n])
+	packet := Packet{data: data, to: parseDestination(oob[:oobn]), truncated: n > bufferSize, error: err}
+	if addr != nil { // a nil *net.UDPAddr must not become a non-nil net.Addr
+		packet.from = addr
+	}
+	return packet
+}
+
+// ReadContinuously reads packets from the connection until ctx is done, at which point the connection is closed.
 func (c *Conn) ReadContinuously(ctx context.Context) <-chan Packet {
-	out := make(chan Packet)
+	return c.ReadConcurrently(ctx, 1)
+}
+
+// ReadConcurrently is like ReadContinuously, but keeps n reads outstanding at once, each into its own
+// buffer, so that a burst of packets is taken off the socket while earlier packets are still being
+// delivered. Packets are delivered in the order their reads complete, so two packets from the same
+// source may be delivered out of order. A reader waiting to deliver a packet that nobody receives
+// gives up once ctx is done or the connection is closed, so no goroutine is left behind.
+func (c *Conn) ReadConcurrently(ctx context.Context, n int) <-chan Packet {
+	if n < 1 {
+		n = 1
+	}
+	out := make(chan Packet, n)
+	c.readers.Add(n)
+	for i := 0; i < n; i++ {
+		go c.readInto(ctx, make([]byte, readBufferSize), out)
+	}
 	go func() {
-		for {
-			in := c.Read(ctx)
-			select {
-			case request := <-in:
-				if request.error == context.Canceled {
-					return
-				}
-				out <- request
-			case <-ctx.Done():
-				err := c.rwc.Close()
-				if err != nil {
-					out <- Packet{nil, nil, err} // TODO refactor to handle this error gracefully!
-				}
-			}
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+		case <-c.closed:
 		}
 	}()
 	return out
 }
+
+// readInto reads packets into buffer and sends them on out until ctx is done or the connection is closed.
+func (c *Conn) readInto(ctx context.Context, buffer []byte, out chan<- Packet) {
+	defer c.readers.Done()
+	for {
+		packet := c.readPacket(buffer)
+		if packet.error != nil && (ctx.Err() != nil || c.isClosed()) {
+			return
+		}
+		select {
+		case out <- packet:
+		case <-ctx.Done():
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// writeTo sends pak to addr. The write fails with a timeout error if the socket cannot take the packet
+// within timeout, such as while its send buffer is full, so that a sender is never stuck in it for good.
+func (c *Conn) writeTo(pak []byte, addr net.Addr, timeout time.Duration) error {
+	err := c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	err = writePacket(c.rwc, pak, addr)
+	if deadlineErr := c.rwc.SetWriteDeadline(time.Time{}); err == nil {
+		err = deadlineErr
+	}
+	return err
+}
+
+// writePacket sends pak to addr over conn as a single datagram. A write that sends only part of pak
+// is reported as an io.ErrShortWrite, as the datagram that went out is a malformed packet.
+func writePacket(conn net.PacketConn, pak []byte, addr net.Addr) error {
+	n, err := conn.WriteTo(pak, addr)
+	if err != nil {
+		return err
+	}
+	if n < len(pak) {
+		return fmt.Errorf("sent %v of the %v bytes of a packet to %v: %w", n, len(pak), addr, io.ErrShortWrite)
+	}
+	return nil
+}
+
+// Close closes the connection, and waits for the goroutines reading from it to stop, so that none
+// of them is left reading from a closed socket. Any packets not yet read are discarded. Calling
+// Close again does nothing and returns nil.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close() // unblocks the outstanding reads
+	})
+	c.readers.Wait()
+	return err
+}
+
+// isClosed reports whether Close has been called.
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketOption returns the value of the socket option opt of conn.
+func socketOption(t *testing.T, conn *Conn, opt int) int {
+	t.Helper()
+	rawConn, err := conn.rwc.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	err = rawConn.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	if err == nil {
+		err = optErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSetBufferSizes(t *testing.T) {
+	conn, err := NewConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defaultWrite := socketOption(t, conn, syscall.SO_SNDBUF)
+
+	// Linux doubles the size it is given, to leave room for its bookkeeping, and caps it at
+	// net.core.rmem_max and net.core.wmem_max, which are at least 200KB by default.
+	const size = 48 * 1024
+	err = conn.SetBufferSizes(size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := socketOption(t, conn, syscall.SO_RCVBUF); got != 2*size {
+		t.Errorf("receive buffer is %v bytes, want %v", got, 2*size)
+	}
+	if got := socketOption(t, conn, syscall.SO_SNDBUF); got != defaultWrite {
+		t.Errorf("send buffer changed from %v to %v bytes, want it left alone", defaultWrite, got)
+	}
+
+	err = conn.SetBufferSizes(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := socketOption(t, conn, syscall.SO_SNDBUF); got != 2*size {
+		t.Errorf("send buffer is %v bytes, want %v", got, 2*size)
+	}
+}
+
+func TestNewReusePortConn(t *testing.T) {
+	first, err := NewReusePortConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.localAddr.String()
+
+	second, err := NewReusePortConn(addr)
+	if err != nil {
+		t.Fatalf("binding a second socket to %v failed: %v", addr, err)
+	}
+	defer second.Close()
+	if got := second.localAddr.String(); got != addr {
+		t.Errorf("second socket is bound to %v, want %v", got, addr)
+	}
+	if got := socketOption(t, second, soReusePort); got == 0 {
+		t.Error("SO_REUSEPORT is not set")
+	}
+
+	// A socket without the option may not join them.
+	plain, err := NewConn(addr)
+	if err == nil {
+		plain.Close()
+		t.Fatalf("binding a socket without SO_REUSEPORT to %v succeeded", addr)
+	}
+	if !isAddrInUse(err) {
+		t.Errorf("binding a socket without SO_REUSEPORT failed with %v, want address in use", err)
+	}
+}
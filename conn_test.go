@@ -0,0 +1,415 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadConcurrently(t *testing.T) {
+	conn, err := NewConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const numSenders, numPackets = 4, 200
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := conn.ReadConcurrently(ctx, numSenders)
+
+	var wg sync.WaitGroup
+	for sender := 0; sender < numSenders; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			out, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer out.Close()
+			for i := 0; i < numPackets; i++ {
+				// Each packet is filled with one byte and has its own length, so that a packet overwritten by
+				// another read sharing its buffer is detected.
+				pak := bytes.Repeat([]byte{byte(sender*numPackets + i)}, 100+sender*numPackets+i)
+				_, _ = out.WriteTo(pak, conn.localAddr)
+				if i%20 == 0 {
+					time.Sleep(time.Millisecond) // stay within the socket's receive buffer
+				}
+			}
+		}(sender)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+
+	// UDP may drop packets under load, so every packet received is checked rather than all of them awaited.
+	seen := make(map[int]bool)
+	quiet := time.NewTimer(5 * time.Second)
+	defer quiet.Stop()
+	for done := false; !done; {
+		select {
+		case packet := <-in:
+			if packet.error != nil {
+				t.Fatal(packet.error)
+			}
+			id := len(packet.data) - 100
+			if id < 0 || id >= numSenders*numPackets || !bytes.Equal(packet.data, bytes.Repeat([]byte{byte(id)}, len(packet.data))) {
+				t.Fatalf("packet of %v bytes is corrupted", len(packet.data))
+			}
+			if seen[id] {
+				t.Fatalf("packet %v delivered twice", id)
+			}
+			seen[id] = true
+		case <-sent:
+			sent = nil
+			quiet.Reset(200 * time.Millisecond)
+		case <-quiet.C:
+			done = true
+		}
+	}
+	if len(seen) < numSenders*numPackets/2 {
+		t.Errorf("received %v of %v packets", len(seen), numSenders*numPackets)
+	}
+}
+
+// TestReadKeepsAbandonedPacket checks that a packet delivered to a Read whose caller gave up on it is not
+// overwritten by the next Read, as each Read has a buffer of its own.
+func TestReadKeepsAbandonedPacket(t *testing.T) {
+	conn, err := NewConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := conn.Read(ctx)
+	cancel()
+	next := conn.Read(context.Background())
+
+	for i := 0; i < 2; i++ {
+		_, _ = sender.WriteTo([]byte(fmt.Sprintf("packet %v", i)), conn.localAddr)
+	}
+	got := map[string]bool{}
+	for _, in := range []<-chan Packet{abandoned, next} {
+		select {
+		case packet := <-in:
+			got[string(packet.data)] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("read did not complete")
+		}
+	}
+	if !got["packet 0"] || !got["packet 1"] {
+		t.Errorf("reads returned %v, want both packets intact", got)
+	}
+}
+
+// fakePacketConn is a net.PacketConn whose reads and writes are done by functions a test supplies. A read or
+// write without a function blocks until the connection is closed.
+type fakePacketConn struct {
+	readFrom func(b []byte) (int, net.Addr, error)
+	writeTo  func(b []byte, addr net.Addr, deadline time.Time) (int, error)
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// newFakeConn returns a Conn reading from and writing to fake.
+func newFakeConn(fake *fakePacketConn) *Conn {
+	fake.closed = make(chan struct{})
+	return &Conn{rwc: fake, localAddr: fake.LocalAddr(), closed: make(chan struct{})}
+}
+
+func (fake *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if fake.readFrom == nil {
+		<-fake.closed
+		return 0, nil, net.ErrClosed
+	}
+	return fake.readFrom(b)
+}
+
+func (fake *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	fake.mu.Lock()
+	deadline := fake.writeDeadline
+	fake.mu.Unlock()
+	if fake.writeTo == nil {
+		<-fake.closed
+		return 0, net.ErrClosed
+	}
+	return fake.writeTo(b, addr, deadline)
+}
+
+func (fake *fakePacketConn) Close() error {
+	fake.closeOnce.Do(func() { close(fake.closed) })
+	return nil
+}
+
+func (fake *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69}
+}
+
+func (fake *fakePacketConn) SetDeadline(t time.Time) error     { return fake.SetWriteDeadline(t) }
+func (fake *fakePacketConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (fake *fakePacketConn) SetWriteDeadline(t time.Time) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.writeDeadline = t
+	return nil
+}
+
+// temporaryError is a network error that a retry may not hit again.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+var testClientAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+func TestWriteShortPacket(t *testing.T) {
+	conn := newFakeConn(&fakePacketConn{
+		writeTo: func(b []byte, addr net.Addr, deadline time.Time) (int, error) { return len(b) - 1, nil },
+	})
+	defer conn.Close()
+
+	err := conn.writeTo(mustBytes(createAckPacket(1).bytes()), testClientAddr, time.Second)
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("writeTo returned %v, want io.ErrShortWrite", err)
+	}
+}
+
+func TestWriteTimesOut(t *testing.T) {
+	fake := &fakePacketConn{}
+	fake.writeTo = func(b []byte, addr net.Addr, deadline time.Time) (int, error) {
+		if deadline.IsZero() {
+			<-fake.closed // a full send buffer without a deadline blocks for good
+			return 0, net.ErrClosed
+		}
+		time.Sleep(time.Until(deadline))
+		return 0, os.ErrDeadlineExceeded
+	}
+	conn := newFakeConn(fake)
+	defer conn.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.writeTo(mustBytes(createAckPacket(1).bytes()), testClientAddr, 50*time.Millisecond)
+	}()
+	select {
+	case err := <-written:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("writeTo returned %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("writeTo is still blocked")
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !fake.writeDeadline.IsZero() {
+		t.Error("writeTo left the write deadline set")
+	}
+}
+
+func TestReadRetriesTemporaryError(t *testing.T) {
+	var reads int32
+	conn := newFakeConn(&fakePacketConn{
+		readFrom: func(b []byte) (int, net.Addr, error) {
+			if atomic.AddInt32(&reads, 1) == 1 {
+				return 0, nil, temporaryError{}
+			}
+			return copy(b, "packet"), testClientAddr, nil
+		},
+	})
+	defer conn.Close()
+
+	select {
+	case packet := <-conn.Read(context.Background()):
+		if packet.error != nil || string(packet.data) != "packet" {
+			t.Errorf("Read returned %q, %v, want the packet after the temporary error", packet.data, packet.error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read did not return")
+	}
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Errorf("read the socket %v times, want 2", n)
+	}
+}
+
+// TestCloseEndsReadBackoff checks that closing a connection whose read is waiting to retry a temporary
+// error ends the read at once, rather than after the wait.
+func TestCloseEndsReadBackoff(t *testing.T) {
+	var reads int32
+	conn := newFakeConn(&fakePacketConn{
+		readFrom: func(b []byte) (int, net.Addr, error) {
+			atomic.AddInt32(&reads, 1)
+			return 0, nil, temporaryError{}
+		},
+	})
+	in := conn.Read(context.Background())
+
+	// After the seventh failure, the read waits 320ms before retrying.
+	for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(&reads) < 7; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the read was not retried")
+		}
+	}
+	start := time.Now()
+	conn.Close() // waits for the read to end
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Close took %v, waiting out the retry delay", elapsed)
+	}
+	if packet := <-in; packet.error == nil {
+		t.Error("Read of a closed connection returned no error")
+	}
+}
+
+func TestSetBufferSizesNeedsUDP(t *testing.T) {
+	conn := newFakeConn(&fakePacketConn{})
+	defer conn.Close()
+	if err := conn.SetBufferSizes(1<<16, 1<<16); err == nil {
+		t.Error("SetBufferSizes of a connection that is not UDP succeeded")
+	}
+}
+
+func TestCaptureDestination(t *testing.T) {
+	conn, err := NewConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.CaptureDestination()
+	if err != nil {
+		t.Skipf("the platform cannot capture destination addresses: %v", err)
+	}
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	in := conn.Read(context.Background())
+	_, _ = sender.WriteTo([]byte("packet"), conn.localAddr)
+	select {
+	case packet := <-in:
+		if packet.error != nil {
+			t.Fatal(packet.error)
+		}
+		if !packet.To().Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("To() = %v, want 127.0.0.1", packet.To())
+		}
+		if packet.from.String() != sender.LocalAddr().String() {
+			t.Errorf("packet is from %v, want %v", packet.from, sender.LocalAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no packet received")
+	}
+}
+
+// freePort returns a UDP port that was free a moment ago, which a test may bind on all interfaces.
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestNewConnInPortRange(t *testing.T) {
+	port := freePort(t)
+	conn, err := newConnInPortRange(port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.localAddr.(*net.UDPAddr).Port; got != port {
+		t.Errorf("bound port %v, want %v", got, port)
+	}
+
+	_, err = newConnInPortRange(port, port) // the only port of the range is taken by conn
+	if !errors.Is(err, errPortRangeExhausted) {
+		t.Errorf("newConnInPortRange returned %v, want errPortRangeExhausted", err)
+	}
+
+	for _, invalid := range [][2]int{{0, 10}, {10, 9}, {60000, 70000}} {
+		if conn, err := newConnInPortRange(invalid[0], invalid[1]); err == nil {
+			conn.Close()
+			t.Errorf("newConnInPortRange(%v, %v) succeeded", invalid[0], invalid[1])
+		}
+	}
+}
+
+// sendPackets sends n packets to conn from a new socket.
+func sendPackets(t *testing.T, conn *Conn, n int) {
+	t.Helper()
+	sender := newRawClient(t)
+	for i := 0; i < n; i++ {
+		sender.send(conn.localAddr, []byte{0, 4, 0, byte(i)})
+	}
+}
+
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	conn, err := NewConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := conn.ReadConcurrently(context.Background(), 4)
+	for i := 0; i < 3; i++ {
+		conn.Read(context.Background()) // abandoned, so the read is still outstanding when the connection closes
+	}
+	sendPackets(t, conn, 10) // more than anyone receives, so readers are blocked delivering them
+	<-in
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reading goroutines to end", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestCancelWhileDeliveryPending(t *testing.T) {
+	before := runtime.NumGoroutine()
+	conn, err := NewConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	in := conn.ReadConcurrently(ctx, 4)
+	sendPackets(t, conn, 10)
+	// Once the channel is full, the packets read after it are waiting to be delivered to a receiver that never comes.
+	waitFor(t, "the delivery channel to fill", func() bool { return len(in) == cap(in) })
+
+	cancel()
+	waitFor(t, "the reading goroutines to end", func() bool { return runtime.NumGoroutine() <= before })
+	if !conn.isClosed() {
+		t.Error("the connection is still open after the context of ReadConcurrently was cancelled")
+	}
+}
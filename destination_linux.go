@@ -0,0 +1,61 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"net"
+	"syscall"
+)
+
+// controlMessageSize is large enough to hold the IPv4 or IPv6 packet info control message of a datagram.
+var controlMessageSize = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enableDestinationCapture asks the kernel to attach the destination address to each datagram read from
+// conn. A dual-stack socket receives IPv4 datagrams as well, so both options are tried.
+func enableDestinationCapture(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ipv4Err, ipv6Err error
+	err = rawConn.Control(func(fd uintptr) {
+		ipv4Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		ipv6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if ipv4Err != nil && ipv6Err != nil {
+		return ipv4Err
+	}
+	return nil
+}
+
+// parseDestination returns the destination address held by the packet info control message in oob,
+// or nil if there is none.
+func parseDestination(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet4Pktinfo:
+			// struct in_pktinfo { int ipi_ifindex; struct in_addr ipi_spec_dst; struct in_addr ipi_addr; }
+			return net.IPv4(msg.Data[8], msg.Data[9], msg.Data[10], msg.Data[11])
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet6Pktinfo:
+			// struct in6_pktinfo { struct in6_addr ipi6_addr; unsigned int ipi6_ifindex; }
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, msg.Data[:net.IPv6len])
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"errors"
+	"net"
+)
+
+// controlMessageSize is the size of the control message buffer, which is unused on this platform.
+var controlMessageSize = 0
+
+func enableDestinationCapture(conn *net.UDPConn) error {
+	return errors.New("tftp: capturing the destination address is not supported on this platform")
+}
+
+func parseDestination(oob []byte) net.IP {
+	return nil
+}
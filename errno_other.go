@@ -0,0 +1,37 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isPeerGone reports whether err shows the client is no longer listening on its TID, typically because
+// the OS received an ICMP port-unreachable message in response to a packet sent to it.
+func isPeerGone(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// isTransientSocketError reports whether opening a socket failed for a reason that may clear up by
+// itself shortly, such as the process or system running out of file descriptors or buffer space.
+func isTransientSocketError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EADDRINUSE)
+}
+
+// isAddrInUse reports whether binding a socket failed because its address is already in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// isTemporaryErrno reports whether a read failed because it was interrupted, or because nothing could be read
+// without blocking, either of which a retry may not hit again.
+func isTemporaryErrno(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build plan9
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// isPeerGone reports whether err shows the client is no longer listening on its TID. Plan 9 reports network
+// errors as strings rather than errnos, so a client that is gone is noticed by its transfer timing out instead.
+func isPeerGone(err error) bool {
+	return false
+}
+
+// isTransientSocketError reports whether opening a socket failed because the process ran out of file
+// descriptors, which may clear up by itself shortly. Plan 9 has no errnos for the other causes checked
+// elsewhere, such as running out of buffer space.
+func isTransientSocketError(err error) bool {
+	return errors.Is(err, syscall.EMFILE)
+}
+
+// isAddrInUse reports whether binding a socket failed because its address is already in use. Plan 9 reports
+// this as a string rather than an errno, so it is recognized by its text.
+func isAddrInUse(err error) bool {
+	return strings.Contains(err.Error(), "address in use")
+}
+
+// isTemporaryErrno reports whether a read failed because it was interrupted, which a retry may not hit again.
+// Plan 9 has no EAGAIN, as its reads block.
+func isTemporaryErrno(err error) bool {
+	return errors.Is(err, syscall.EINTR)
+}
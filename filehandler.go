@@ -7,14 +7,29 @@ package tftp
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode/utf8"
 )
 
 // fileHandler is the type that must be implemented by the handler of the client type.
+//
+// Read reads a whole block: it fills b unless the end of the file is reached first. A read
+// that returns fewer than len(b) bytes, including zero bytes, has reached the end of the file
+// and returns io.EOF, so the block it returns is the final block of a transfer. A file whose
+// size is an exact multiple of len(b) therefore ends with a read of zero bytes.
 type fileHandler interface {
 	Open() error
 	io.ReadWriteCloser
+
+	// Abort closes the file without keeping an incomplete write.
+	Abort() error
 }
 
 // openFlag controls behavior of opening a file with a blockStreamer.
@@ -39,6 +54,125 @@ const (
 	octet
 )
 
+// maxFilenameLength is the maximum number of characters in a requested filename.
+const maxFilenameLength = 255
+
+// validateFilename checks that a requested filename names a file beneath the server's root.
+// The checks operate on characters of the decoded name rather than on its raw bytes, and if
+// netasciiOnly is set the name must also consist of printable 7-bit ASCII characters only.
+func validateFilename(filename string, netasciiOnly bool) *tftpError {
+	if filename == "" {
+		emptyError := errNoFile.fmt("empty filename")
+		return &emptyError
+	}
+	if utf8.RuneCountInString(filename) > maxFilenameLength {
+		lengthError := errNotDef.fmt("filename is longer than %v characters", maxFilenameLength)
+		return &lengthError
+	}
+	if netasciiOnly {
+		for _, r := range filename {
+			if r < 0x20 || r > 0x7E {
+				encodingError := errNotDef.fmt("filename %q is not netascii", filename)
+				return &encodingError
+			}
+		}
+	}
+	if filepath.IsAbs(filename) || strings.HasPrefix(filename, "/") || strings.HasPrefix(filename, "\\") {
+		traversalError := errAccess.fmt("filename %q must be relative to the server root", filename)
+		return &traversalError
+	}
+	for _, element := range strings.FieldsFunc(filename, isPathSeparator) {
+		if element == ".." {
+			traversalError := errAccess.fmt("filename %q must not leave the server root", filename)
+			return &traversalError
+		}
+	}
+	return nil
+}
+
+// isPathSeparator reports whether r separates path elements for any client, regardless of the server's OS.
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// checkSymlinks returns an error if resolving the symbolic links in filename, relative to root,
+// leads to a path outside of root. Links within root are allowed.
+func checkSymlinks(root, filename string) *tftpError {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		realRoot, err = filepath.Abs(realRoot)
+	}
+	if err != nil {
+		rootError := errNotDef.fmt("failed to resolve server root").wrap(err)
+		return &rootError
+	}
+
+	target, err := evalSymlinksAllowMissing(filepath.Join(realRoot, filename))
+	if err != nil {
+		return ftpOpenFileError(err)
+	}
+
+	rel, err := filepath.Rel(realRoot, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		symlinkError := errAccess.fmt("%q links outside of the server root", filename)
+		return &symlinkError
+	}
+	return nil
+}
+
+// findCaseInsensitive returns the name of the file beneath root that filename names when the case of
+// its letters is ignored, element by element. An element that exists as it is named is used as it is.
+// It reports false if no file matches, or if an element matches more than one directory entry.
+func findCaseInsensitive(root, filename string) (string, bool) {
+	found := ""
+	for _, element := range strings.FieldsFunc(filename, isPathSeparator) {
+		dir := filepath.Join(root, found)
+		if _, err := os.Lstat(filepath.Join(dir, element)); err == nil {
+			found = filepath.Join(found, element)
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return "", false
+		}
+		match := ""
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), element) {
+				if match != "" {
+					return "", false // ambiguous
+				}
+				match = entry.Name()
+			}
+		}
+		if match == "" {
+			return "", false
+		}
+		found = filepath.Join(found, match)
+	}
+	return found, found != ""
+}
+
+// evalSymlinksAllowMissing is like filepath.EvalSymlinks, except that the final elements of path
+// may not exist yet, such as the name of a file about to be written, or may be beneath a file.
+func evalSymlinksAllowMissing(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil || !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+		return resolved, err
+	}
+	dir := filepath.Dir(path)
+	if dir == path {
+		return path, nil
+	}
+	resolvedDir, err := evalSymlinksAllowMissing(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedDir, filepath.Base(path)), nil
+}
+
+// errNotRegularFile is returned when opening a file that is not a regular file.
+var errNotRegularFile = errors.New("not a regular file")
+
 // blockStreamer provides an efficient interface for streaming small,
 // block-sized read-only or write-only file operations together.
 type blockStreamer struct {
@@ -46,57 +180,335 @@ type blockStreamer struct {
 	openMode openFlag     // openMode controls which type of I/O operation will be streamed; read-only or write-only.
 	encoding encodingFlag // encoding controls whether raw will be streamed as netascii or not.
 
-	fileReference *os.File          // fileReference will be opened and closed by the Open() & Close() calls to a blockStreamer.
+	lineEnding LineEnding // lineEnding is the line separator that netascii is converted to and from on disk.
+
+	fileSystem    FileSystem        // fileSystem is the file system the file is opened on.
+	fileReference File              // fileReference will be opened and closed by the Open() & Close() calls to a blockStreamer.
 	buffer        *bufio.ReadWriter // buffer serves as the intermediary reader or writer to the fileReference.
+
+	source  io.Reader        // source is what Read reads from: the buffer, or a netascii encoder reading from it.
+	sink    io.Writer        // sink is what Write writes to: the buffer, or a netascii decoder writing to it.
+	encoder *netasciiEncoder // encoder is the netascii encoder in source, if any.
+	decoder *netasciiDecoder // decoder is the netascii decoder in sink, if any, which must be finished before closing.
 }
 
 func newBlockStreamer(filename string, openFlag openFlag, encFlag encodingFlag) *blockStreamer {
 	fh := blockStreamer{
-		filename,
-		openFlag,
-		encFlag,
-		nil,
-		nil}
+		filename:   filename,
+		openMode:   openFlag,
+		encoding:   encFlag,
+		fileSystem: osFileSystem{},
+	}
 	return &fh
 }
 
 func (fh *blockStreamer) Open() error {
 	/* TODO: Implement func (fh blockStreamer) open(filename, mode string) error */
-	var err error
+	err := fh.checkRegularFile()
+	if err != nil {
+		return err
+	}
 	switch fh.openMode {
 	case read:
-		fh.fileReference, err = os.OpenFile(fh.filename, os.O_RDONLY, os.ModeExclusive)
+		// Reads take no lock, so that many clients can download the same file at once, such as a PXE boot image.
+		fh.fileReference, err = fh.fileSystem.OpenFile(fh.filename, os.O_RDONLY, 0)
 		if err != nil {
 			return err
 		}
 		fh.buffer = bufio.NewReadWriter(bufio.NewReader(fh.fileReference), nil)
+		fh.source = fh.buffer
+		if fh.encoding == netascii {
+			fh.encoder = newNetasciiEncoder(fh.buffer.Reader, fh.lineEnding)
+			fh.source = fh.encoder
+		}
 	case write:
-		fh.fileReference, err = os.OpenFile(fh.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_EXCL, os.ModePerm)
+		fh.fileReference, err = fh.fileSystem.OpenFile(fh.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_EXCL, os.ModePerm)
 		if err != nil {
 			return err
 		}
 		fh.buffer = bufio.NewReadWriter(nil, bufio.NewWriter(fh.fileReference))
+		fh.sink = fh.buffer
+		if fh.encoding == netascii {
+			fh.decoder = newNetasciiDecoder(fh.buffer.Writer, fh.lineEnding)
+			fh.sink = fh.decoder
+		}
 	default:
 		panic(fh.openMode)
 	}
 	return nil
 }
 
+// checkRegularFile returns an error wrapping errNotRegularFile if the file exists but is a directory,
+// device, named pipe or other special file, which could not be streamed or would block while streaming.
+// A file that does not exist passes the check when opening for writing, as it will be created.
+func (fh *blockStreamer) checkRegularFile() error {
+	info, err := fh.fileSystem.Stat(fh.filename)
+	if err != nil {
+		if os.IsNotExist(err) && fh.openMode == write {
+			return nil
+		}
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &os.PathError{Op: "open", Path: fh.filename, Err: errNotRegularFile}
+	}
+	return nil
+}
+
+// checksumFile returns the digest of the file at path on fsys computed by h as a line in the format of md5sum
+// and sha256sum: the digest in hexadecimal, two spaces and the file's base name.
+func checksumFile(fsys FileSystem, path string, h hash.Hash) (string, error) {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", &os.PathError{Op: "open", Path: path, Err: errNotRegularFile}
+	}
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(path)), nil
+}
+
+// size returns the size of the open file in bytes.
+func (fh *blockStreamer) size() (int64, error) {
+	info, err := fh.fileReference.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// seek moves the read position of the open file to offset bytes from its start.
+func (fh *blockStreamer) seek(offset int64) error {
+	_, err := fh.fileReference.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	fh.buffer.Reader.Reset(fh.fileReference) // discard anything buffered from the old position
+	return nil
+}
+
 func (fh *blockStreamer) Close() error {
 	if fh.openMode == write {
-		err := fh.buffer.Flush()
+		var err error
+		if fh.decoder != nil {
+			err = fh.decoder.finish()
+		}
+		if err == nil {
+			err = fh.buffer.Flush()
+		}
 		if err != nil {
-			_ = fh.fileReference.Close()
-			return err
+			// The file is closed even so, and an error closing it is reported too, as it may tell
+			// more about what went wrong with the disk than the flush error does.
+			return errors.Join(err, fh.fileReference.Close())
 		}
 	}
 	return fh.fileReference.Close() // TODO further research best practices for flush/close
 }
 
+// Abort closes the file without flushing buffered writes. A file opened for writing is removed,
+// as it holds an incomplete transfer.
+func (fh *blockStreamer) Abort() error {
+	err := fh.fileReference.Close()
+	if fh.openMode == write {
+		removeErr := fh.fileSystem.Remove(fh.filename)
+		if err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// Read fills b with the next len(b) bytes of the file, returning io.EOF along with the bytes
+// read if the end of the file is reached before b is filled.
 func (fh *blockStreamer) Read(b []byte) (n int, err error) {
-	return fh.buffer.Read(b)
+	n, err = io.ReadFull(fh.source, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
 
 func (fh *blockStreamer) Write(b []byte) (n int, err error) {
-	return fh.buffer.Write(b)
+	return fh.sink.Write(b)
+}
+
+// decodedBytes returns the number of bytes of the file read or written so far by a netascii transfer, which
+// differs from the number of bytes transferred as line separators are converted. It reports false for an
+// octet transfer, whose bytes are transferred as they are.
+func (fh *blockStreamer) decodedBytes() (int64, bool) {
+	return netasciiBytes(fh.encoder, fh.decoder)
+}
+
+// netasciiBytes returns the number of bytes of a file read by encoder or written by decoder, whichever is set,
+// and reports false if neither is.
+func netasciiBytes(encoder *netasciiEncoder, decoder *netasciiDecoder) (int64, bool) {
+	switch {
+	case encoder != nil:
+		return encoder.consumed, true
+	case decoder != nil:
+		return decoder.written, true
+	default:
+		return 0, false
+	}
+}
+
+// streamHandler adapts a stream supplied by a caller of Client to a fileHandler, so that data can be
+// downloaded to any io.Writer or uploaded from any io.Reader, such as os.Stdout or os.Stdin. The caller
+// owns the stream, so Close and Abort leave it open.
+type streamHandler struct {
+	reader io.Reader // reader supplies the data of an upload.
+	writer io.Writer // writer receives the data of a download.
+
+	netascii bool             // netascii is set if the stream is converted to and from netascii by Open.
+	buffer   *bufio.Writer    // buffer is the buffer between a netascii decoder and the stream, if any.
+	encoder  *netasciiEncoder // encoder is the netascii encoder in reader, if any.
+	decoder  *netasciiDecoder // decoder is the netascii decoder in writer, if any, which is finished by Close.
+}
+
+// Open wraps the stream in a netascii encoder or decoder if the transfer is in netascii mode, converting
+// between the line separators of the host and those of netascii.
+func (sh *streamHandler) Open() error {
+	if !sh.netascii {
+		return nil
+	}
+	if sh.reader != nil {
+		sh.encoder = newNetasciiEncoder(bufio.NewReader(sh.reader), HostLineEnding)
+		sh.reader = sh.encoder
+	}
+	if sh.writer != nil {
+		sh.buffer = bufio.NewWriter(sh.writer)
+		sh.decoder = newNetasciiDecoder(sh.buffer, HostLineEnding)
+		sh.writer = sh.decoder
+	}
+	return nil
+}
+
+// Close writes out anything a netascii decoder still holds, leaving the stream itself open.
+func (sh *streamHandler) Close() error {
+	if sh.decoder == nil {
+		return nil
+	}
+	err := sh.decoder.finish()
+	if err != nil {
+		return err
+	}
+	return sh.buffer.Flush()
+}
+
+func (sh *streamHandler) Abort() error {
+	return nil
+}
+
+// Read fills b with the next len(b) bytes of the stream, returning io.EOF along with the bytes
+// read if the end of the stream is reached before b is filled.
+func (sh *streamHandler) Read(b []byte) (n int, err error) {
+	if sh.reader == nil {
+		return 0, errors.New("stream is not readable")
+	}
+	n, err = io.ReadFull(sh.reader, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (sh *streamHandler) Write(b []byte) (n int, err error) {
+	if sh.writer == nil {
+		return 0, errors.New("stream is not writable")
+	}
+	return sh.writer.Write(b)
+}
+
+// decodedBytes returns the number of bytes of the stream read or written so far by a netascii transfer, and
+// reports false for an octet transfer, like blockStreamer's.
+func (sh *streamHandler) decodedBytes() (int64, bool) {
+	return netasciiBytes(sh.encoder, sh.decoder)
+}
+
+// readAheadHandler reads the blocks of a file opened for reading in a goroutine of its own, up to a number of
+// blocks ahead of the caller, so that reading the disk overlaps with the network round trip of each block.
+// Each Read must be given a buffer of the block size, and returns the next block just as the underlying
+// fileHandler would.
+type readAheadHandler struct {
+	fileHandler
+	blocks   chan readAheadBlock // blocks holds the blocks read ahead, in order.
+	stop     chan struct{}       // stop is closed to stop reading ahead.
+	finished chan struct{}       // finished is closed once the goroutine reading ahead has returned.
+}
+
+// readAheadBlock is a block read ahead, along with the error reading it returned.
+type readAheadBlock struct {
+	data []byte
+	err  error
+}
+
+// newReadAheadHandler starts reading blocks of blockSize bytes from fh, which must already be open,
+// keeping up to numBlocks blocks ahead of the caller.
+func newReadAheadHandler(fh fileHandler, blockSize, numBlocks int) *readAheadHandler {
+	rh := &readAheadHandler{
+		fileHandler: fh,
+		blocks:      make(chan readAheadBlock, numBlocks),
+		stop:        make(chan struct{}),
+		finished:    make(chan struct{}),
+	}
+	go rh.readAhead(blockSize)
+	return rh
+}
+
+// readAhead reads blocks until the end of the file or an error, or until it is stopped.
+func (rh *readAheadHandler) readAhead(blockSize int) {
+	defer close(rh.finished)
+	for {
+		data := make([]byte, blockSize)
+		n, err := rh.fileHandler.Read(data)
+		select {
+		case rh.blocks <- readAheadBlock{data: data[:n], err: err}:
+		case <-rh.stop:
+			return
+		}
+		if err != nil { // io.EOF marks the final block, after which there is nothing more to read
+			return
+		}
+	}
+}
+
+// Read copies the next block into b, returning io.EOF along with the final block.
+func (rh *readAheadHandler) Read(b []byte) (n int, err error) {
+	block, ok := <-rh.blocks
+	if !ok {
+		return 0, io.EOF
+	}
+	if block.err != nil {
+		close(rh.blocks) // readAhead has returned, and any later Read finds the end of the file
+	}
+	return copy(b, block.data), block.err
+}
+
+// Close stops reading ahead before closing the file, so that the file is never read after it is closed.
+func (rh *readAheadHandler) Close() error {
+	rh.stopReadingAhead()
+	return rh.fileHandler.Close()
+}
+
+func (rh *readAheadHandler) Abort() error {
+	rh.stopReadingAhead()
+	return rh.fileHandler.Abort()
+}
+
+func (rh *readAheadHandler) stopReadingAhead() {
+	select {
+	case <-rh.stop:
+	default:
+		close(rh.stop)
+	}
+	<-rh.finished
 }
@@ -0,0 +1,92 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindCaseInsensitive(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"Boot/PXELinux.0", "a.txt", "DUP", "Dup"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, root, name, nil)
+	}
+
+	tests := []struct {
+		filename string
+		want     string
+		ok       bool
+	}{
+		{"Boot/PXELinux.0", "Boot/PXELinux.0", true},
+		{"boot/pxelinux.0", "Boot/PXELinux.0", true},
+		{"BOOT\\PXELINUX.0", "Boot/PXELinux.0", true},
+		{"A.TXT", "a.txt", true},
+		{"DUP", "DUP", true}, // an exact match is used even if the name is ambiguous
+		{"dup", "", false},   // ambiguous
+		{"missing", "", false},
+		{"boot/missing", "", false},
+		{"a.txt/x", "", false},
+	}
+	for _, test := range tests {
+		got, ok := findCaseInsensitive(root, test.filename)
+		if got != filepath.FromSlash(test.want) || ok != test.ok {
+			t.Errorf("findCaseInsensitive(%q) = %q, %v, want %q, %v", test.filename, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+var (
+	errTestWrite = errors.New("write failed")
+	errTestClose = errors.New("close failed")
+)
+
+// failingFileSystem is the operating system's file system, except that every file it opens fails each write, and
+// fails Close after closing the file underneath.
+type failingFileSystem struct {
+	osFileSystem
+}
+
+func (fsys failingFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := fsys.osFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{file}, nil
+}
+
+type failingFile struct {
+	File
+}
+
+func (failingFile) Write(b []byte) (int, error) {
+	return 0, errTestWrite
+}
+
+func (file failingFile) Close() error {
+	_ = file.File.Close()
+	return errTestClose
+}
+
+func TestBlockStreamerCloseReportsFlushAndCloseErrors(t *testing.T) {
+	fh := newBlockStreamer(filepath.Join(t.TempDir(), "f"), write, octet)
+	fh.fileSystem = failingFileSystem{}
+	if err := fh.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.Write([]byte("data")); err != nil { // buffered, so the write to the file fails when flushed
+		t.Fatal(err)
+	}
+	err := fh.Close()
+	if !errors.Is(err, errTestWrite) || !errors.Is(err, errTestClose) {
+		t.Errorf("Close returned %v, want both the flush error and the close error", err)
+	}
+}
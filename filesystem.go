@@ -0,0 +1,76 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"io"
+	"os"
+)
+
+// FileSystem is a file system that a Server reads files from and writes files to, in place of the operating
+// system's, such as an in-memory file system in tests. The names passed to its methods are the paths the server
+// builds by joining Root and a requested filename with filepath.Join.
+type FileSystem interface {
+	// OpenFile opens the named file with the flags of os.OpenFile. A download opens a file with os.O_RDONLY,
+	// and an upload with os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_EXCL. Errors should satisfy os.IsNotExist,
+	// os.IsExist and os.IsPermission where they apply, so that the client is sent the matching TFTP error.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Stat describes the named file. Root and each of the FallbackRoots must be reported as directories.
+	Stat(name string) (os.FileInfo, error)
+
+	// Remove removes the named file, which discards an upload that did not complete.
+	Remove(name string) error
+}
+
+// File is a file opened by a FileSystem.
+type File interface {
+	io.ReadWriteCloser
+	io.Seeker
+	Stat() (os.FileInfo, error)
+}
+
+// osFileSystem is the operating system's file system, which is used when Server.FileSystem is nil.
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // not a nil *os.File, which would make a non-nil File
+	}
+	return file, nil
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// fileSystem returns the file system the server serves files from.
+func (srv *Server) fileSystem() FileSystem {
+	if srv.FileSystem != nil {
+		return srv.FileSystem
+	}
+	return osFileSystem{}
+}
+
+// onDisk reports whether the server serves files from the operating system's file system, which the options
+// that deal in symbolic links, directory listings, directories and modification times need.
+func (srv *Server) onDisk() bool {
+	return srv.FileSystem == nil
+}
+
+// lstat describes the named file like the Stat method of fsys, except that a symbolic link on the operating
+// system's file system is described itself rather than the file it links to, so that a link that leads out
+// of the root is found and can be refused.
+func lstat(fsys FileSystem, name string) (os.FileInfo, error) {
+	if _, ok := fsys.(osFileSystem); ok {
+		return os.Lstat(name)
+	}
+	return fsys.Stat(name)
+}
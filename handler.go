@@ -7,9 +7,15 @@ package tftp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -19,19 +25,38 @@ type RequestHandler interface {
 }
 
 func HandleRequest(ctx context.Context, request Packet, done chan<- error) {
+	infoDone := make(chan TransferInfo, 1)
+	handleRequest(ctx, request, infoDone)
+	done <- (<-infoDone).Err
+}
+
+// handleRequest is like HandleRequest, but reports the summary of the transfer on done rather than just its error.
+// If ctx is done first, the transfer is reported while the handler is still sending its error and closing its
+// file, so the returned channel is closed once the handler has finished.
+func handleRequest(ctx context.Context, request Packet, done chan<- TransferInfo) <-chan struct{} {
 	handler := NewHandlerObject(request)
-	handlerFinished := handler.Start(ctx)
+	handlerFinished := handler.start(ctx)
+	exited := make(chan struct{})
 	select {
-	case err := <-handlerFinished:
-		done <- err
+	case info := <-handlerFinished:
+		done <- info
+		close(exited)
 	case <-ctx.Done():
-		done <- ctx.Err()
+		done <- TransferInfo{ID: handler.id, RemoteAddr: request.from, Err: ctx.Err()}
+		go func() {
+			<-handlerFinished
+			close(exited)
+		}()
 	}
+	return exited
 }
 
 type HandlerObject struct {
 	ResponseWriter
 
+	// id identifies the transfer in logs and in its TransferInfo, see ID.
+	id uint64
+
 	// packetReader listens for new packets from a client.
 	packetReader *Conn
 
@@ -41,6 +66,49 @@ type HandlerObject struct {
 	// remoteAddr is the address at which this client can be reached.
 	remoteAddr net.Addr
 
+	// ctx is the context the connection is served with, which is done when the server closes. It is
+	// context.Background until the handler is started.
+	ctx context.Context
+
+	// server is the Server that received the request, whose settings apply to this connection.
+	// If the handler was not started by a Server, the zero Server's settings apply.
+	server *Server
+
+	// writeTarget is the name of the file this handler has reserved for writing, if any.
+	writeTarget string
+
+	// readRoot is the directory that a read request is served from, if it is not the server's Root but one
+	// of its FallbackRoots.
+	readRoot string
+
+	// transferSlot is the client IP address this handler holds one of the server's per-IP transfer slots for, if any.
+	transferSlot string
+
+	// request is the parsed request that started this connection, once setup has parsed it.
+	request *RequestPacket
+
+	// options are the values negotiated with the client for this transfer, once setup has negotiated them.
+	options transferOptions
+
+	// tracked is the server's record of the request that started this connection, through which
+	// retransmissions of the request are forwarded. It is nil if the handler was not started by a Server.
+	tracked *trackedRequest
+
+	// firstResponse is the response to the request that started this connection, which is resent
+	// if the client retransmits its request.
+	firstResponse []byte
+
+	// lastResponse is the last response sent to the client, which is retransmitted if the client
+	// does not answer it in time.
+	lastResponse []byte
+
+	// retransmissions is the number of times lastResponse has been retransmitted.
+	retransmissions int
+
+	// progressed is set once a packet has been received on the connection, showing the client
+	// received the response to its request.
+	progressed bool
+
 	// ErrorLog specifies an optional logger for errors setting
 	// connections, unexpected behavior from handlers, and
 	// underlying FileSystem errors.
@@ -48,59 +116,189 @@ type HandlerObject struct {
 	ErrorLog *log.Logger // Go 1.3
 }
 
+// lastTransferID is the ID of the most recently created HandlerObject.
+var lastTransferID uint64
+
 func NewHandlerObject(request Packet) *HandlerObject {
 	handlerObject := &HandlerObject{
+		id:         atomic.AddUint64(&lastTransferID, 1),
 		lastPacket: request,
 		remoteAddr: request.from,
+		ctx:        context.Background(),
 	}
 	return handlerObject
 }
 
 func (handlerObject *HandlerObject) Start(ctx context.Context) <-chan error {
-	done := make(chan error)
+	done := make(chan error, 1) // buffered so the handler can finish even if nobody waits for it
+	finished := handlerObject.start(ctx)
 	go func() {
-		setupErr := handlerObject.setup(ctx)
-		if setupErr != nil {
-			handlerObject.sendErrorAndClose(*setupErr)
-			done <- setupErr
-			return
-		}
-
-		go handlerObject.Handle(handlerObject.lastPacket)
-
-		for {
-			ctxTimeout, _ := context.WithTimeout(ctx, 5*time.Second)
-			in := handlerObject.packetReader.Read(ctxTimeout)
-			select {
-			case packet := <-in:
-				log.Printf("tftp: new packet received:\n\tfrom: %v\n\tdata: %v\n", packet.from, packet.data) // TODO delete
-				handlerObject.lastPacket = packet
-				go handlerObject.Handle(packet)
-			case <-ctx.Done(): // THE SERVER IS CLOSING
-				tftpErr := errNotDef.fmt("server is shutting down")
-				handlerObject.sendErrorAndClose(tftpErr)
-				connectionErr := fmt.Errorf("connection's context closed with: %v", ctx.Err())
-				done <- connectionErr
-				return
-			case <-ctxTimeout.Done(): // THE CONNECTION IS TERMINATED (TODO SHOULD BE DALLYING?)
-				tftpErr := errNotDef.fmt("connection timeout")
-				handlerObject.sendErrorAndClose(tftpErr)
-				done <- ctx.Err()
-				return
-			}
+		done <- (<-finished).Err
+	}()
+	return done
+}
+
+// start is like Start, but reports the summary of the transfer when the handler finishes rather than just its error.
+func (handlerObject *HandlerObject) start(ctx context.Context) <-chan TransferInfo {
+	done := make(chan TransferInfo, 1) // buffered so the handler can finish even if nobody waits for it
+	go func() {
+		err := handlerObject.serve(ctx)
+		if handlerObject.tracked != nil {
+			handlerObject.settings().untrackRequest(handlerObject.tracked)
+		}
+		if handlerObject.transferSlot != "" {
+			handlerObject.settings().releaseTransferSlot(handlerObject.transferSlot)
 		}
+		info := handlerObject.transferInfo(err)
+		handlerObject.transferComplete(info)
+		done <- info
 	}()
 	return done
 }
 
+// serve handles the connection until its transfer completes or fails, and returns the error it failed with.
+func (handlerObject *HandlerObject) serve(ctx context.Context) error {
+	handlerObject.ctx = ctx
+	setupErr := handlerObject.setup(ctx)
+	if setupErr != nil {
+		handlerObject.sendErrorAndAbort(*setupErr)
+		return *setupErr // a tftpError value, which errors.As and ErrorCodeOf match
+	}
+
+	err := handlerObject.Handle(handlerObject.lastPacket)
+	if err != nil {
+		return err
+	}
+
+	var in <-chan Packet // in is kept until it delivers, so that no packet is lost to an abandoned read
+	for {
+		if handlerObject.ResponseWriter.Complete() {
+			return handlerObject.close()
+		}
+
+		if in == nil {
+			in = handlerObject.packetReader.Read(ctx)
+		}
+		wait := handlerObject.settings().retransmitWait(handlerObject.retransmissions)
+		ctxTimeout, cancelTimeout := context.WithTimeout(ctx, wait)
+		select {
+		case packet := <-in:
+			cancelTimeout()
+			in = nil
+			handlerObject.progressed = true
+			if packet.error != nil {
+				return handlerObject.handleReadError(packet.error)
+			}
+			handlerObject.lastPacket = packet
+			if errorPacket, err := parseErrorPacket(packet); err == nil { // the client gave up, and expects no reply
+				handlerObject.abortAndLog()
+				return fmt.Errorf("client %v aborted the transfer: %w", handlerObject.remoteAddr, errorPacket.tftpError)
+			}
+			err := handlerObject.Handle(packet)
+			if err != nil {
+				return err
+			}
+		case <-handlerObject.retransmittedRequests():
+			cancelTimeout()
+			handlerObject.answerRetransmittedRequest()
+		case <-handlerObject.abortRequested():
+			cancelTimeout()
+			tftpErr := errNotDef.fmt("transfer aborted by the server")
+			handlerObject.sendErrorAndAbort(tftpErr)
+			return tftpErr
+		case <-ctx.Done(): // THE SERVER IS CLOSING
+			cancelTimeout()
+			tftpErr := errNotDef.fmt("server is shutting down")
+			handlerObject.sendErrorAndAbort(tftpErr)
+			return fmt.Errorf("connection's context closed with: %v", ctx.Err())
+		case <-ctxTimeout.Done():
+			cancelTimeout()
+			if handlerObject.retransmit() {
+				continue
+			}
+			tftpErr := errNotDef.fmt("connection timeout")
+			handlerObject.sendErrorAndAbort(tftpErr)
+			return tftpErr
+		}
+	}
+}
+
+// retransmittedRequests returns the channel on which the server forwards retransmissions of the request
+// that started this connection, or nil if the handler was not started by a Server.
+func (handlerObject *HandlerObject) retransmittedRequests() <-chan Packet {
+	if handlerObject.tracked == nil {
+		return nil
+	}
+	return handlerObject.tracked.retransmissions
+}
+
+// abortRequested returns the channel that is closed when Server.AbortTransfer aborts this connection's
+// transfer, or nil if the handler was not started by a Server.
+func (handlerObject *HandlerObject) abortRequested() <-chan struct{} {
+	if handlerObject.tracked == nil {
+		return nil
+	}
+	return handlerObject.tracked.aborted
+}
+
+// retransmit resends the last response after the client failed to answer it in time, as either the
+// response or the client's answer may have been lost. It reports false once the server's limit on
+// retransmissions of a single response has been reached, after which the connection times out.
+func (handlerObject *HandlerObject) retransmit() bool {
+	srv := handlerObject.settings()
+	if handlerObject.lastResponse == nil || handlerObject.retransmissions >= srv.maxRetransmissions() {
+		return false
+	}
+	handlerObject.retransmissions++
+	err := handlerObject.sendPacket(handlerObject.lastResponse)
+	if err != nil {
+		handlerObject.logf("tftp: error retransmitting to %v - %v", handlerObject.remoteAddr, err)
+	}
+	if srv.OnRetransmit != nil {
+		srv.OnRetransmit(handlerObject.remoteAddr, responseBlockNumber(handlerObject.lastResponse), handlerObject.retransmissions)
+	}
+	return true
+}
+
+// responseBlockNumber returns the block number of a DATA or ACK response, or 0 for an OACK,
+// which takes the place of block 0.
+func responseBlockNumber(response []byte) uint16 {
+	pak := Packet{data: response}
+	if op, err := pak.readOpCode(); err != nil || (op != DATA && op != ACK) {
+		return 0
+	}
+	blockNumber, _ := pak.readBlockNumber()
+	return blockNumber
+}
+
+// answerRetransmittedRequest resends the response to the request that started this connection, as the client
+// retransmitted its request because the response was lost. Once the client has sent a packet to the
+// connection it has received the response, so a late retransmission is ignored.
+func (handlerObject *HandlerObject) answerRetransmittedRequest() {
+	if handlerObject.progressed || handlerObject.firstResponse == nil {
+		return
+	}
+	err := handlerObject.sendPacket(handlerObject.firstResponse)
+	if err != nil {
+		handlerObject.logf("tftp: error resending response to retransmitted request from %v - %v", handlerObject.remoteAddr, err)
+	}
+}
+
 func (handlerObject *HandlerObject) setup(ctx context.Context) *tftpError { // setup() is an instance of Sequential coupling...
 	handlerObject.setupLogger(ctx)
+	handlerObject.setupServer(ctx)
+	handlerObject.setupTrackedRequest(ctx)
 
 	err := handlerObject.setupPacketReader()
 	if err != nil {
 		return err
 	}
 
+	err = handlerObject.setupTransferSlot()
+	if err != nil {
+		return err
+	}
+
 	err = handlerObject.setupPacketHandler()
 	if err != nil {
 		return err
@@ -116,25 +314,196 @@ func (handlerObject *HandlerObject) setupLogger(ctx context.Context) {
 	}
 }
 
+func (handlerObject *HandlerObject) setupServer(ctx context.Context) {
+	srv, ok := ctx.Value(ServerContextKey).(*Server)
+	if ok {
+		handlerObject.server = srv
+	} else {
+		handlerObject.server = &Server{}
+	}
+}
+
+// setupTransferSlot takes one of the server's transfer slots for the client's IP address, if the server
+// limits the number of transfers per IP address.
+func (handlerObject *HandlerObject) setupTransferSlot() *tftpError {
+	srv := handlerObject.settings()
+	if srv.MaxTransfersPerIP <= 0 {
+		return nil
+	}
+	ip := handlerObject.remoteAddr.String()
+	if udpAddr, ok := handlerObject.remoteAddr.(*net.UDPAddr); ok {
+		ip = udpAddr.IP.String()
+	}
+	if !srv.acquireTransferSlot(ip) {
+		tooManyError := errNotDef.fmt("too many transfers from %v", ip)
+		return &tooManyError
+	}
+	handlerObject.transferSlot = ip
+	return nil
+}
+
+func (handlerObject *HandlerObject) setupTrackedRequest(ctx context.Context) {
+	tracked, ok := ctx.Value(trackedRequestContextKey).(*trackedRequest)
+	if ok {
+		handlerObject.tracked = tracked
+	}
+}
+
+// maxTIDAttempts is the number of times setupPacketReader tries to open a socket for a connection's TID.
+const maxTIDAttempts = 3
+
 func (handlerObject *HandlerObject) setupPacketReader() *tftpError {
-	conn, err := NewConn(":0") // :0 tells the OS to assign an ephemeral port
+	var err error
+	for attempt := 1; attempt <= maxTIDAttempts; attempt++ {
+		var conn *Conn
+		conn, err = handlerObject.newTIDConn()
+		if err == nil {
+			handlerObject.packetReader = conn
+			return nil
+		}
+		if !isTransientSocketError(err) {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+	handlerObject.logf("tftp: failed to assign TID for connection from %v - %v", handlerObject.remoteAddr, err)
+	internalServerError := errNotDef.fmt("failed to assign TID for connection").wrap(err)
+	return &internalServerError
+}
+
+// newTIDConn opens the socket for the connection's TID, on a port within the server's TID port range if it has one,
+// with the buffer sizes the server is configured with.
+func (handlerObject *HandlerObject) newTIDConn() (*Conn, error) {
+	srv := handlerObject.settings()
+	var conn *Conn
+	var err error
+	if srv.MinTIDPort == 0 && srv.MaxTIDPort == 0 {
+		conn, err = NewConn(":0") // :0 tells the OS to assign an ephemeral port
+	} else {
+		conn, err = newConnInPortRange(srv.MinTIDPort, srv.MaxTIDPort)
+	}
 	if err != nil {
-		internalServerError := errNotDef.fmt("failed to assign TID for connection")
-		return &internalServerError
+		return nil, err
 	}
-	handlerObject.packetReader = conn
-	return nil
+	err = srv.setBufferSizes(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func (handlerObject *HandlerObject) setupPacketHandler() *tftpError {
-	req, err := parseRequestPacket(handlerObject.lastPacket)
+	if handlerObject.lastPacket.truncated {
+		// Parsing what is left of the request would only report a confusing error about its last option.
+		msg := "request packet from %v is larger than the %v bytes the server accepts"
+		oversizedError := errNotDef.fmt(msg, handlerObject.lastPacket.from, bufferSize)
+		return &oversizedError
+	}
+
+	req, err := parseRequestPacket(handlerObject.lastPacket, handlerObject.settings().LenientModes)
 	if err != nil {
 		msg := "error occurred while reading opcode in Request packet from %v - %v"
 		badRequestError := errNotDef.fmt(msg, handlerObject.lastPacket.from, err)
 		return &badRequestError
 	}
+	handlerObject.request = req
+	handlerObject.options = negotiateOptions(req.options)
+	if handlerObject.settings().PowerOfTwoBlockSize {
+		handlerObject.options.roundBlockSizeToPowerOfTwo()
+	}
+	handlerObject.options.declineBlockSizeBelow(handlerObject.settings().MinBlockSize)
+	handlerObject.options.maxRoundTrips = handlerObject.settings().MaxRoundTrips
+	handlerObject.options.maxDuplicates = handlerObject.settings().maxDuplicates()
+	handlerObject.options.readAhead = handlerObject.settings().ReadAhead
+	handlerObject.options.lineEnding = handlerObject.settings().NetasciiLineEnding
+	handlerObject.options.fileSystem = handlerObject.settings().fileSystem()
+	if omit := handlerObject.settings().OmitEmptyFinalBlock; omit != nil {
+		handlerObject.options.omitEmptyFinalBlock = omit(handlerObject.remoteAddr)
+	}
 
-	handler, openFileError := newPacketHandler(req)
+	if srv := handlerObject.settings(); srv.HealthFilename != "" && req.openFlag == read && req.filename == srv.HealthFilename {
+		handlerObject.ResponseWriter = newRrqResponseWriter(&streamHandler{reader: strings.NewReader(healthPayload)}, handlerObject.options)
+		return nil
+	}
+
+	requestError := handlerObject.validateRequest(req)
+	if requestError != nil {
+		return requestError
+	}
+
+	if rewrite := handlerObject.settings().FilenameRewrite; rewrite != nil {
+		req.filename = rewrite(req.filename)
+		requestError = handlerObject.validateRequest(req) // the rewritten name must be just as safe
+		if requestError != nil {
+			return requestError
+		}
+	}
+
+	if allowMode := handlerObject.settings().AllowMode; allowMode != nil {
+		mode, _ := encodingFlagToMode(req.encodingFlag) // the request was parsed, so its mode is known
+		if !allowMode(req.filename, mode) {
+			modeError := errOperation.fmt("%q cannot be transferred in %v mode", req.filename, mode)
+			return &modeError
+		}
+	}
+
+	if suffix := handlerObject.settings().ChecksumSuffix; req.openFlag == read && suffix != "" &&
+		len(req.filename) > len(suffix) && strings.HasSuffix(req.filename, suffix) {
+		return handlerObject.setupChecksum(req, strings.TrimSuffix(req.filename, suffix))
+	}
+
+	if req.openFlag == read && len(handlerObject.settings().FallbackRoots) > 0 {
+		handlerObject.readRoot = handlerObject.findReadRoot(req.filename)
+		requestError = handlerObject.validateRequest(req) // links must stay within the root the file is read from
+		if requestError != nil {
+			return requestError
+		}
+	}
+
+	if req.openFlag == read && handlerObject.settings().CaseInsensitiveFilenames && handlerObject.settings().onDisk() {
+		if filename, ok := findCaseInsensitive(handlerObject.root(), req.filename); ok && filename != req.filename {
+			req.filename = filename
+			requestError = handlerObject.validateRequest(req) // the matched name must be just as safe
+			if requestError != nil {
+				return requestError
+			}
+		}
+	}
+
+	if defaultFile := handlerObject.settings().DefaultFile; req.openFlag == read && defaultFile != "" {
+		_, err := handlerObject.settings().fileSystem().Stat(handlerObject.path(req.filename))
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			handlerObject.logf("tftp: %q does not exist, serving default file %q", req.filename, defaultFile)
+			req.filename = defaultFile
+			handlerObject.readRoot = ""
+			if len(handlerObject.settings().FallbackRoots) > 0 {
+				handlerObject.readRoot = handlerObject.findReadRoot(req.filename)
+			}
+			requestError = handlerObject.validateRequest(req) // the default file must be just as safe
+			if requestError != nil {
+				return requestError
+			}
+		}
+	}
+
+	if req.openFlag == write {
+		if !handlerObject.settings().acquireWriteTarget(req.filename) {
+			busyError := errFileExists.fmt("%q is already being written by another transfer", req.filename)
+			return &busyError
+		}
+		handlerObject.writeTarget = req.filename
+
+		if handlerObject.settings().CreateDirs && handlerObject.settings().onDisk() {
+			// The name has been validated, so its directories are all beneath the root.
+			err := os.MkdirAll(filepath.Dir(handlerObject.path(req.filename)), 0755)
+			if err != nil {
+				return ftpOpenFileError(err)
+			}
+		}
+	}
+
+	handler, openFileError := newPacketHandler(handlerObject.path(req.filename), req, handlerObject.options)
 	if openFileError != nil {
 		return openFileError
 	}
@@ -142,29 +511,201 @@ func (handlerObject *HandlerObject) setupPacketHandler() *tftpError {
 	return nil
 }
 
-func (handlerObject *HandlerObject) Handle(packet Packet) {
+// setupChecksum answers a read request with the checksum of the file named filename, see Server.ChecksumSuffix.
+// The file is looked for and validated as if it had been requested itself.
+func (handlerObject *HandlerObject) setupChecksum(req *RequestPacket, filename string) *tftpError {
+	srv := handlerObject.settings()
+	target := *req
+	target.filename = filename
+	if len(srv.FallbackRoots) > 0 {
+		handlerObject.readRoot = handlerObject.findReadRoot(target.filename)
+	}
+	if srv.CaseInsensitiveFilenames && srv.onDisk() {
+		if matched, ok := findCaseInsensitive(handlerObject.root(), target.filename); ok {
+			target.filename = matched
+		}
+	}
+	requestError := handlerObject.validateRequest(&target)
+	if requestError != nil {
+		return requestError
+	}
+
+	checksum, err := checksumFile(srv.fileSystem(), handlerObject.path(target.filename), srv.newChecksumHash())
+	if err != nil {
+		return ftpOpenFileError(err)
+	}
+	stream := &streamHandler{reader: strings.NewReader(checksum), netascii: req.encodingFlag == netascii}
+	err = stream.Open()
+	if err != nil {
+		return ftpOpenFileError(err)
+	}
+	handlerObject.ResponseWriter = newRrqResponseWriter(stream, handlerObject.options)
+	return nil
+}
+
+// ID returns the transfer ID of the handler, which is unique among the handlers created by the process.
+// It prefixes the handler's log lines and is reported in its TransferInfo, so that the lifecycle of a
+// single transfer can be followed through the logs.
+func (handlerObject *HandlerObject) ID() uint64 {
+	return handlerObject.id
+}
+
+// Request returns the request that started the connection, once it has been parsed, or nil before. Its Filename is
+// the name of the file being transferred, after any FilenameRewrite, case folding or DefaultFile has been applied.
+func (handlerObject *HandlerObject) Request() *RequestPacket {
+	return handlerObject.request
+}
+
+// Options returns the options negotiated with the client, as they were acknowledged in the OACK
+// packet, or nil before the request has been set up. The response writer is given the same
+// negotiated values when it is created, so that it never has to look them up elsewhere.
+func (handlerObject *HandlerObject) Options() map[string]string {
+	if handlerObject.request == nil {
+		return nil
+	}
+	options := make(map[string]string, len(handlerObject.options.accepted))
+	for name, value := range handlerObject.options.accepted {
+		options[name] = value
+	}
+	return options
+}
+
+// healthPayload is the content of the server's health file, see Server.HealthFilename.
+const healthPayload = "OK\n"
+
+// settings returns the Server whose settings apply to this connection. If the handler was not
+// started by a Server, the zero Server's settings apply.
+func (handlerObject *HandlerObject) settings() *Server {
+	if handlerObject.server == nil {
+		return &Server{}
+	}
+	return handlerObject.server
+}
+
+// root returns the directory that the filenames of requests are relative to.
+func (handlerObject *HandlerObject) root() string {
+	if handlerObject.readRoot != "" {
+		return handlerObject.readRoot
+	}
+	if root := handlerObject.settings().Root; root != "" {
+		return root
+	}
+	return "." // a handler not started by a Server serves the working directory
+}
+
+// findReadRoot returns the first of the server's Root and FallbackRoots that holds the file named filename,
+// or Root if none of them does, so that the file is reported as missing from Root.
+func (handlerObject *HandlerObject) findReadRoot(filename string) string {
+	srv := handlerObject.settings()
+	roots := append([]string{handlerObject.root()}, srv.FallbackRoots...)
+	for _, root := range roots {
+		if _, err := lstat(srv.fileSystem(), filepath.Join(root, filename)); err == nil {
+			return root
+		}
+		if srv.CaseInsensitiveFilenames && srv.onDisk() {
+			if _, ok := findCaseInsensitive(root, filename); ok {
+				return root
+			}
+		}
+	}
+	return roots[0]
+}
+
+// path returns the path of the file named filename by a request, within the server's Root.
+func (handlerObject *HandlerObject) path(filename string) string {
+	return filepath.Join(handlerObject.root(), filename)
+}
+
+// validateRequest rejects a request that the server's settings do not allow before its file is opened.
+func (handlerObject *HandlerObject) validateRequest(req *RequestPacket) *tftpError {
+	srv := handlerObject.settings()
+
+	if srv.DisableNetascii && req.encodingFlag == netascii {
+		netasciiError := errOperation.fmt("netascii transfers are disabled, use octet mode")
+		return &netasciiError
+	}
+
+	filenameError := validateFilename(req.filename, srv.NetasciiFilenames)
+	if filenameError != nil {
+		return filenameError
+	}
+
+	if !srv.FollowSymlinks && srv.onDisk() {
+		return checkSymlinks(handlerObject.root(), req.filename)
+	}
+	return nil
+}
+
+// Handle sends the response to packet back to the client. If the transfer fails, the connection
+// is aborted and the error it failed with is returned.
+func (handlerObject *HandlerObject) Handle(packet Packet) error {
 	response := handlerObject.ResponseWriter.WriteResponse(packet)
+	if response == nil { // the transfer is complete and there is nothing left to send
+		return nil
+	}
+	if handlerObject.firstResponse == nil {
+		handlerObject.firstResponse = response
+	}
+
 	err := handlerObject.sendPacket(response)
 	if err != nil {
+		if errors.Is(err, errSendStopped) {
+			handlerObject.sendErrorAndAbort(handlerObject.stopError())
+			return err
+		}
+		if isPeerGone(err) {
+			handlerObject.abortForGonePeer(err)
+			return fmt.Errorf("client %v is unreachable: %v", handlerObject.remoteAddr, err)
+		}
 		handlerObject.logf("tftp: failed to send:\n\tresponse: %v\n\tdue to error: %v", response, err)
-		handlerObject.sendDefaultErrorAndClose()
+		handlerObject.sendDefaultErrorAndAbort()
+		return err
 	}
+	handlerObject.lastResponse = response
+	handlerObject.retransmissions = 0
+
+	if errorPacket, err := parseErrorPacket(Packet{data: response}); err == nil { // any error terminates the transfer
+		handlerObject.abortAndLog()
+		return errorPacket.tftpError
+	}
+	return nil
+}
+
+// handleReadError aborts the connection after reading from it failed, and returns the error the connection finished with.
+func (handlerObject *HandlerObject) handleReadError(err error) error {
+	if isPeerGone(err) {
+		handlerObject.abortForGonePeer(err)
+		return fmt.Errorf("client %v is unreachable: %v", handlerObject.remoteAddr, err)
+	}
+	handlerObject.sendErrorAndAbort(errNotDef.fmt("failed to read from connection"))
+	return err
+}
+
+// abortForGonePeer aborts the connection to a client that is no longer listening. No error packet
+// is sent, as it could not be delivered.
+func (handlerObject *HandlerObject) abortForGonePeer(cause error) {
+	handlerObject.logf("tftp: client %v is unreachable, closing connection - %v", handlerObject.remoteAddr, cause)
+	handlerObject.abortAndLog()
 }
 
-func (handlerObject *HandlerObject) sendDefaultErrorAndClose() {
-	handlerObject.sendErrorAndClose(internalErrorPacket().tftpError)
+func (handlerObject *HandlerObject) sendDefaultErrorAndAbort() {
+	handlerObject.sendErrorAndAbort(internalErrorPacket().tftpError)
 }
 
-func (handlerObject *HandlerObject) sendErrorAndClose(tftpErr tftpError) {
+func (handlerObject *HandlerObject) sendErrorAndAbort(tftpErr tftpError) {
 	rawErrorData := handlerObject.getRawErrorData(tftpErr)
 	err := handlerObject.sendPacket(rawErrorData)
 	if err != nil {
 		handlerObject.logf("tftp: error sending error packet to client - %v", err)
 	}
 
-	err = handlerObject.close()
+	handlerObject.abortAndLog()
+}
+
+func (handlerObject *HandlerObject) abortAndLog() {
+	err := handlerObject.abort()
 	if err != nil {
-		handlerObject.logf("tftp: error closing client handler - %v", err)
+		handlerObject.logf("tftp: error aborting client handler - %v", err)
 	}
 }
 
@@ -178,32 +719,117 @@ func (handlerObject *HandlerObject) getRawErrorData(tftpErr tftpError) []byte {
 	}
 }
 
+// errNoPacketReader is returned when a packet cannot be sent because setup failed before the connection's TID was
+// assigned, and the handler was not started by a Server whose socket could send it instead.
+var errNoPacketReader = errors.New("connection has no TID to send from")
+
 func (handlerObject *HandlerObject) close() error {
-	packetReaderErr := handlerObject.packetReader.rwc.Close()
-	var responseWriterErr error
+	var packetReaderErr, responseWriterErr error
+	if handlerObject.packetReader != nil {
+		packetReaderErr = handlerObject.packetReader.Close()
+	}
 	if handlerObject.ResponseWriter != nil {
 		responseWriterErr = handlerObject.ResponseWriter.Close()
 	}
+	var modTimeErr error
+	if responseWriterErr == nil {
+		modTimeErr = handlerObject.applyModTime()
+	}
+	handlerObject.releaseWriteTarget()
 
-	if packetReaderErr != nil {
-		return packetReaderErr
+	return errors.Join(packetReaderErr, responseWriterErr, modTimeErr)
+}
+
+// applyModTime sets the modification time of a file written by a WRQ transfer to the time
+// chosen by the server's UploadModTime function, once the file has been closed.
+func (handlerObject *HandlerObject) applyModTime() error {
+	modTime := handlerObject.settings().UploadModTime
+	if modTime == nil || handlerObject.writeTarget == "" || !handlerObject.settings().onDisk() {
+		return nil
+	}
+	mtime := modTime(handlerObject.writeTarget)
+	if mtime.IsZero() {
+		return nil
+	}
+	path := handlerObject.path(handlerObject.writeTarget)
+	return os.Chtimes(path, mtime, mtime)
+}
+
+// abort closes the connection after a failed transfer, discarding any partially written file.
+func (handlerObject *HandlerObject) abort() error {
+	var packetReaderErr, responseWriterErr error
+	if handlerObject.packetReader != nil {
+		packetReaderErr = handlerObject.packetReader.Close()
+	}
+	if handlerObject.ResponseWriter != nil {
+		responseWriterErr = handlerObject.ResponseWriter.Abort()
+	}
+	handlerObject.releaseWriteTarget()
+
+	return errors.Join(packetReaderErr, responseWriterErr)
+}
+
+// releaseWriteTarget releases the handler's reservation of the file it was writing, once the file is closed.
+func (handlerObject *HandlerObject) releaseWriteTarget() {
+	if handlerObject.writeTarget != "" {
+		handlerObject.settings().releaseWriteTarget(handlerObject.writeTarget)
+		handlerObject.writeTarget = ""
 	}
-	return responseWriterErr
 }
 
 func (handlerObject *HandlerObject) sendPacket(pak []byte) error {
-	_, err := handlerObject.packetReader.rwc.WriteTo(pak, handlerObject.remoteAddr)
-	if err != nil {
-		return err
+	if handlerObject.packetReader == nil {
+		// Setup failed before the connection had a TID, so its error is sent from the port the request
+		// arrived on, as a server that is busy answers.
+		if requestReader := handlerObject.settings().requestReader; requestReader != nil {
+			return requestReader.writeTo(pak, handlerObject.remoteAddr, handlerObject.settings().retransmitTimeout())
+		}
+		return errNoPacketReader
 	}
-	log.Printf("sendPacket():\n\tto:   %v\n\tdata: %v\n", handlerObject.remoteAddr, pak) // TODO delete
-	return nil
+	if op, _ := (Packet{data: pak}).readOpCode(); op == DATA {
+		if !handlerObject.settings().rateLimiter.wait(handlerObject.ctx, handlerObject.abortRequested(), len(pak)) {
+			return errSendStopped
+		}
+	}
+	return handlerObject.packetReader.writeTo(pak, handlerObject.remoteAddr, handlerObject.settings().retransmitTimeout())
 }
 
+// errSendStopped is returned by sendPacket when the transfer is stopped while the packet waits for the server's
+// GlobalRateLimit.
+var errSendStopped = errors.New("transfer stopped while waiting to send")
+
+// stopError returns the error to send the client when the server stops its transfer, by closing or by
+// aborting the transfer.
+func (handlerObject *HandlerObject) stopError() tftpError {
+	if handlerObject.ctx.Err() != nil {
+		return errNotDef.fmt("server is shutting down")
+	}
+	return errNotDef.fmt("transfer aborted by the server")
+}
+
+// logf logs a message about this connection, prefixed with logPrefix so that the lines of one
+// transfer can be told apart from those of the others being served at the same time.
 func (handlerObject *HandlerObject) logf(format string, args ...interface{}) {
+	msg := handlerObject.logPrefix() + fmt.Sprintf(format, args...)
 	if handlerObject.ErrorLog != nil {
-		handlerObject.ErrorLog.Printf(format, args...)
+		handlerObject.ErrorLog.Print(msg)
 	} else {
-		log.Printf(format, args...)
+		log.Print(msg)
+	}
+}
+
+// logPrefix identifies the transfer by its ID and the client's address, then the requested filename
+// once the request has been parsed, then the TID once one has been assigned, such as
+// `[#42 192.0.2.1:1234 "boot.img" tid=40001] `.
+func (handlerObject *HandlerObject) logPrefix() string {
+	prefix := fmt.Sprintf("#%v %v", handlerObject.id, handlerObject.remoteAddr)
+	if handlerObject.request != nil {
+		prefix += fmt.Sprintf(" %q", handlerObject.request.filename)
+	}
+	if handlerObject.packetReader != nil {
+		if localAddr, ok := handlerObject.packetReader.localAddr.(*net.UDPAddr); ok {
+			prefix += fmt.Sprintf(" tid=%v", localAddr.Port)
+		}
 	}
+	return "[" + prefix + "] "
 }
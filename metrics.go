@@ -0,0 +1,106 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+)
+
+// Names of the counters in the expvar map published by a Server whose ExpvarName is set.
+const (
+	requestsMetric          = "requests"           // requests that started a connection
+	rejectedMetric          = "rejected"           // requests refused before a transfer started, such as by a busy server
+	activeConnectionsMetric = "active_connections" // connections currently being handled
+	bytesReadMetric         = "bytes_read"         // bytes read from files by RRQ transfers
+	bytesWrittenMetric      = "bytes_written"      // bytes written to files by WRQ transfers
+	errorsMetric            = "errors"             // failed transfers, as a map keyed by TFTP error code
+)
+
+// serverMetrics publishes the counters of a Server with the expvar package.
+type serverMetrics struct {
+	counters *expvar.Map
+	errors   *expvar.Map
+}
+
+// newServerMetrics returns the metrics published under name. Servers that are given the same name share
+// the same counters, as expvar does not allow a name to be published twice.
+func newServerMetrics(name string) (*serverMetrics, error) {
+	var counters *expvar.Map
+	switch published := expvar.Get(name).(type) {
+	case nil:
+		counters = expvar.NewMap(name)
+	case *expvar.Map:
+		counters = published
+	default:
+		return nil, fmt.Errorf("tftp: expvar %q is already published as a %T", name, published)
+	}
+
+	errorCounts, ok := counters.Get(errorsMetric).(*expvar.Map)
+	if !ok {
+		errorCounts = new(expvar.Map)
+		counters.Set(errorsMetric, errorCounts)
+	}
+	metrics := &serverMetrics{
+		counters: counters,
+		errors:   errorCounts,
+	}
+	return metrics, nil
+}
+
+// connStarted records a request that started a connection.
+func (metrics *serverMetrics) connStarted() {
+	if metrics == nil {
+		return
+	}
+	metrics.counters.Add(requestsMetric, 1)
+	metrics.counters.Add(activeConnectionsMetric, 1)
+}
+
+// connFinished records that a connection finished.
+func (metrics *serverMetrics) connFinished() {
+	if metrics == nil {
+		return
+	}
+	metrics.counters.Add(activeConnectionsMetric, -1)
+}
+
+// requestRejected records a request that was refused with err before a transfer started, counting err
+// like the error of a failed transfer.
+func (metrics *serverMetrics) requestRejected(err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.counters.Add(rejectedMetric, 1)
+	metrics.countError(err)
+}
+
+// transferFinished records the bytes moved by a transfer and, if it failed with err, its error code.
+func (metrics *serverMetrics) transferFinished(write bool, bytes int64, err error) {
+	if metrics == nil {
+		return
+	}
+	if write {
+		metrics.counters.Add(bytesWrittenMetric, bytes)
+	} else {
+		metrics.counters.Add(bytesReadMetric, bytes)
+	}
+	if err != nil {
+		metrics.countError(err)
+	}
+}
+
+// countError records the error code of err. An error that is not a TFTP error is counted as undefined.
+func (metrics *serverMetrics) countError(err error) {
+	errorCode := errNotDef.errorCode
+	var tftpErr tftpError
+	if errors.As(err, &tftpErr) {
+		errorCode = tftpErr.errorCode
+	}
+	metrics.errors.Add(strconv.Itoa(int(errorCode)), 1)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// metricValue returns the value of the counter key in the expvar map published as name, or of the counter
+// for an error code if key is of the form "errors.<code>". A counter that was never added to is 0.
+func metricValue(t testing.TB, name, key string) int64 {
+	t.Helper()
+	counters, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		t.Fatalf("expvar %q is not published", name)
+	}
+	if len(key) > len(errorsMetric)+1 && key[:len(errorsMetric)+1] == errorsMetric+"." {
+		counters = counters.Get(errorsMetric).(*expvar.Map)
+		key = key[len(errorsMetric)+1:]
+	}
+	counter, ok := counters.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return counter.Value()
+}
+
+// expvarNames counts the names returned by newExpvarName.
+var expvarNames int64
+
+// newExpvarName returns an expvar name that no other server of the test binary uses, so that a test run more
+// than once with -count starts from counters of 0.
+func newExpvarName(t testing.TB) string {
+	return fmt.Sprintf("tftp_test_%v_%v", t.Name(), atomic.AddInt64(&expvarNames, 1))
+}
+
+func TestMetrics(t *testing.T) {
+	srv := startServer(t, func(srv *Server) { srv.ExpvarName = newExpvarName(t) })
+	download := testData(1000)
+	writeFile(t, srv.Root, "download", download)
+	upload := testData(700)
+	client := newTestClient(srv.LocalAddr().String())
+
+	var got bytes.Buffer
+	if _, err := client.Download("download", &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Upload(bytes.NewReader(upload), "upload"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Download("missing", io.Discard); err == nil {
+		t.Fatal("download of a missing file succeeded")
+	}
+	waitFor(t, "the connections to finish", func() bool {
+		return metricValue(t, srv.ExpvarName, activeConnectionsMetric) == 0
+	})
+
+	want := map[string]int64{
+		requestsMetric:     3,
+		bytesReadMetric:    int64(len(download)),
+		bytesWrittenMetric: int64(len(upload)),
+		rejectedMetric:     0,
+		"errors.1":         1, // file not found
+	}
+	for key, value := range want {
+		if got := metricValue(t, srv.ExpvarName, key); got != value {
+			t.Errorf("%v = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestMetricsSharedName(t *testing.T) {
+	name := newExpvarName(t)
+	first := startServer(t, func(srv *Server) { srv.ExpvarName = name })
+	second := startServer(t, func(srv *Server) { srv.ExpvarName = name }) // publishing the name again must not panic
+	for _, srv := range []*Server{first, second} {
+		writeFile(t, srv.Root, "f", testData(100))
+		if _, err := newTestClient(srv.LocalAddr().String()).Download("f", io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "both downloads to be counted", func() bool { return metricValue(t, name, bytesReadMetric) == 200 })
+	if got := metricValue(t, name, requestsMetric); got != 2 {
+		t.Errorf("requests = %v, want 2", got)
+	}
+}
+
+func TestMetricsNameTaken(t *testing.T) {
+	name := newExpvarName(t)
+	expvar.NewString(name)
+	srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+	srv.ExpvarName = name
+	select {
+	case err := <-srv.Serve(make(chan CancelType)):
+		if err == nil || !strings.Contains(err.Error(), "already published") {
+			t.Errorf("Serve returned %v, want an error saying the name is taken", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not fail")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"bufio"
+	"runtime"
+)
+
+// LineEnding is the line separator of text files on disk, which netascii transfers convert
+// to and from the CR LF line separator that netascii sends over the network.
+type LineEnding int
+
+const (
+	// HostLineEnding is the line separator of the operating system the server runs on:
+	// CR LF on Windows, and LF everywhere else.
+	HostLineEnding LineEnding = iota
+
+	// LFLineEnding is the LF line separator of Unix-like systems.
+	LFLineEnding
+
+	// CRLFLineEnding is the CR LF line separator of Windows.
+	CRLFLineEnding
+)
+
+// crlf reports whether lines end with CR LF, resolving HostLineEnding for the running system.
+func (lineEnding LineEnding) crlf() bool {
+	switch lineEnding {
+	case LFLineEnding:
+		return false
+	case CRLFLineEnding:
+		return true
+	default:
+		return runtime.GOOS == "windows"
+	}
+}
+
+// netasciiEncoder reads a file as netascii, as defined in RFC 764: each line separator becomes CR LF, and
+// every other CR becomes CR NUL.
+type netasciiEncoder struct {
+	file     *bufio.Reader
+	crlf     bool   // crlf is set if the file's lines end with CR LF rather than LF
+	pending  []byte // pending holds encoded bytes that did not fit in the last Read
+	consumed int64  // consumed is the number of bytes read from the file so far
+}
+
+func newNetasciiEncoder(file *bufio.Reader, lineEnding LineEnding) *netasciiEncoder {
+	return &netasciiEncoder{file: file, crlf: lineEnding.crlf()}
+}
+
+func (encoder *netasciiEncoder) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(encoder.pending) > 0 {
+			n += copy(p[n:], encoder.pending)
+			encoder.pending = encoder.pending[:0]
+			continue
+		}
+		b, err := encoder.file.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		encoder.consumed++
+		switch b {
+		case '\n':
+			p[n] = '\r'
+			encoder.pending = append(encoder.pending, '\n')
+		case '\r':
+			p[n] = '\r'
+			if next, err := encoder.file.Peek(1); encoder.crlf && err == nil && next[0] == '\n' {
+				_, _ = encoder.file.ReadByte()
+				encoder.consumed++
+				encoder.pending = append(encoder.pending, '\n')
+			} else {
+				encoder.pending = append(encoder.pending, 0x00)
+			}
+		default:
+			p[n] = b
+		}
+		n++
+	}
+	return n, nil
+}
+
+// netasciiDecoder writes netascii to a file, turning each CR LF into the file's line separator and each
+// CR NUL into a CR. A CR at the end of one Write is held until the next, as it depends on the byte after it.
+type netasciiDecoder struct {
+	file      *bufio.Writer
+	crlf      bool  // crlf is set if the file's lines end with CR LF rather than LF
+	pendingCR bool  // pendingCR is set if the last byte written was a CR
+	written   int64 // written is the number of bytes written to the file so far
+}
+
+func newNetasciiDecoder(file *bufio.Writer, lineEnding LineEnding) *netasciiDecoder {
+	return &netasciiDecoder{file: file, crlf: lineEnding.crlf()}
+}
+
+func (decoder *netasciiDecoder) Write(p []byte) (n int, err error) {
+	for _, b := range p {
+		err = decoder.writeByte(b)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (decoder *netasciiDecoder) writeByte(b byte) error {
+	if !decoder.pendingCR {
+		if b == '\r' {
+			decoder.pendingCR = true
+			return nil
+		}
+		return decoder.writeFileByte(b)
+	}
+
+	decoder.pendingCR = false
+	switch b {
+	case '\n':
+		if decoder.crlf {
+			if err := decoder.writeFileByte('\r'); err != nil {
+				return err
+			}
+		}
+		return decoder.writeFileByte('\n')
+	case 0x00:
+		return decoder.writeFileByte('\r')
+	default: // a bare CR is not valid netascii, so it is kept as it is
+		if err := decoder.writeFileByte('\r'); err != nil {
+			return err
+		}
+		return decoder.writeByte(b)
+	}
+}
+
+// finish writes a CR left pending by the final Write.
+func (decoder *netasciiDecoder) finish() error {
+	if !decoder.pendingCR {
+		return nil
+	}
+	decoder.pendingCR = false
+	return decoder.writeFileByte('\r')
+}
+
+// writeFileByte writes b to the file, counting it in written.
+func (decoder *netasciiDecoder) writeFileByte(b byte) error {
+	err := decoder.file.WriteByte(b)
+	if err == nil {
+		decoder.written++
+	}
+	return err
+}
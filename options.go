@@ -0,0 +1,212 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"math"
+	"strconv"
+)
+
+// Option names recognized by the server. Any other option requested by a client is ignored,
+// which RFC 2347 specifies is how a server declines an option.
+const (
+	blksizeOption  = "blksize"  // the number of data bytes in each DATA packet, defined in RFC 2348
+	rolloverOption = "rollover" // the block number that follows 65535, a common extension to RFC 2347
+	tsizeOption    = "tsize"    // the size of the file in bytes, defined in RFC 2349
+	offsetOption   = "offset"   // the byte offset a read starts from, a non-standard extension for resuming downloads
+)
+
+const (
+	// minBlockSize is the smallest blksize value allowed by RFC 2348.
+	minBlockSize = 8
+
+	// maxBlockSize is the largest blksize value allowed by RFC 2348.
+	maxBlockSize = 65464
+
+	// maxAcceptedBlockSize is the largest blksize the server will agree to. It is the largest block that fits
+	// in a DATA packet read into a buffer of bufferSize bytes. Larger requests are answered with this value,
+	// as RFC 2348 allows a server to respond with a smaller block size than the one requested.
+	maxAcceptedBlockSize = bufferSize - sizeOfOpCode - 2
+)
+
+// transferOptions holds the values that control a single transfer once its options have been negotiated.
+type transferOptions struct {
+	// blockSize is the number of data bytes carried by each DATA packet.
+	blockSize int
+
+	// rollover is the block number that follows block 65535, either 0 or 1.
+	rollover uint16
+
+	// transferSize is the size of the file in bytes given by the tsize option, or -1 if it was not requested.
+	// A read request asks for it with a value of 0, and is answered with the size of the file.
+	transferSize int64
+
+	// offset is the byte offset of the file that a read transfer starts from, so that a client can resume
+	// an interrupted download. It is 0 unless the offset option was accepted.
+	offset int64
+
+	// accepted holds each option the server agreed to and the value it agreed to, which are echoed to
+	// the client in an OACK packet. If it is empty, the transfer proceeds as defined in RFC 1350.
+	accepted map[string]string
+
+	// maxRoundTrips is the server's limit on DATA/ACK round trips, or 0 for no limit. It is not negotiated.
+	maxRoundTrips int
+
+	// maxDuplicates is the server's limit on consecutive duplicate packets, or 0 for no limit. It is not negotiated.
+	maxDuplicates int
+
+	// readAhead is the number of blocks a read transfer reads from its file ahead of the client, or 0 to
+	// read each block only once the previous one has been acknowledged. It is not negotiated.
+	readAhead int
+
+	// lineEnding is the line separator that netascii transfers convert to and from on disk. It is not negotiated.
+	lineEnding LineEnding
+
+	// fileSystem is the file system the file of the transfer is opened on. It is not negotiated.
+	fileSystem FileSystem
+
+	// omitEmptyFinalBlock is set if a read transfer ends once the last full block is acknowledged rather than
+	// sending an empty final block, for legacy clients that hang on it. It is not negotiated.
+	omitEmptyFinalBlock bool
+}
+
+// negotiateOptions decides which of the requested options the server will honor. An option with a
+// value the server cannot honor is omitted from the accepted options rather than failing the transfer,
+// so the transfer falls back to the behavior of RFC 1350 for that option.
+func negotiateOptions(requested map[string]string) transferOptions {
+	opts := transferOptions{
+		blockSize:    defaultBlockSize,
+		transferSize: -1,
+		accepted:     make(map[string]string),
+	}
+	for name, value := range requested {
+		switch name {
+		case blksizeOption:
+			blockSize, ok := parseBlockSize(value)
+			if ok {
+				opts.blockSize = blockSize
+				opts.accepted[name] = strconv.Itoa(blockSize)
+			}
+		case rolloverOption:
+			if value == "0" || value == "1" {
+				rollover, _ := strconv.Atoi(value)
+				opts.rollover = uint16(rollover)
+				opts.accepted[name] = value
+			}
+		case tsizeOption:
+			transferSize, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && transferSize >= 0 {
+				opts.transferSize = transferSize
+				opts.accepted[name] = strconv.FormatInt(transferSize, 10)
+			}
+		case offsetOption:
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && offset >= 0 {
+				opts.offset = offset
+				opts.accepted[name] = strconv.FormatInt(offset, 10)
+			}
+		}
+	}
+	return opts
+}
+
+// answerOffset clamps the offset requested for a read transfer to size, the size of the file being read,
+// so that resuming a download that has already finished sends only the empty final block. If the offset
+// cannot be honored, as for a write or a netascii transfer, whose offsets on the network and on disk differ,
+// the option is declined instead.
+func (opts *transferOptions) answerOffset(size int64, honored bool) {
+	if _, ok := opts.accepted[offsetOption]; !ok {
+		return
+	}
+	if !honored {
+		opts.offset = 0
+		delete(opts.accepted, offsetOption)
+		return
+	}
+	if opts.offset > size {
+		opts.offset = size
+	}
+	opts.accepted[offsetOption] = strconv.FormatInt(opts.offset, 10)
+}
+
+// answerTransferSize replaces the tsize value of a read request, which is 0, with size, the number of bytes
+// of the file that will be sent, which is less than its size if the read starts from an offset. If the size is not known in advance, as when netascii conversion may change it, the
+// option is declined instead, as RFC 2349 allows.
+func (opts *transferOptions) answerTransferSize(size int64, known bool) {
+	if opts.transferSize < 0 {
+		return
+	}
+	if !known {
+		opts.transferSize = -1
+		delete(opts.accepted, tsizeOption)
+		return
+	}
+	opts.transferSize = size
+	opts.accepted[tsizeOption] = strconv.FormatInt(size, 10)
+}
+
+// parseBlockSize parses a requested blksize value. It reports false for a value that is not a decimal
+// number within the range allowed by RFC 2348, and caps a valid value at maxAcceptedBlockSize.
+func parseBlockSize(value string) (int, bool) {
+	blockSize, err := strconv.Atoi(value)
+	if err != nil || blockSize < minBlockSize || blockSize > maxBlockSize {
+		return 0, false
+	}
+	if blockSize > maxAcceptedBlockSize {
+		blockSize = maxAcceptedBlockSize
+	}
+	return blockSize, true
+}
+
+// roundBlockSizeToPowerOfTwo rounds an accepted blksize down to the nearest power of two. It does
+// nothing if the blksize option was not accepted.
+func (opts *transferOptions) roundBlockSizeToPowerOfTwo() {
+	if _, ok := opts.accepted[blksizeOption]; !ok {
+		return
+	}
+	blockSize := minBlockSize // the smallest block size RFC 2348 allows is itself a power of two
+	for blockSize*2 <= opts.blockSize {
+		blockSize *= 2
+	}
+	opts.blockSize = blockSize
+	opts.accepted[blksizeOption] = strconv.Itoa(blockSize)
+}
+
+// declineBlockSizeBelow declines an accepted blksize smaller than min, so that the transfer uses the default
+// block size of RFC 1350. A min larger than the default block size acts as the default block size.
+func (opts *transferOptions) declineBlockSizeBelow(min int) {
+	if _, ok := opts.accepted[blksizeOption]; !ok {
+		return
+	}
+	if min > defaultBlockSize {
+		min = defaultBlockSize
+	}
+	if opts.blockSize < min {
+		opts.blockSize = defaultBlockSize
+		delete(opts.accepted, blksizeOption)
+	}
+}
+
+// nextBlockNumber returns the block number that follows blockNumber, wrapping around to the
+// negotiated rollover value after block 65535.
+func (opts transferOptions) nextBlockNumber(blockNumber uint16) uint16 {
+	if blockNumber == math.MaxUint16 {
+		return opts.rollover
+	}
+	return blockNumber + 1
+}
+
+// oack returns the OACK packet acknowledging the accepted options, and false if no options were accepted.
+func (opts transferOptions) oack() ([]byte, bool) {
+	if len(opts.accepted) == 0 {
+		return nil, false
+	}
+	raw, err := createOackPacket(opts.accepted).bytes()
+	if err != nil {
+		return internalErrorPacket().raw, true
+	}
+	return raw, true
+}
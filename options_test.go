@@ -0,0 +1,140 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestNegotiateBlockSize(t *testing.T) {
+	tests := []struct {
+		value         string
+		wantBlockSize int
+		wantAccepted  bool
+		powerOfTwo    bool // powerOfTwo rounds the block size as PowerOfTwoBlockSize does
+	}{
+		{"0", defaultBlockSize, false, false},
+		{"abc", defaultBlockSize, false, false},
+		{"-5", defaultBlockSize, false, false},
+		{"", defaultBlockSize, false, false},
+		{"1e3", defaultBlockSize, false, false},
+		{"7", defaultBlockSize, false, false},
+		{"70000", defaultBlockSize, false, false},
+		{"65465", defaultBlockSize, false, false},
+		{"8", 8, true, false},
+		{"512", 512, true, false},
+		{"1428", 1428, true, false},
+		{"65464", maxAcceptedBlockSize, true, false}, // valid, but larger than the server accepts
+		{"8", 8, true, true},
+		{"9", 8, true, true},
+		{"512", 512, true, true},
+		{"1428", 1024, true, true},
+		{"65464", 1024, true, true}, // maxAcceptedBlockSize, rounded down
+		{"7", defaultBlockSize, false, true},
+		{"abc", defaultBlockSize, false, true},
+	}
+	for _, tt := range tests {
+		name := strconv.Quote(tt.value)
+		if tt.powerOfTwo {
+			name += " rounded to a power of two"
+		}
+		t.Run(name, func(t *testing.T) {
+			opts := negotiateOptions(map[string]string{blksizeOption: tt.value})
+			if tt.powerOfTwo {
+				opts.roundBlockSizeToPowerOfTwo()
+			}
+			if opts.blockSize != tt.wantBlockSize {
+				t.Errorf("blockSize = %v, want %v", opts.blockSize, tt.wantBlockSize)
+			}
+			value, accepted := opts.accepted[blksizeOption]
+			if accepted != tt.wantAccepted {
+				t.Fatalf("blksize accepted = %v, want %v", accepted, tt.wantAccepted)
+			}
+			if accepted && value != strconv.Itoa(tt.wantBlockSize) {
+				t.Errorf("OACK blksize = %q, want %q", value, strconv.Itoa(tt.wantBlockSize))
+			}
+			if _, ok := opts.oack(); ok != tt.wantAccepted {
+				t.Errorf("OACK sent = %v, want %v", ok, tt.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestInvalidBlockSizeFallsBackToDefault(t *testing.T) {
+	for _, value := range []string{"0", "abc", "-5", "70000"} {
+		t.Run(value, func(t *testing.T) {
+			srv := startServer(t, nil)
+			writeFile(t, srv.Root, "f", testData(2*defaultBlockSize))
+			client := newRawClient(t)
+
+			client.sendRequest(srv.LocalAddr(), read, "f", map[string]string{blksizeOption: value})
+			dataPacket, _ := client.receiveData() // no OACK, as no option was accepted
+			if dataPacket.blockNumber != 1 || len(dataPacket.data) != defaultBlockSize {
+				t.Errorf("first block is DATA(%v) of %v bytes, want DATA(1) of %v bytes",
+					dataPacket.blockNumber, len(dataPacket.data), defaultBlockSize)
+			}
+		})
+	}
+}
+
+func TestDeclineBlockSizeBelow(t *testing.T) {
+	tests := []struct {
+		value         string
+		min           int
+		wantBlockSize int
+		wantAccepted  bool
+	}{
+		{"8", 0, 8, true},
+		{"8", 512, defaultBlockSize, false},
+		{"511", 512, defaultBlockSize, false},
+		{"512", 512, 512, true},
+		{"1024", 512, 1024, true},
+		{"256", 4096, defaultBlockSize, false}, // a floor above 512 acts as 512
+		{"512", 4096, 512, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v/%v", tt.value, tt.min), func(t *testing.T) {
+			opts := negotiateOptions(map[string]string{blksizeOption: tt.value})
+			opts.declineBlockSizeBelow(tt.min)
+			if opts.blockSize != tt.wantBlockSize {
+				t.Errorf("blockSize = %v, want %v", opts.blockSize, tt.wantBlockSize)
+			}
+			if _, accepted := opts.accepted[blksizeOption]; accepted != tt.wantAccepted {
+				t.Errorf("blksize accepted = %v, want %v", accepted, tt.wantAccepted)
+			}
+		})
+	}
+}
+
+// TestMinBlockSize checks that a blksize below the server's floor is left out of the OACK rather than
+// answered with the floor, as RFC 2348 does not let a server answer with a larger block size than the
+// client asked for.
+func TestMinBlockSize(t *testing.T) {
+	srv := startServer(t, func(srv *Server) { srv.MinBlockSize = 512 })
+	data := testData(3 * defaultBlockSize)
+	writeFile(t, srv.Root, "f", data)
+	client := newRawClient(t)
+
+	client.sendRequest(srv.LocalAddr(), read, "f", map[string]string{blksizeOption: "8", tsizeOption: "0"})
+	packet := client.receive()
+	oackPacket, err := parseOackPacket(packet)
+	if err != nil {
+		t.Fatalf("expected OACK, got %v", describe(packet.data))
+	}
+	if value, ok := oackPacket.options[blksizeOption]; ok {
+		t.Errorf("OACK blksize = %q, want blksize declined", value)
+	}
+	client.send(packet.from, mustBytes(createAckPacket(0).bytes()))
+	first, _ := client.receiveData()
+	if len(first.data) != defaultBlockSize {
+		t.Fatalf("first block has %v bytes, want %v", len(first.data), defaultBlockSize)
+	}
+	if got := client.download(packet.from, first, defaultBlockSize); !bytes.Equal(got, data) {
+		t.Errorf("received %v bytes, want %v", len(got), len(data))
+	}
+}
@@ -8,32 +8,104 @@ package tftp
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strings"
 )
 
 type Packet struct {
 	from net.Addr
 	data []byte
+	to   net.IP // to is the local address the packet was sent to, if the Conn that read it captures it
+
+	// truncated is set if the datagram was larger than bufferSize bytes, the most the server accepts. The
+	// rest of it beyond the buffer it was read into was discarded by the socket.
+	truncated bool
+
 	error
 }
 
+// From returns the address the packet was received from.
+func (packet Packet) From() net.Addr {
+	return packet.from
+}
+
+// To returns the local address the packet was sent to, or nil if the Conn that read it was not
+// set to capture it with CaptureDestination.
+func (packet Packet) To() net.IP {
+	return packet.to
+}
+
+// Data returns the raw contents of the packet. It must not be modified.
+func (packet Packet) Data() []byte {
+	return packet.data
+}
+
+// ParsePacket parses the raw datagram data received from the address from into a typed packet,
+// chosen by its opcode: a *RequestPacket for RRQ and WRQ, a *DataPacket for DATA, an *AckPacket
+// for ACK, an *ErrorPacket for ERROR, or an *OackPacket for OACK. If the datagram is not a correctly formed packet of one
+// of these types, an error is returned explaining why.
+func ParsePacket(from net.Addr, data []byte) (interface{}, error) {
+	packet := Packet{from: from, data: data}
+	op, err := packet.readOpCode()
+	if err != nil {
+		return nil, err
+	}
+	// each case checks err itself, so that a failed parse returns a nil interface rather than a typed nil pointer
+	switch op {
+	case RRQ, WRQ:
+		requestPacket, err := parseRequestPacket(packet, false)
+		if err != nil {
+			return nil, err
+		}
+		return requestPacket, nil
+	case DATA:
+		dataPacket, err := parseDataPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+		return dataPacket, nil
+	case ACK:
+		ackPacket, err := parseAckPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+		return ackPacket, nil
+	case ERROR:
+		errorPacket, err := parseErrorPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+		return errorPacket, nil
+	case OACK:
+		oackPacket, err := parseOackPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+		return oackPacket, nil
+	default:
+		return nil, fmt.Errorf("expected opcode matching RRQ(%v), WRQ(%v), DATA(%v), ACK(%v), ERROR(%v) or OACK(%v), found %v",
+			RRQ, WRQ, DATA, ACK, ERROR, OACK, op)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 // RequestPacket is generated from a RRQ/WRQ packet as defined in RFC 1350.
 type RequestPacket struct {
-	openFlag            // generated from the opCode
-	filename     string // null-terminator is removed
-	encodingFlag        // generated from the mode value
+	openFlag                       // generated from the opCode
+	filename     string            // null-terminator is removed
+	encodingFlag                   // generated from the mode value
+	options      map[string]string // option names are lower-cased, as they are case-insensitive (RFC 2347)
 }
 
 // parseRequestPacket parses the packet's raw into the fields of
 // the returned RequestPacket. If the packet is not correctly
-// formed, an error is returned explaining why.
-func parseRequestPacket(packet Packet) (*RequestPacket, error) {
+// formed, an error is returned explaining why. If lenientModes
+// is set, an unrecognized mode is treated as octet.
+func parseRequestPacket(packet Packet, lenientModes bool) (*RequestPacket, error) {
 	openFlag, err := packet.readOpenFlag()
 	if err != nil {
 		return nil, err
@@ -42,7 +114,11 @@ func parseRequestPacket(packet Packet) (*RequestPacket, error) {
 	if err != nil {
 		return nil, err
 	}
-	encodingFlag, err := packet.readEncodingFlag()
+	encodingFlag, err := packet.readEncodingFlag(lenientModes)
+	if err != nil {
+		return nil, err
+	}
+	options, err := packet.readOptions()
 	if err != nil {
 		return nil, err
 	}
@@ -50,10 +126,47 @@ func parseRequestPacket(packet Packet) (*RequestPacket, error) {
 		openFlag:     openFlag,
 		filename:     filename,
 		encodingFlag: encodingFlag,
+		options:      options,
 	}
 	return request, nil
 }
 
+// Filename returns the name of the file that the request asks to read or write, as the client sent it.
+func (requestPacket RequestPacket) Filename() string {
+	return requestPacket.filename
+}
+
+// Mode returns the transfer mode that the request asks for.
+func (requestPacket RequestPacket) Mode() Mode {
+	if requestPacket.encodingFlag == netascii {
+		return ModeNetascii
+	}
+	return ModeOctet
+}
+
+// IsRead reports whether the packet is a read request (RRQ), which asks to download a file.
+func (requestPacket RequestPacket) IsRead() bool {
+	return requestPacket.openFlag == read
+}
+
+// IsWrite reports whether the packet is a write request (WRQ), which asks to upload a file.
+func (requestPacket RequestPacket) IsWrite() bool {
+	return requestPacket.openFlag == write
+}
+
+// Options returns a copy of the options that the request carries, keyed by their lower-cased names, or
+// nil if it carries none.
+func (requestPacket RequestPacket) Options() map[string]string {
+	if len(requestPacket.options) == 0 {
+		return nil
+	}
+	options := make(map[string]string, len(requestPacket.options))
+	for name, value := range requestPacket.options {
+		options[name] = value
+	}
+	return options
+}
+
 func (packet Packet) readOpenFlag() (openFlag, error) {
 	var flag openFlag
 	op, err := packet.readOpCode()
@@ -78,37 +191,84 @@ func opCodeToOpenFlag(op opCode) (openFlag, error) {
 
 func (packet Packet) readFilename() (string, error) {
 	if len(packet.data) < minRequestPacketSize {
-		return "", errors.New("incorrectly formed request packet")
+		return "", packet.parseError(len(packet.data), "incorrectly formed request packet: shorter than %v bytes", minRequestPacketSize)
 	}
 	buffer := bytes.NewBuffer(packet.data)
 	buffer.Next(sizeOfOpCode)
-	return readNetasciiString(buffer)
+	filename, err := readRawString(buffer)
+	if err != nil {
+		return "", packet.parseError(sizeOfOpCode, "incorrectly formed request packet: filename is not null-terminated")
+	}
+	return filename, nil
 }
 
-func (packet Packet) readEncodingFlag() (encodingFlag, error) {
+func (packet Packet) readEncodingFlag(lenientModes bool) (encodingFlag, error) {
 	var flag encodingFlag
 	if len(packet.data) < minRequestPacketSize {
-		return flag, errors.New("incorrectly formed request packet")
+		return flag, packet.parseError(len(packet.data), "incorrectly formed request packet: shorter than %v bytes", minRequestPacketSize)
 	}
 	buffer := bytes.NewBuffer(packet.data)
 	buffer.Next(sizeOfOpCode)
 	_, err := readNetasciiString(buffer) // the first string is the filename
 	if err != nil {
-		return flag, err
+		return flag, packet.parseError(sizeOfOpCode, "incorrectly formed request packet: filename is not null-terminated")
 	}
+	offset := packet.offsetOf(buffer)
 	mode, err := readNetasciiString(buffer)
 	if err != nil {
-		return flag, err
+		return flag, packet.parseError(offset, "incorrectly formed request packet: mode is not null-terminated")
+	}
+	flag, err = modeToEncodingFlag(mode, lenientModes)
+	if err != nil {
+		return flag, packet.parseError(offset, "%v", err)
+	}
+	return flag, nil
+}
+
+// readOptions reads the option name and value pairs that may follow the mode of a request packet as
+// defined in RFC 2347. A request without options returns an empty map.
+func (packet Packet) readOptions() (map[string]string, error) {
+	if len(packet.data) < minRequestPacketSize {
+		return nil, packet.parseError(len(packet.data), "incorrectly formed request packet: shorter than %v bytes", minRequestPacketSize)
+	}
+	buffer := bytes.NewBuffer(packet.data)
+	buffer.Next(sizeOfOpCode)
+	for i := 0; i < 2; i++ { // skip the filename and mode
+		offset := packet.offsetOf(buffer)
+		if _, err := readNetasciiString(buffer); err != nil {
+			return nil, packet.parseError(offset, "incorrectly formed request packet: string is not null-terminated")
+		}
 	}
-	return modeToEncodingFlag(mode)
+	return packet.readOptionPairs(buffer)
 }
 
-func modeToEncodingFlag(mode string) (encodingFlag, error) {
+// readOptionPairs reads option name and value pairs from the rest of buffer, which holds the end of the packet.
+func (packet Packet) readOptionPairs(buffer *bytes.Buffer) (map[string]string, error) {
+	options := make(map[string]string)
+	for buffer.Len() > 0 {
+		offset := packet.offsetOf(buffer)
+		name, err := readNetasciiString(buffer)
+		if err != nil {
+			return nil, packet.parseError(offset, "option name is not null-terminated")
+		}
+		offset = packet.offsetOf(buffer)
+		value, err := readNetasciiString(buffer)
+		if err != nil {
+			return nil, packet.parseError(offset, "option %v is missing a value", name)
+		}
+		options[strings.ToLower(name)] = value
+	}
+	return options, nil
+}
+
+// modeToEncodingFlag returns the encoding of the named mode. An unrecognized mode is an error,
+// unless lenientModes is set, in which case it is treated as octet.
+func modeToEncodingFlag(mode string, lenientModes bool) (encodingFlag, error) {
 	mode = strings.ToLower(mode)
-	switch mode {
-	case "netascii":
+	switch {
+	case mode == "netascii":
 		return netascii, nil
-	case "octet":
+	case mode == "octet", lenientModes:
 		return octet, nil
 	default:
 		var flag encodingFlag
@@ -117,6 +277,109 @@ func modeToEncodingFlag(mode string) (encodingFlag, error) {
 	}
 }
 
+func createRequestPacket(openFlag openFlag, filename string, encodingFlag encodingFlag) RequestPacket {
+	requestPacket := RequestPacket{
+		openFlag:     openFlag,
+		filename:     filename,
+		encodingFlag: encodingFlag,
+	}
+	return requestPacket
+}
+
+func (requestPacket RequestPacket) bytes() ([]byte, error) {
+	op, err := openFlagToOpCode(requestPacket.openFlag)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := encodingFlagToMode(requestPacket.encodingFlag)
+	if err != nil {
+		return nil, err
+	}
+	elements := []interface{}{op, []byte(requestPacket.filename), byte(0x00), []byte(mode), byte(0x00)}
+	return binaryWrite(append(elements, optionElements(requestPacket.options)...)...)
+}
+
+func openFlagToOpCode(flag openFlag) (opCode, error) {
+	switch flag {
+	case read:
+		return RRQ, nil
+	case write:
+		return WRQ, nil
+	default:
+		var op opCode
+		err := fmt.Errorf("expected open flag matching read or write, found %v", flag)
+		return op, err
+	}
+}
+
+func encodingFlagToMode(flag encodingFlag) (string, error) {
+	switch flag {
+	case netascii:
+		return "netascii", nil
+	case octet:
+		return "octet", nil
+	default:
+		err := fmt.Errorf("expected encoding flag matching netascii or octet, found %v", flag)
+		return "", err
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// OackPacket is generated from the options accepted for a request, as defined in RFC 2347.
+type OackPacket struct {
+	options map[string]string
+}
+
+func createOackPacket(options map[string]string) OackPacket {
+	oackPacket := OackPacket{
+		options: options,
+	}
+	return oackPacket
+}
+
+// parseOackPacket parses the packet into the fields of
+// the returned OackPacket. If the packet is not correctly
+// formed, an error is returned explaining why.
+func parseOackPacket(packet Packet) (*OackPacket, error) {
+	op, err := packet.readOpCode()
+	if err != nil {
+		return nil, err
+	}
+	if op != OACK {
+		return nil, errOperation
+	}
+	buffer := bytes.NewBuffer(packet.data)
+	buffer.Next(sizeOfOpCode)
+	options, err := packet.readOptionPairs(buffer)
+	if err != nil {
+		return nil, err
+	}
+	oackPacket := &OackPacket{
+		options: options,
+	}
+	return oackPacket, nil
+}
+
+func (oackPacket OackPacket) bytes() ([]byte, error) {
+	return binaryWrite(append([]interface{}{OACK}, optionElements(oackPacket.options)...)...)
+}
+
+// optionElements returns the null-terminated name and value of each option, ordered by name, for binaryWrite.
+func optionElements(options map[string]string) []interface{} {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names) // map iteration order is random, but the packet should be reproducible
+
+	var elements []interface{}
+	for _, name := range names {
+		elements = append(elements, []byte(name), byte(0x00), []byte(options[name]), byte(0x00))
+	}
+	return elements
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 // AckPacket is generated from a ACK packet as defined in RFC 1350.
@@ -124,6 +387,27 @@ type AckPacket struct {
 	blockNumber uint16
 }
 
+// parseAckPacket parses the packet into the fields of
+// the returned AckPacket. If the packet is not correctly
+// formed, an error is returned explaining why.
+func parseAckPacket(packet Packet) (*AckPacket, error) {
+	op, err := packet.readOpCode()
+	if err != nil {
+		return nil, err
+	}
+	if op != ACK {
+		return nil, errOperation
+	}
+	blockNumber, err := packet.readBlockNumber()
+	if err != nil {
+		return nil, err
+	}
+	ackPacket := &AckPacket{
+		blockNumber: blockNumber,
+	}
+	return ackPacket, nil
+}
+
 func createAckPacket(blockNumber uint16) AckPacket {
 	ackPacket := AckPacket{
 		blockNumber: blockNumber,
@@ -188,7 +472,7 @@ func (packet Packet) readBlockNumber() (uint16, error) {
 		return blockNumber, err
 	}
 	if err := binary.Read(bytesReader, binary.BigEndian, &blockNumber); err != nil {
-		return blockNumber, err
+		return blockNumber, packet.parseError(offset, "packet is too short to hold a block number")
 	}
 	return blockNumber, nil
 }
@@ -229,6 +513,34 @@ type ErrorPacket struct {
 	raw []byte
 }
 
+// parseErrorPacket parses the packet into the fields of
+// the returned ErrorPacket. If the packet is not correctly
+// formed, an error is returned explaining why.
+func parseErrorPacket(packet Packet) (*ErrorPacket, error) {
+	op, err := packet.readOpCode()
+	if err != nil {
+		return nil, err
+	}
+	if op != ERROR {
+		return nil, errOperation
+	}
+	errorCode, err := packet.readBlockNumber() // the error code occupies the same position as a block number
+	if err != nil {
+		return nil, err
+	}
+	buffer := bytes.NewBuffer(packet.data)
+	buffer.Next(sizeOfOpCode + binary.Size(errorCode))
+	errMsg, err := readNetasciiString(buffer)
+	if err != nil {
+		return nil, packet.parseError(sizeOfOpCode+binary.Size(errorCode), "error message is not null-terminated")
+	}
+	errorPacket := &ErrorPacket{
+		tftpError: newTFTPError(errorCode, errMsg),
+		raw:       packet.data,
+	}
+	return errorPacket, nil
+}
+
 func createErrorPacket(tftpErr tftpError) (ErrorPacket, error) {
 	size, err := errorPacketSize(tftpErr)
 	if err != nil {
@@ -245,7 +557,7 @@ func createErrorPacket(tftpErr tftpError) (ErrorPacket, error) {
 
 	write(ERROR)
 	write(tftpErr.errorCode)
-	fixedLengthData := []byte(tftpErr.errorMsg.Error())
+	fixedLengthData := errorMessageBytes(tftpErr)
 	write(fixedLengthData)
 	write(byte(0x00))
 
@@ -262,11 +574,32 @@ func createErrorPacket(tftpErr tftpError) (ErrorPacket, error) {
 	return pak, nil
 }
 
+// SendError sends an ERROR packet with code and message to addr over conn, outside of any transfer,
+// such as an unknown transfer ID error to a stranger or a custom error from a proxy. A message longer
+// than an ERROR packet carries is truncated.
+func SendError(conn net.PacketConn, addr net.Addr, code ErrorCode, message string) error {
+	pak, err := createErrorPacket(newTFTPError(uint16(code), message))
+	if err != nil {
+		return err
+	}
+	return writePacket(conn, pak.raw, addr)
+}
+
 func errorPacketSize(err tftpError) (int, error) {
-	fixedLengthData := []byte(err.errorMsg.Error())
+	fixedLengthData := errorMessageBytes(err)
 	return binarySize(ERROR, err.errorCode, fixedLengthData, byte(0x00))
 }
 
+// errorMessageBytes returns the message of err as it is written to an ERROR packet, truncated to
+// maxErrorMessageSize bytes so that the packet fits in a single datagram of any block size.
+func errorMessageBytes(err tftpError) []byte {
+	errMsg := []byte(err.errorMsg)
+	if len(errMsg) > maxErrorMessageSize {
+		errMsg = errMsg[:maxErrorMessageSize]
+	}
+	return errMsg
+}
+
 func internalErrorPacket() ErrorPacket {
 	errStr := "internal server error"
 	opCode := []byte{0x00, 0x05}
@@ -277,11 +610,8 @@ func internalErrorPacket() ErrorPacket {
 	raw, _ := binaryWrite(opCode, errorCode, errMsg, nullTerminator)
 
 	errPak := ErrorPacket{
-		tftpError: tftpError{
-			errorCode: 0,
-			errorMsg:  errors.New(errStr),
-		},
-		raw: raw,
+		tftpError: newTFTPError(0, errStr),
+		raw:       raw,
 	}
 	return errPak
 }
@@ -297,15 +627,67 @@ func readNetasciiString(buffer *bytes.Buffer) (string, error) {
 	return str, nil
 }
 
+// readRawString reads a null-terminated string as raw 8-bit bytes, so that a filename encoded
+// as UTF-8 or any other 8-bit encoding is returned unchanged apart from its terminator.
+func readRawString(buffer *bytes.Buffer) (string, error) {
+	raw, err := buffer.ReadBytes(0x00)
+	if err != nil {
+		return "", err
+	}
+	return string(raw[:len(raw)-1]), nil
+}
+
 func (packet Packet) readOpCode() (opCode, error) {
 	bytesReader := bytes.NewReader(packet.data)
 	var op opCode
 	if err := binary.Read(bytesReader, binary.BigEndian, &op); err != nil {
-		return op, err
+		return op, packet.parseError(0, "packet is too short to hold an opcode")
 	}
 	return op, nil
 }
 
+// offsetOf returns the offset in the packet of the next byte to be read from buffer, which holds the end of the packet.
+func (packet Packet) offsetOf(buffer *bytes.Buffer) int {
+	return len(packet.data) - buffer.Len()
+}
+
+// parseErrorContext is the number of bytes either side of the offset of a parseError that it shows.
+const parseErrorContext = 8
+
+// parseError returns an error explaining why parsing the packet failed at offset, followed by a hex dump of the
+// bytes around the offset, so that a malformed packet from a quirky client can be diagnosed from the log alone.
+func (packet Packet) parseError(offset int, format string, a ...interface{}) error {
+	if offset > len(packet.data) {
+		offset = len(packet.data)
+	}
+	start, end := offset-parseErrorContext, offset+parseErrorContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(packet.data) {
+		end = len(packet.data)
+	}
+	var dump strings.Builder
+	if start > 0 {
+		dump.WriteString("... ")
+	}
+	fmt.Fprintf(&dump, "% x", packet.data[start:offset])
+	if offset < end {
+		if offset > start {
+			dump.WriteString(" ")
+		}
+		fmt.Fprintf(&dump, "[%02x] % x", packet.data[offset], packet.data[offset+1:end])
+	}
+	if end < len(packet.data) {
+		dump.WriteString(" ...")
+	}
+	msg := fmt.Sprintf(format, a...)
+	if len(packet.data) == 0 {
+		return fmt.Errorf("%v (the packet is empty)", msg)
+	}
+	return fmt.Errorf("%v (at byte offset %v of %v: %v)", msg, offset, len(packet.data), strings.TrimSpace(dump.String()))
+}
+
 func binaryWrite(elements ...interface{}) ([]byte, error) {
 	size, err := binarySize(elements...)
 	if err != nil {
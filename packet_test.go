@@ -0,0 +1,255 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    interface{}
+		wantErr string
+	}{
+		{"RRQ", "\x00\x01boot.bin\x00octet\x00", &RequestPacket{openFlag: read, filename: "boot.bin", encodingFlag: octet, options: map[string]string{}}, ""},
+		{"WRQ with options", "\x00\x02f\x00NetASCII\x00BLKSIZE\x001024\x00tsize\x000\x00",
+			&RequestPacket{openFlag: write, filename: "f", encodingFlag: netascii, options: map[string]string{"blksize": "1024", "tsize": "0"}}, ""},
+		{"DATA", "\x00\x03\x00\x07abc", &DataPacket{blockNumber: 7, data: []byte("abc")}, ""},
+		{"empty DATA", "\x00\x03\x00\x01", &DataPacket{blockNumber: 1, data: []byte{}}, ""},
+		{"ACK", "\x00\x04\x01\x02", &AckPacket{blockNumber: 0x0102}, ""},
+		{"ACK with padding", "\x00\x04\x00\x01\x00", &AckPacket{blockNumber: 1}, ""}, // trailing bytes are ignored
+		{"ERROR", "\x00\x05\x00\x01no such file\x00", &ErrorPacket{tftpError: newTFTPError(1, "no such file"), raw: []byte("\x00\x05\x00\x01no such file\x00")}, ""},
+		{"OACK", "\x00\x06blksize\x001024\x00", &OackPacket{options: map[string]string{"blksize": "1024"}}, ""},
+
+		{"empty", "", nil, "too short to hold an opcode"},
+		{"one byte", "\x00", nil, "too short to hold an opcode"},
+		{"unknown opcode", "\x00\x09abc", nil, "expected opcode"},
+		{"garbage", "\xff\xfe\xfd\xfc", nil, "expected opcode"},
+		{"short RRQ", "\x00\x01f\x00", nil, "shorter than"},
+		{"RRQ without mode terminator", "\x00\x01f\x00octet", nil, "mode is not null-terminated"},
+		{"RRQ with unknown mode", "\x00\x01f\x00mail\x00", nil, "mail"},
+		{"RRQ with option missing a value", "\x00\x01f\x00octet\x00blksize\x00", nil, "missing a value"},
+		{"short DATA", "\x00\x03\x00", nil, ""},
+		{"short ACK", "\x00\x04\x01", nil, ""},
+		{"ERROR without terminator", "\x00\x05\x00\x01oops", nil, "not null-terminated"},
+		{"OACK with option missing a value", "\x00\x06blksize\x00", nil, "missing a value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParsePacket(nil, []byte(test.data))
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("ParsePacket returned %#v, want an error", got)
+				}
+				if got != nil {
+					t.Errorf("ParsePacket returned %#v along with its error, want nil", got)
+				}
+				if !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error %q does not mention %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePacket returned %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParsePacket = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestPacketAccessors(t *testing.T) {
+	parsed, err := ParsePacket(nil, []byte("\x00\x02dir/f.txt\x00NETASCII\x00BlkSize\x00512\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := parsed.(*RequestPacket)
+	if req.Filename() != "dir/f.txt" || req.Mode() != ModeNetascii || !req.IsWrite() || req.IsRead() {
+		t.Errorf("request is %q in mode %v, write %v, read %v, want a netascii write of \"dir/f.txt\"",
+			req.Filename(), req.Mode(), req.IsWrite(), req.IsRead())
+	}
+	options := req.Options()
+	if !reflect.DeepEqual(options, map[string]string{"blksize": "512"}) {
+		t.Errorf("Options() = %v, want blksize 512", options)
+	}
+	options["blksize"] = "8" // a copy, which must not change the request
+	if req.Options()["blksize"] != "512" {
+		t.Error("changing the map returned by Options changed the request")
+	}
+
+	parsed, err = ParsePacket(nil, []byte("\x00\x01f\x00octet\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = parsed.(*RequestPacket)
+	if req.Mode() != ModeOctet || !req.IsRead() || req.Options() != nil {
+		t.Errorf("request is in mode %v, read %v, with options %v, want an octet read without options", req.Mode(), req.IsRead(), req.Options())
+	}
+}
+
+func TestSendError(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if err := SendError(conn, peer.LocalAddr(), CodeUnknownTID, "not one of my transfers"); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, bufferSize)
+	n, from, err := peer.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePacket(from, buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	errPak, ok := parsed.(*ErrorPacket)
+	if !ok {
+		t.Fatalf("received %T, want *ErrorPacket", parsed)
+	}
+	if errPak.errorMsg != "not one of my transfers" || !errors.Is(errPak.tftpError, ErrUnknownTID) {
+		t.Errorf("received error %v, want code %v with the message sent", errPak.tftpError, CodeUnknownTID)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		code ErrorCode
+		wire uint16
+	}{
+		{ErrUndefined, CodeNotDefined, 0},
+		{ErrFileNotFound, CodeFileNotFound, 1},
+		{ErrAccessViolation, CodeAccessViolation, 2},
+		{ErrDiskFull, CodeDiskFull, 3},
+		{ErrIllegalOperation, CodeIllegalOperation, 4},
+		{ErrUnknownTID, CodeUnknownTID, 5},
+		{ErrFileExists, CodeFileExists, 6},
+		{ErrNoSuchUser, CodeNoSuchUser, 7},
+		{ErrOptionRefused, CodeOptionNegotiation, 8},
+	}
+	for _, tt := range tests {
+		code, ok := ErrorCodeOf(tt.err)
+		if !ok || code != tt.code || uint16(code) != tt.wire {
+			t.Errorf("ErrorCodeOf(%v) = %v, %v, want %v (%v on the wire)", tt.err, code, ok, tt.code, tt.wire)
+		}
+		pak, err := createErrorPacket(tt.err.(tftpError))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := uint16(pak.raw[2])<<8 | uint16(pak.raw[3]); got != tt.wire {
+			t.Errorf("ERROR packet for %v carries code %v, want %v", tt.err, got, tt.wire)
+		}
+	}
+}
+
+func TestTFTPErrorHelpers(t *testing.T) {
+	err := newTFTPError(uint16(CodeFileNotFound), "file not found")
+	if err.errorCode != 1 || err.errorMsg != "file not found" || err.cause != nil {
+		t.Errorf("newTFTPError returned %+v", err)
+	}
+	if got, want := err.Error(), "TFTP error 1 occurred: file not found"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	formatted := errNoFile.fmt("%q is %v bytes", "f", 3)
+	if formatted.errorMsg != `file not found: "f" is 3 bytes` || formatted.errorCode != errNoFile.errorCode {
+		t.Errorf("fmt returned %+v", formatted)
+	}
+	if !errors.Is(formatted, ErrFileNotFound) || errors.Is(formatted, ErrAccessViolation) {
+		t.Errorf("%v does not match only the sentinel it was made from", formatted)
+	}
+
+	cause := errors.New("cause")
+	wrapped := formatted.wrap(cause).fmt("more")
+	if !errors.Is(wrapped, cause) || !errors.Is(wrapped, ErrFileNotFound) {
+		t.Errorf("%v does not match both its cause and its sentinel", wrapped)
+	}
+	if wrapped.errorMsg != formatted.errorMsg+": more" {
+		t.Errorf("wrap changed the message to %q", wrapped.errorMsg)
+	}
+
+	pak, packetErr := createErrorPacket(formatted)
+	if packetErr != nil {
+		t.Fatal(packetErr)
+	}
+	if want := []byte("\x00\x05\x00\x01file not found: \"f\" is 3 bytes\x00"); !bytes.Equal(pak.raw, want) {
+		t.Errorf("ERROR packet is %q, want %q", pak.raw, want)
+	}
+}
+
+func TestLongErrorMessageTruncated(t *testing.T) {
+	long := strings.Repeat("x", 2*maxErrorMessageSize)
+	pak, err := createErrorPacket(errNotDef.fmt("%v", long))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pak.raw) != 4+maxErrorMessageSize+1 || pak.raw[len(pak.raw)-1] != 0 {
+		t.Fatalf("ERROR packet is %v bytes ending in %#x, want %v bytes ending in a NUL",
+			len(pak.raw), pak.raw[len(pak.raw)-1], 4+maxErrorMessageSize+1)
+	}
+	parsed, err := parseErrorPacket(Packet{data: pak.raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (errNotDef.errorMsg + ": " + long)[:maxErrorMessageSize]; parsed.errorMsg != want {
+		t.Errorf("message parsed back is %v bytes, want the first %v bytes of the original", len(parsed.errorMsg), maxErrorMessageSize)
+	}
+}
+
+func TestParseErrorOffset(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"mode not terminated", "\x00\x01file\x00oct", "at byte offset 7 of 10: 00 01 66 69 6c 65 00 [6f] 63 74)"},
+		{"option value missing", "\x00\x01a-long-filename\x00octet\x00blksize\x001024",
+			"at byte offset 32 of 36: ... 62 6c 6b 73 69 7a 65 00 [31] 30 32 34)"},
+		{"too short", "\x00\x01f\x00", "at byte offset 4 of 4: 00 01 66 00)"},
+		{"empty", "", "(the packet is empty)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePacket(nil, []byte(tt.data))
+			if err == nil || !strings.HasSuffix(err.Error(), tt.want) {
+				t.Errorf("ParsePacket returned %v, want an error ending %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetOf(t *testing.T) {
+	packet := Packet{data: []byte("\x00\x01file\x00octet\x00")}
+	buffer := bytes.NewBuffer(packet.data)
+	for _, want := range []int{0, 2, 7} {
+		if got := packet.offsetOf(buffer); got != want {
+			t.Errorf("offsetOf = %v, want %v", got, want)
+		}
+		if want == 0 {
+			buffer.Next(sizeOfOpCode)
+		} else {
+			_, _ = buffer.ReadBytes(0x00)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all of a server's transfers, which spends bytes at a fixed rate.
+// Each packet reserves its bytes in the order it asks for them and then waits until they have been paid for,
+// so transfers are served in turn: as a transfer has a single DATA packet in flight at a time, one that
+// sends quickly cannot take a larger share than one that waits for slow ACKs.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// bytesPerSecond is the rate at which the bucket spends bytes.
+	bytesPerSecond int
+
+	// next is the time at which the bytes reserved so far have all been spent. It is never earlier than the
+	// time of the last reservation, so that an idle bucket does not save up bytes for a burst.
+	next time.Time
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// reserve reserves n bytes and returns how long the caller must wait before sending them.
+func (limiter *rateLimiter) reserve(n int) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(time.Duration(n) * time.Second / time.Duration(limiter.bytesPerSecond))
+	return wait
+}
+
+// wait blocks until n bytes can be sent, and reports true once they can. It gives up early, reporting false, if
+// ctx is done or aborted is closed in the meantime, so that a transfer being stopped is not kept waiting. A nil
+// rateLimiter never blocks.
+func (limiter *rateLimiter) wait(ctx context.Context, aborted <-chan struct{}, n int) bool {
+	if limiter == nil {
+		return true
+	}
+	wait := limiter.reserve(n)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-aborted:
+		return false
+	}
+}
@@ -1,17 +1,40 @@
 package tftp
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sync"
+	"syscall"
 )
 
 type ResponseWriter interface {
+	// WriteResponse returns the packet to send in response to pak, or nil if there is nothing to send.
 	WriteResponse(pak Packet) (response []byte)
+
+	// Complete reports whether the transfer has finished successfully,
+	// after which no more packets are expected from the client.
+	Complete() bool
+
+	// BytesTransferred returns the number of bytes of the file read or written so far.
+	BytesTransferred() int64
+
+	// Close releases the file of a transfer, keeping everything written to it.
 	Close() error
+
+	// Abort releases the file of a failed transfer, discarding anything partially written to it.
+	Abort() error
 }
 
-func newPacketHandler(req *RequestPacket) (ResponseWriter, *tftpError) {
-	fileHandler := newBlockStreamer(req.filename, req.openFlag, req.encodingFlag)
+// newPacketHandler opens the file at path, which holds the file named by req, and returns the
+// ResponseWriter that transfers it.
+func newPacketHandler(path string, req *RequestPacket, opts transferOptions) (ResponseWriter, *tftpError) {
+	fileHandler := newBlockStreamer(path, req.openFlag, req.encodingFlag)
+	fileHandler.lineEnding = opts.lineEnding
+	if opts.fileSystem != nil {
+		fileHandler.fileSystem = opts.fileSystem
+	}
 	err := fileHandler.Open()
 	if err != nil {
 		return nil, ftpOpenFileError(err)
@@ -20,66 +43,257 @@ func newPacketHandler(req *RequestPacket) (ResponseWriter, *tftpError) {
 	var handler ResponseWriter
 	switch req.openFlag {
 	case read:
-		handler = newRrqResponseWriter(fileHandler)
+		size, err := fileHandler.size()
+		opts.answerOffset(size, err == nil && req.encodingFlag == octet)
+		opts.answerTransferSize(size-opts.offset, err == nil && req.encodingFlag == octet) // only the rest is sent
+		if opts.offset > 0 {
+			err = fileHandler.seek(opts.offset)
+			if err != nil {
+				_ = fileHandler.Close()
+				return nil, ftpOpenFileError(err)
+			}
+		}
+		if opts.readAhead > 0 {
+			handler = newRrqResponseWriter(newReadAheadHandler(fileHandler, opts.blockSize, opts.readAhead), opts)
+			break
+		}
+		handler = newRrqResponseWriter(fileHandler, opts)
 	case write:
-		handler = newWrqResponseWriter(fileHandler)
+		opts.answerOffset(0, false)
+		if req.encodingFlag != octet {
+			opts.transferSize = -1 // netascii conversion changes the size on disk, so the given size is not checked
+		}
+		handler = newWrqResponseWriter(fileHandler, opts)
 	default:
 		panic(req.openFlag)
 	}
 	return handler, nil
 }
 
+// ftpOpenFileError maps an error from opening a file to the TFTP error sent to the client.
+// The returned error wraps err, so callers can still match it with errors.Is and errors.As.
 func ftpOpenFileError(err error) *tftpError {
-	if os.IsExist(err) {
-		return &errFileExists
-	} else if os.IsNotExist(err) {
-		return &errNoFile
+	var fileError tftpError
+	if errors.Is(err, errNotRegularFile) {
+		fileError = errAccess.fmt("not a regular file").wrap(err)
+	} else if os.IsExist(err) {
+		fileError = errFileExists.wrap(err)
+	} else if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		fileError = errNoFile.wrap(err)
 	} else if os.IsPermission(err) {
-		return &errAccess
+		fileError = errAccess.wrap(err)
+	} else if errors.Is(err, syscall.ENAMETOOLONG) {
+		fileError = errAccess.fmt("filename too long").wrap(err)
 	} else {
 		msg := "error occurred while opening file - %v"
-		fileError := errNotDef.fmt(msg, err)
-		return &fileError
+		fileError = errNotDef.fmt(msg, err).wrap(err)
+	}
+	return &fileError
+}
+
+// packetErrorResponse returns the ERROR packet answering a packet that could not be handled because of err.
+// A tftpError is sent as it is, while any other error means the packet was malformed, which is an illegal
+// TFTP operation.
+func packetErrorResponse(err error) []byte {
+	var tftpErr tftpError
+	if errors.As(err, &tftpErr) {
+		return rawErrorPacket(tftpErr)
+	}
+	return rawErrorPacket(errOperation.fmt("malformed packet - %v", err))
+}
+
+// rawErrorPacket returns the raw ERROR packet for tftpErr, or the internal error packet if it cannot be created.
+func rawErrorPacket(tftpErr tftpError) []byte {
+	pak, err := createErrorPacket(tftpErr)
+	if err != nil {
+		return internalErrorPacket().raw
+	}
+	return pak.raw
+}
+
+// roundTripCounter counts the round trips of a transfer, each being one packet from the client and the
+// response to it, so that a client cannot keep a transfer open forever.
+type roundTripCounter struct {
+	count int
+	limit int // limit is the maximum number of round trips, or 0 for no limit
+}
+
+func newRoundTripCounter(limit int) roundTripCounter {
+	return roundTripCounter{limit: limit}
+}
+
+// next counts another round trip, returning an error if the transfer has exceeded its limit.
+func (counter *roundTripCounter) next() *tftpError {
+	counter.count++
+	if counter.limit > 0 && counter.count > counter.limit {
+		limitError := undefinedError(fmt.Sprintf("transfer exceeded the limit of %v round trips", counter.limit))
+		return &limitError
+	}
+	return nil
+}
+
+// duplicateCounter counts the consecutive duplicate packets of a transfer, so that a client stuck resending
+// the same packet cannot keep a transfer open forever.
+type duplicateCounter struct {
+	count int
+	limit int // limit is the maximum number of consecutive duplicates, or 0 for no limit
+}
+
+func newDuplicateCounter(limit int) duplicateCounter {
+	return duplicateCounter{limit: limit}
+}
+
+// next counts another packet, which resets the count unless it is a duplicate, returning an error if the
+// transfer has exceeded its limit.
+func (counter *duplicateCounter) next(duplicate bool) *tftpError {
+	if !duplicate {
+		counter.count = 0
+		return nil
 	}
+	counter.count++
+	if counter.limit > 0 && counter.count > counter.limit {
+		limitError := undefinedError(fmt.Sprintf("transfer exceeded the limit of %v consecutive duplicate packets", counter.limit))
+		return &limitError
+	}
+	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
+// rrqState is the stage a read transfer has reached.
+type rrqState int
+
+const (
+	rrqSending        rrqState = iota // blocks are read from the file and sent as they are acknowledged
+	rrqFinalBlockSent                 // the block that ends the file has been sent and awaits its ACK
+	rrqDone                           // the client acknowledged the end of the file, so nothing more is read
+)
+
 type RrqResponseWriter struct {
 	// handler interfaces with the file that the client is reading from or writing to.
 	fileHandler
+
+	// options are the values negotiated with the client for this transfer.
+	options transferOptions
+
+	// roundTrips limits how many packets the transfer may respond to.
+	roundTrips roundTripCounter
+
+	// duplicates limits how many duplicate ACKs in a row the transfer tolerates.
+	duplicates duplicateCounter
+
+	// lastBlockSent is the block number of the last DATA packet sent, which the next ACK must acknowledge
+	// for the transfer to advance. It is 0 before the first block has been sent.
+	lastBlockSent uint16
+
+	// requestAnswered is set once the RRQ that started the transfer has been answered. Any later
+	// RRQ on the connection is an illegal TFTP operation.
+	requestAnswered bool
+
+	// oackPending is set while an OACK sent to acknowledge the requested options awaits the client's
+	// ACK(0), after which the first block is sent. It is cleared by that ACK(0), so that a later
+	// ACK(0) acknowledges a data block numbered 0 after a rollover.
+	oackPending bool
+
+	// state is the stage the transfer has reached. An empty file and a file whose size is a multiple of the
+	// block size both end with an empty block, but only the ACK of that block moves the state to rrqDone,
+	// after which the file is never read again.
+	state rrqState
+
+	// finalBlockNumber is the block number of the final block, once it has been sent.
+	finalBlockNumber uint16
+
+	// bytesRead is the number of bytes read from the file so far.
+	bytesRead int64
+}
+
+// blockBuffers holds buffers large enough for the largest block the server accepts, so that a
+// download does not allocate a new buffer to read each block of its file into. A buffer is only
+// used while its block is copied into a DATA packet, and is never handed to another goroutine.
+var blockBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, maxAcceptedBlockSize)
+		return &buffer
+	},
 }
 
-func newRrqResponseWriter(fh fileHandler) *RrqResponseWriter {
+func newRrqResponseWriter(fh fileHandler, opts transferOptions) *RrqResponseWriter {
 	rrqResponseWriter := &RrqResponseWriter{
 		fileHandler: fh,
+		options:     opts,
+		roundTrips:  newRoundTripCounter(opts.maxRoundTrips),
+		duplicates:  newDuplicateCounter(opts.maxDuplicates),
 	}
 	return rrqResponseWriter
 }
 
 func (rrqResponseWriter *RrqResponseWriter) WriteResponse(pak Packet) (response []byte) {
-	data := make([]byte, 512)
-	n, err := rrqResponseWriter.fileHandler.Read(data) // TODO#01 I can't just call Read, it needs to be based on the correct block number
-	/* TODO I bet I can do a scheme where handler deals with block num
-	if RRQ
-		bn == 1 and call read
-	else if bn == last.bn+1
-		call read
-	else if bn == last.bn
-		resend last
-	else
-		send error because it's out of order
-	*/
+	if rrqResponseWriter.state == rrqDone {
+		return nil // the transfer is over, and a stray packet must not read past the end of the file
+	}
+	if limitError := rrqResponseWriter.roundTrips.next(); limitError != nil {
+		return rawErrorPacket(*limitError)
+	}
+
+	if op, _ := pak.readOpCode(); op == RRQ {
+		if oack, ok := rrqResponseWriter.options.oack(); ok && !rrqResponseWriter.requestAnswered {
+			rrqResponseWriter.requestAnswered = true
+			rrqResponseWriter.oackPending = true
+			return oack // the client acknowledges the OACK with ACK(0), which is answered with DATA(1)
+		}
+	}
+
+	if ackPacket, err := parseAckPacket(pak); err == nil {
+		if aheadErr := rrqResponseWriter.checkAckNotAhead(ackPacket.blockNumber); aheadErr != nil {
+			return rawErrorPacket(*aheadErr)
+		}
+		duplicate := ackPacket.blockNumber != rrqResponseWriter.lastBlockSent
+		if limitError := rrqResponseWriter.duplicates.next(duplicate); limitError != nil {
+			return rawErrorPacket(*limitError)
+		}
+		// An ACK(0) is only answered while an OACK awaits it, when no block has been sent and lastBlockSent is
+		// still 0. Without an OACK, DATA(1) answers the RRQ itself, so an ACK(0) from a client sending a
+		// keep-alive or acknowledging an OACK it imagined is ignored here like any other stale ACK, rather
+		// than mistaken for the ACK that asks for block 1.
+		if duplicate { // a duplicate or delayed ACK of a block before the last one sent
+			return nil // the block it acknowledges was answered already, and answering again would double the traffic (RFC 1123)
+		}
+	}
+
+	blockNumber, err := rrqResponseWriter.nextBlockNumber(pak)
+	if err != nil {
+		return packetErrorResponse(err)
+	}
+
+	if rrqResponseWriter.state == rrqFinalBlockSent {
+		if blockNumber == rrqResponseWriter.options.nextBlockNumber(rrqResponseWriter.finalBlockNumber) {
+			rrqResponseWriter.state = rrqDone // the client acknowledged the final block
+		}
+		return nil // there is nothing left to read, whatever the packet asks for
+	}
+
+	buffer := blockBuffers.Get().(*[]byte)
+	defer blockBuffers.Put(buffer) // the block is copied into the DATA packet before the buffer is reused
+	data := (*buffer)[:rrqResponseWriter.options.blockSize]
+	n, err := rrqResponseWriter.fileHandler.Read(data) // only an ACK of the last block sent gets this far, so each block is read once
 	data = data[:n]
 	if err != nil && err != io.EOF {
 		return internalErrorPacket().raw
 	}
+	if err == io.EOF && n == 0 && rrqResponseWriter.options.omitEmptyFinalBlock && rrqResponseWriter.bytesRead > 0 {
+		rrqResponseWriter.state = rrqDone // the client acknowledged the last full block, which ends the file
+		return nil
+	}
+	rrqResponseWriter.bytesRead += int64(n)
 
-	blockNumber, err := rrqResponseWriter.nextBlockNumber(pak)
-	if err != nil { // TODO the error I received is actually useful, it should be returned
-		return internalErrorPacket().raw
+	// Only a block shorter than the block size ends the file. A full block that reaches the end of the
+	// file is followed by an empty one, which is what tells the client that the file has ended.
+	if err == io.EOF && n < rrqResponseWriter.options.blockSize {
+		rrqResponseWriter.state = rrqFinalBlockSent
+		rrqResponseWriter.finalBlockNumber = blockNumber
 	}
 
+	rrqResponseWriter.lastBlockSent = blockNumber
 	dataPacket := createDataPacket(blockNumber, data)
 
 	raw, err := dataPacket.bytes()
@@ -89,10 +303,34 @@ func (rrqResponseWriter *RrqResponseWriter) WriteResponse(pak Packet) (response
 	return raw
 }
 
+// checkAckNotAhead returns an error if blockNumber acknowledges a block that has not been sent yet,
+// which no correctly behaving client can do. Block numbers are compared within a window of half the
+// block number space behind the last block sent, so that the comparison holds across a rollover.
+func (rrqResponseWriter *RrqResponseWriter) checkAckNotAhead(blockNumber uint16) *tftpError {
+	behind := rrqResponseWriter.lastBlockSent - blockNumber
+	if behind < 1<<15 {
+		return nil
+	}
+	aheadError := errOperation.fmt("ACK of block %v, which has not been sent, after block %v", blockNumber, rrqResponseWriter.lastBlockSent)
+	return &aheadError
+}
+
+func (rrqResponseWriter *RrqResponseWriter) Complete() bool {
+	return rrqResponseWriter.state == rrqDone
+}
+
+func (rrqResponseWriter *RrqResponseWriter) BytesTransferred() int64 {
+	return rrqResponseWriter.bytesRead
+}
+
 func (rrqResponseWriter *RrqResponseWriter) Close() error {
 	return rrqResponseWriter.fileHandler.Close()
 }
 
+func (rrqResponseWriter *RrqResponseWriter) Abort() error {
+	return rrqResponseWriter.fileHandler.Abort()
+}
+
 func (rrqResponseWriter *RrqResponseWriter) nextBlockNumber(pak Packet) (uint16, error) {
 	var blockNumber uint16
 	op, err := pak.readOpCode()
@@ -100,16 +338,21 @@ func (rrqResponseWriter *RrqResponseWriter) nextBlockNumber(pak Packet) (uint16,
 		return 0, err
 	}
 
-	switch op {
-	case RRQ:
+	switch {
+	case op == RRQ && !rrqResponseWriter.requestAnswered:
+		rrqResponseWriter.requestAnswered = true
 		blockNumber = 1
-	case ACK:
-		currentBlockNumber, err := pak.readBlockNumber()
-		blockNumber = currentBlockNumber + 1
+	case op == ACK:
+		ackPacket, err := parseAckPacket(pak)
 		if err != nil {
 			return 0, err
 		}
-	default:
+		if rrqResponseWriter.oackPending && ackPacket.blockNumber == 0 {
+			rrqResponseWriter.oackPending = false
+			return 1, nil // ACK(0) acknowledges the OACK rather than a block, so the first block follows
+		}
+		blockNumber = rrqResponseWriter.options.nextBlockNumber(ackPacket.blockNumber)
+	default: // after the request itself, only ACKs belong to a read transfer
 		unexpectedPacketTypeErr := errOperation.fmt("expected packet of type RRQ (Read Request) or ACK (Acknowledgement), found %v", op)
 		return 0, unexpectedPacketTypeErr
 	}
@@ -122,32 +365,84 @@ func (rrqResponseWriter *RrqResponseWriter) nextBlockNumber(pak Packet) (uint16,
 type WrqResponseWriter struct {
 	// handler interfaces with the file that the client is reading from or writing to.
 	fileHandler
+
+	// options are the values negotiated with the client for this transfer.
+	options transferOptions
+
+	// roundTrips limits how many packets the transfer may respond to.
+	roundTrips roundTripCounter
+
+	// duplicates limits how many duplicate DATA blocks in a row the transfer tolerates.
+	duplicates duplicateCounter
+
+	// written is set once a block has been written to the file.
+	written bool
+
+	// lastWritten is the block number of the last block written to the file, once written is set.
+	lastWritten uint16
+
+	// requestAnswered is set once the WRQ that started the transfer has been answered. Any later
+	// WRQ on the connection is an illegal TFTP operation.
+	requestAnswered bool
+
+	// complete is set once a block shorter than the block size, which ends the file, has been written.
+	complete bool
+
+	// bytesWritten is the number of bytes written to the file so far.
+	bytesWritten int64
 }
 
-func newWrqResponseWriter(fh fileHandler) *WrqResponseWriter {
+func newWrqResponseWriter(fh fileHandler, opts transferOptions) *WrqResponseWriter {
 	wrqResponseWriter := &WrqResponseWriter{
 		fileHandler: fh,
+		options:     opts,
+		roundTrips:  newRoundTripCounter(opts.maxRoundTrips),
+		duplicates:  newDuplicateCounter(opts.maxDuplicates),
 	}
 	return wrqResponseWriter
 }
 
 func (wrqResponseWriter *WrqResponseWriter) WriteResponse(pak Packet) (response []byte) {
+	if limitError := wrqResponseWriter.roundTrips.next(); limitError != nil {
+		return rawErrorPacket(*limitError)
+	}
+
 	blockNumber, err := wrqResponseWriter.nextBlockNumber(pak)
 	if err != nil {
-		return internalErrorPacket().raw
+		return packetErrorResponse(err)
 	}
 
-	if blockNumber != 0 {
+	if op, _ := pak.readOpCode(); op == WRQ {
+		if oack, ok := wrqResponseWriter.options.oack(); ok {
+			return oack // the OACK takes the place of ACK(0), and the client answers it with DATA(1)
+		}
+	} else { // a DATA packet, whose block number may be 0 after a rollover
 		// TODO: so right here, if the packet data is 0-511 bytes, I need to dally (keep sending final ACK in response to final DATA)
-		// TODO: In general, I just want to make sure I don't write the same data twice. So I need some block number error checking.
 		data, err := wrqResponseWriter.parsePacket(pak)
 		if err != nil {
-			return internalErrorPacket().raw
+			return packetErrorResponse(err)
+		}
+
+		duplicate := wrqResponseWriter.alreadyWritten(blockNumber)
+		if limitError := wrqResponseWriter.duplicates.next(duplicate); limitError != nil {
+			return rawErrorPacket(*limitError)
 		}
+		if !duplicate { // a duplicate block is only acknowledged again, as it has already been written
+			n, err := wrqResponseWriter.fileHandler.Write(data) // nextBlockNumber only lets the next block in order through
+			if err != nil || n != len(data) {                   // TODO do I really have to be measuring len here? It's probably included in the error
+				return internalErrorPacket().raw
+			}
+			wrqResponseWriter.bytesWritten += int64(n)
+			wrqResponseWriter.written = true
+			wrqResponseWriter.lastWritten = blockNumber
 
-		n, err := wrqResponseWriter.fileHandler.Write(data) // TODO I can't just call Write, it needs to be based on the correct block number
-		if err != nil || n != len(data) {                   // TODO do I really have to be measuring len here? It's probably included in the error
-			return internalErrorPacket().raw
+			final := len(data) < wrqResponseWriter.options.blockSize
+			if sizeError := wrqResponseWriter.checkTransferSize(final); sizeError != nil {
+				return rawErrorPacket(*sizeError)
+			}
+			if final {
+				wrqResponseWriter.complete = true
+			}
 		}
 	}
 
@@ -160,23 +455,46 @@ func (wrqResponseWriter *WrqResponseWriter) WriteResponse(pak Packet) (response
 	return raw
 }
 
+func (wrqResponseWriter *WrqResponseWriter) Complete() bool {
+	return wrqResponseWriter.complete
+}
+
+func (wrqResponseWriter *WrqResponseWriter) BytesTransferred() int64 {
+	return wrqResponseWriter.bytesWritten
+}
+
 func (wrqResponseWriter *WrqResponseWriter) Close() error {
 	return wrqResponseWriter.fileHandler.Close()
 }
 
+func (wrqResponseWriter *WrqResponseWriter) Abort() error {
+	return wrqResponseWriter.fileHandler.Abort()
+}
+
 func (wrqResponseWriter *WrqResponseWriter) nextBlockNumber(pak Packet) (uint16, error) {
 	var blockNumber uint16
 	op, err := pak.readOpCode()
+	if err != nil {
+		return 0, err
+	}
 
-	switch op {
-	case WRQ:
+	switch {
+	case op == WRQ && !wrqResponseWriter.requestAnswered:
+		wrqResponseWriter.requestAnswered = true
 		blockNumber = 0
-	case DATA:
+	case op == DATA:
 		blockNumber, err = pak.readBlockNumber()
 		if err != nil {
 			return 0, err
 		}
-	default:
+		// A client whose ACK(0) or OACK was lost may still send DATA(1). It shows that the client knows the
+		// request was accepted, so it is written like any other first block.
+		wrqResponseWriter.requestAnswered = true
+		if expected := wrqResponseWriter.expectedBlockNumber(); blockNumber != expected && !wrqResponseWriter.alreadyWritten(blockNumber) {
+			aheadErr := errOperation.fmt("DATA block %v is ahead of the expected block %v", blockNumber, expected)
+			return 0, aheadErr
+		}
+	default: // after the request itself, only DATA packets belong to a write transfer
 		unexpectedPacketTypeErr := errOperation.fmt("expected packet of type WRQ (Write Request) or DATA (Data), found %v", op)
 		return 0, unexpectedPacketTypeErr
 	}
@@ -191,3 +509,37 @@ func (wrqResponseWriter *WrqResponseWriter) parsePacket(pak Packet) ([]byte, err
 	}
 	return dataPacket.data, nil
 }
+
+// checkTransferSize returns an error if the client gave the size of the file with the tsize option and the
+// bytes written so far do not agree with it: more bytes than the size, or fewer once the final block, the
+// first one shorter than the block size, has been written. UDP delivers whole datagrams, so a short block
+// always ends the file, and a file that ends early means the client stopped sending before all of it.
+func (wrqResponseWriter *WrqResponseWriter) checkTransferSize(final bool) *tftpError {
+	size := wrqResponseWriter.options.transferSize
+	written := wrqResponseWriter.bytesWritten
+	if size < 0 || written == size || (written < size && !final) {
+		return nil
+	}
+	sizeError := errNotDef.fmt("received %v bytes of a file whose transfer size was given as %v", written, size)
+	return &sizeError
+}
+
+// expectedBlockNumber returns the block number of the next DATA block to be written, which is 1 until
+// a block has been written.
+func (wrqResponseWriter *WrqResponseWriter) expectedBlockNumber() uint16 {
+	if !wrqResponseWriter.written {
+		return 1
+	}
+	return wrqResponseWriter.options.nextBlockNumber(wrqResponseWriter.lastWritten)
+}
+
+// alreadyWritten reports whether the block numbered blockNumber has been written, as a retransmitted or
+// delayed block has. Block numbers are compared within a window of half the block number space behind
+// the expected block, so that the comparison holds across a rollover.
+func (wrqResponseWriter *WrqResponseWriter) alreadyWritten(blockNumber uint16) bool {
+	if !wrqResponseWriter.written {
+		return false
+	}
+	behind := wrqResponseWriter.expectedBlockNumber() - blockNumber
+	return behind >= 1 && behind < 1<<15
+}
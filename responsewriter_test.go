@@ -0,0 +1,318 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// ackOf returns an ACK packet acknowledging blockNumber.
+func ackOf(blockNumber uint16) Packet {
+	raw, _ := createAckPacket(blockNumber).bytes()
+	return Packet{data: raw}
+}
+
+// requestOf returns a request packet for a file named "f" in octet mode carrying options.
+func requestOf(flag openFlag, options map[string]string) Packet {
+	req := createRequestPacket(flag, "f", octet)
+	req.options = options
+	raw, _ := req.bytes()
+	return Packet{data: raw}
+}
+
+// newTestRrqResponseWriter returns a writer that reads data, negotiated with the options requested.
+func newTestRrqResponseWriter(data []byte, requested map[string]string) *RrqResponseWriter {
+	return newRrqResponseWriter(&streamHandler{reader: bytes.NewReader(data)}, negotiateOptions(requested))
+}
+
+// describe returns a short description of a response for test failures, such as "DATA(2) of 512 bytes".
+func describe(response []byte) string {
+	if response == nil {
+		return "no response"
+	}
+	packet := Packet{data: response}
+	if dataPacket, err := parseDataPacket(packet); err == nil {
+		return fmt.Sprintf("DATA(%v) of %v bytes", dataPacket.blockNumber, len(dataPacket.data))
+	}
+	if ackPacket, err := parseAckPacket(packet); err == nil {
+		return fmt.Sprintf("ACK(%v)", ackPacket.blockNumber)
+	}
+	if errorPacket, err := parseErrorPacket(packet); err == nil {
+		return fmt.Sprintf("ERROR(%v)", errorPacket.errorCode)
+	}
+	if _, err := parseOackPacket(packet); err == nil {
+		return "OACK"
+	}
+	return fmt.Sprintf("%v", response)
+}
+
+func TestCheckAckNotAhead(t *testing.T) {
+	tests := []struct {
+		name          string
+		lastBlockSent uint16
+		ack           uint16
+		wantErr       bool
+	}{
+		{"matching", 5, 5, false},
+		{"stale", 5, 4, false},
+		{"stale ACK(0)", 5, 0, false},
+		{"future", 5, 6, true},
+		{"far future", 5, 100, true},
+		{"matching before any block", 0, 0, false},
+		{"stale across rollover", 0, 65535, false},
+		{"stale across rollover to 1", 1, 65535, false},
+		{"future across rollover", 65535, 0, true},
+		{"oldest stale in window", 40000, 40000 - 1<<15 + 1, false},
+		{"future outside window", 40000, 40000 - 1<<15, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrqResponseWriter := &RrqResponseWriter{lastBlockSent: tt.lastBlockSent}
+			err := rrqResponseWriter.checkAckNotAhead(tt.ack)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAckNotAhead(%v) after block %v = %v, want error %v", tt.ack, tt.lastBlockSent, err, tt.wantErr)
+			}
+			if err != nil && err.errorCode != uint16(CodeIllegalOperation) {
+				t.Errorf("error code = %v, want %v", err.errorCode, CodeIllegalOperation)
+			}
+		})
+	}
+}
+
+func TestRrqResponseWriterAnswersOnlyTheLastBlockSent(t *testing.T) {
+	tests := []struct {
+		name string
+		ack  uint16
+		want string
+	}{
+		{"matching ACK", 2, "DATA(3) of 100 bytes"},
+		{"stale ACK", 1, "no response"},
+		{"stale ACK(0)", 0, "no response"},
+		{"future ACK", 3, "ERROR(4)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrqResponseWriter := newTestRrqResponseWriter(testData(2*512+100), nil)
+			rrqResponseWriter.WriteResponse(requestOf(read, nil)) // DATA(1)
+			if got := describe(rrqResponseWriter.WriteResponse(ackOf(1))); got != "DATA(2) of 512 bytes" {
+				t.Fatalf("ACK(1) answered with %v", got)
+			}
+
+			if got := describe(rrqResponseWriter.WriteResponse(ackOf(tt.ack))); got != tt.want {
+				t.Errorf("ACK(%v) after DATA(2) answered with %v, want %v", tt.ack, got, tt.want)
+			}
+		})
+	}
+}
+
+// rolloverBlocks is the number of blocks in the rollover tests, which is enough to pass block 65535 twice
+// with a rollover to 1, or once and a bit with a rollover to 0.
+const rolloverBlocks = 2*65535 + 3
+
+// nextBlock returns the block number that follows blockNumber with the rollover value given.
+func nextBlock(blockNumber, rollover uint16) uint16 {
+	if blockNumber == 65535 {
+		return rollover
+	}
+	return blockNumber + 1
+}
+
+func TestRrqResponseWriterRollover(t *testing.T) {
+	for _, rollover := range []uint16{0, 1} {
+		t.Run(fmt.Sprintf("rollover=%v", rollover), func(t *testing.T) {
+			const blockSize = minBlockSize
+			data := testData(rolloverBlocks*blockSize + 3)
+			requested := map[string]string{blksizeOption: "8", rolloverOption: fmt.Sprint(rollover)}
+			rrqResponseWriter := newTestRrqResponseWriter(data, requested)
+			if got := describe(rrqResponseWriter.WriteResponse(requestOf(read, requested))); got != "OACK" {
+				t.Fatalf("RRQ answered with %v, want OACK", got)
+			}
+
+			var received []byte
+			ack := ackOf(0)
+			want := uint16(1)
+			for i := 0; ; i++ {
+				response := rrqResponseWriter.WriteResponse(ack)
+				dataPacket, err := parseDataPacket(Packet{data: response})
+				if err != nil {
+					t.Fatalf("block %v: expected DATA, got %v", i+1, describe(response))
+				}
+				if dataPacket.blockNumber != want {
+					t.Fatalf("block %v: got DATA(%v), want DATA(%v)", i+1, dataPacket.blockNumber, want)
+				}
+				received = append(received, dataPacket.data...)
+				ack = ackOf(dataPacket.blockNumber)
+				if len(dataPacket.data) < blockSize {
+					break
+				}
+				want = nextBlock(want, rollover)
+			}
+			if response := rrqResponseWriter.WriteResponse(ack); response != nil || !rrqResponseWriter.Complete() {
+				t.Errorf("ACK of the final block answered with %v, complete %v", describe(response), rrqResponseWriter.Complete())
+			}
+			if !bytes.Equal(received, data) {
+				t.Errorf("received %v bytes that differ from the %v bytes of the file", len(received), len(data))
+			}
+		})
+	}
+}
+
+func TestWrqResponseWriterRollover(t *testing.T) {
+	for _, rollover := range []uint16{0, 1} {
+		t.Run(fmt.Sprintf("rollover=%v", rollover), func(t *testing.T) {
+			const blockSize = minBlockSize
+			data := testData(rolloverBlocks*blockSize + 3)
+			requested := map[string]string{blksizeOption: "8", rolloverOption: fmt.Sprint(rollover)}
+			var file bytes.Buffer
+			wrqResponseWriter := newWrqResponseWriter(&streamHandler{writer: &file}, negotiateOptions(requested))
+			if got := describe(wrqResponseWriter.WriteResponse(requestOf(write, requested))); got != "OACK" {
+				t.Fatalf("WRQ answered with %v, want OACK", got)
+			}
+
+			blockNumber := uint16(0)
+			for offset := 0; offset <= len(data); offset += blockSize {
+				blockNumber = nextBlock(blockNumber, rollover)
+				block := data[offset:]
+				if len(block) > blockSize {
+					block = block[:blockSize]
+				}
+				raw, _ := createDataPacket(blockNumber, block).bytes()
+				response := wrqResponseWriter.WriteResponse(Packet{data: raw})
+				if want := fmt.Sprintf("ACK(%v)", blockNumber); describe(response) != want {
+					t.Fatalf("DATA(%v) at offset %v answered with %v, want %v", blockNumber, offset, describe(response), want)
+				}
+			}
+			if !wrqResponseWriter.Complete() {
+				t.Error("upload not complete after its final block")
+			}
+			if !bytes.Equal(file.Bytes(), data) {
+				t.Errorf("wrote %v bytes that differ from the %v bytes sent", file.Len(), len(data))
+			}
+		})
+	}
+}
+
+func TestWrqResponseWriterDataBeforeAck0(t *testing.T) {
+	data := testData(defaultBlockSize + 3)
+	dataOf := func(blockNumber uint16, block []byte) Packet {
+		raw, _ := createDataPacket(blockNumber, block).bytes()
+		return Packet{data: raw}
+	}
+	tests := []struct {
+		name      string
+		requested map[string]string
+	}{
+		{"ACK(0) lost", nil},
+		{"OACK lost", map[string]string{tsizeOption: fmt.Sprint(len(data))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested := tt.requested
+			var file bytes.Buffer
+			wrqResponseWriter := newWrqResponseWriter(&streamHandler{writer: &file}, negotiateOptions(requested))
+			// The client sends DATA(1) though the answer to its WRQ was lost, so the writer never answers the
+			// WRQ itself.
+			steps := []struct {
+				pak  Packet
+				want string
+			}{
+				{dataOf(1, data[:defaultBlockSize]), "ACK(1)"},
+				{dataOf(1, data[:defaultBlockSize]), "ACK(1)"}, // a retransmission, which is not written again
+				{dataOf(2, data[defaultBlockSize:]), "ACK(2)"},
+				{requestOf(write, requested), "ERROR(4)"}, // the DATA(1) showed that the request was answered
+			}
+			for i, step := range steps {
+				if got := describe(wrqResponseWriter.WriteResponse(step.pak)); got != step.want {
+					t.Fatalf("step %v answered with %v, want %v", i, got, step.want)
+				}
+			}
+			if !wrqResponseWriter.Complete() || !bytes.Equal(file.Bytes(), data) {
+				t.Errorf("upload complete %v with %v bytes written, want the %v bytes sent", wrqResponseWriter.Complete(), file.Len(), len(data))
+			}
+		})
+	}
+
+	wrqResponseWriter := newWrqResponseWriter(&streamHandler{writer: &bytes.Buffer{}}, negotiateOptions(nil))
+	if got := describe(wrqResponseWriter.WriteResponse(dataOf(2, data[:defaultBlockSize]))); got != "ERROR(4)" {
+		t.Errorf("DATA(2) as the first packet answered with %v, want ERROR(4)", got)
+	}
+}
+
+// countingReader counts the calls made to Read.
+type countingReader struct {
+	reader io.Reader
+	reads  int
+}
+
+func (counter *countingReader) Read(b []byte) (int, error) {
+	counter.reads++
+	return counter.reader.Read(b)
+}
+
+func TestRrqResponseWriterEndOfFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		blocks []string // blocks are the responses to the RRQ and to the ACK of each block but the last
+	}{
+		{"empty file", 0, []string{"DATA(1) of 0 bytes"}},
+		{"exact multiple of the block size", 2 * 512, []string{"DATA(1) of 512 bytes", "DATA(2) of 512 bytes", "DATA(3) of 0 bytes"}},
+		{"short final block", 512 + 100, []string{"DATA(1) of 512 bytes", "DATA(2) of 100 bytes"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &countingReader{reader: bytes.NewReader(testData(tt.size))}
+			rrqResponseWriter := newRrqResponseWriter(&streamHandler{reader: file}, negotiateOptions(nil))
+			pak := requestOf(read, nil)
+			for i, want := range tt.blocks {
+				if got := describe(rrqResponseWriter.WriteResponse(pak)); got != want {
+					t.Fatalf("response %v is %v, want %v", i, got, want)
+				}
+				if rrqResponseWriter.Complete() {
+					t.Fatalf("transfer complete before the ACK of block %v", i+1)
+				}
+				pak = ackOf(uint16(i + 1))
+			}
+			if got := describe(rrqResponseWriter.WriteResponse(pak)); got != "no response" || !rrqResponseWriter.Complete() {
+				t.Fatalf("ACK of the final block answered with %v, complete %v", got, rrqResponseWriter.Complete())
+			}
+
+			reads := file.reads
+			for _, stray := range []Packet{pak, ackOf(uint16(len(tt.blocks) + 1)), requestOf(read, nil)} {
+				if got := describe(rrqResponseWriter.WriteResponse(stray)); got != "no response" {
+					t.Errorf("%v after the transfer ended answered with %v", describe(stray.data), got)
+				}
+			}
+			if file.reads != reads || rrqResponseWriter.BytesTransferred() != int64(tt.size) {
+				t.Errorf("file read %v more times after the transfer ended, %v bytes sent", file.reads-reads, rrqResponseWriter.BytesTransferred())
+			}
+		})
+	}
+}
+
+func TestRrqResponseWriterAck0(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested map[string]string
+		steps     []string // steps are the responses to the RRQ, ACK(0), ACK(0) again and ACK(1)
+	}{
+		{"without OACK", nil, []string{"DATA(1) of 512 bytes", "no response", "no response", "DATA(2) of 100 bytes"}},
+		{"with OACK", map[string]string{tsizeOption: "0"}, []string{"OACK", "DATA(1) of 512 bytes", "no response", "DATA(2) of 100 bytes"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrqResponseWriter := newTestRrqResponseWriter(testData(512+100), tt.requested)
+			names := []string{"RRQ", "ACK(0)", "repeated ACK(0)", "ACK(1)"}
+			for i, pak := range []Packet{requestOf(read, tt.requested), ackOf(0), ackOf(0), ackOf(1)} {
+				if got := describe(rrqResponseWriter.WriteResponse(pak)); got != tt.steps[i] {
+					t.Fatalf("%v answered with %v, want %v", names[i], got, tt.steps[i])
+				}
+			}
+		})
+	}
+}
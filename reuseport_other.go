@@ -0,0 +1,17 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(network, address string, rawConn syscall.RawConn) error {
+	return errors.New("tftp: SO_REUSEPORT is not supported on this platform")
+}
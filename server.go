@@ -7,10 +7,15 @@ package tftp
 
 import (
 	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -19,24 +24,348 @@ type Server struct {
 	// files from and write files to.
 	Root string
 
+	// FallbackRoots lists further directories that read requests are
+	// served from, such as defaults beneath site-specific overrides in
+	// Root. A file that does not exist in Root is looked for in each
+	// of them in order, and served from the first that has it. Write
+	// requests always write to Root.
+	FallbackRoots []string
+
+	// FileSystem is the file system that files are read from and
+	// written to, such as an in-memory file system in tests. If nil,
+	// the operating system's file system is used. Symbolic links are
+	// not checked on another file system, and CreateDirs,
+	// CaseInsensitiveFilenames and UploadModTime have no effect.
+	FileSystem FileSystem
+
 	// Addr is the address the server will listen on for new Read and Write
 	// requests. The default value is ":tftp".
 	Addr string
 
+	// ReusePort sets SO_REUSEADDR and SO_REUSEPORT on the socket that
+	// listens on Addr, so that another server with the option set can
+	// bind the same address while this one is running, such as a new
+	// instance taking over requests while the old one finishes its
+	// transfers, or several processes sharing the load. Serve returns
+	// an error if the platform is not Linux or a BSD.
+	ReusePort bool
+
+	// ReadBufferSize and WriteBufferSize set the sizes in bytes of the
+	// operating system's receive and send buffers for the socket that
+	// listens on Addr and the socket of each connection, so that a
+	// busy server does not drop datagrams that arrive in a burst. If
+	// zero, the system's default is used. The system may cap a size
+	// at its own limit, such as net.core.rmem_max on Linux.
+	ReadBufferSize  int
+	WriteBufferSize int
+
 	// ErrorLog specifies an optional logger for errors setting
 	// connections, unexpected behavior from handlers, and
 	// underlying FileSystem errors.
 	// If nil, logging is done via the log package's standard logger.
 	ErrorLog *log.Logger // Go 1.3
 
+	// DisableNetascii causes requests with the netascii mode to be
+	// rejected with an illegal TFTP operation error before the file
+	// is opened, so that only octet transfers are served.
+	DisableNetascii bool
+
+	// NetasciiLineEnding is the line separator of text files on disk,
+	// which netascii transfers convert to and from the CR LF that is
+	// sent over the network. The default, HostLineEnding, is CR LF on
+	// Windows and LF elsewhere, but a server serving files prepared on
+	// another system can choose that system's line separator instead.
+	NetasciiLineEnding LineEnding
+
+	// LenientModes causes requests with an unrecognized mode, such as
+	// the non-standard mode strings sent by some embedded clients, to
+	// be served as octet transfers. By default they are rejected, as
+	// RFC 1350 only defines the netascii and octet modes.
+	LenientModes bool
+
+	// PowerOfTwoBlockSize causes a requested blksize to be rounded down
+	// to the nearest power of two, such as 1024 for a request of 1500,
+	// for boot ROMs that misbehave with any other block size. The
+	// rounded value is the one acknowledged in the OACK. By default the
+	// requested block size is accepted as it is, up to the largest the
+	// server supports.
+	PowerOfTwoBlockSize bool
+
+	// MinBlockSize is the smallest blksize the server agrees to, so
+	// that a client cannot multiply the number of packets of a
+	// transfer by asking for tiny blocks. A smaller blksize is declined
+	// and left out of the OACK, as RFC 2348 does not let the server
+	// answer with a larger size than requested, so the transfer uses
+	// blocks of 512 bytes. Values above 512 act as 512. If zero, any
+	// blksize down to the 8 bytes allowed by RFC 2348 is accepted.
+	MinBlockSize int
+
+	// NetasciiFilenames requires requested filenames to be netascii
+	// as RFC 1350 specifies, rejecting any filename that contains a
+	// byte outside of printable 7-bit ASCII. By default filenames are
+	// accepted as raw 8-bit strings, such as the UTF-8 names sent by
+	// modern clients.
+	NetasciiFilenames bool
+
+	// MaxRoundTrips is the maximum number of DATA/ACK round trips
+	// a single transfer may perform before it is aborted with an
+	// error, which stops a client from holding a transfer open
+	// forever by sending tiny blocks. If zero, there is no limit.
+	MaxRoundTrips int
+
+	// ReadAhead is the number of blocks a read transfer reads from its
+	// file ahead of the client, so that reading the disk overlaps with
+	// waiting for the client's acknowledgements, which speeds up
+	// transfers over links with a long round trip time. If zero, each
+	// block is read only once the previous block has been acknowledged.
+	ReadAhead int
+
+	// OmitEmptyFinalBlock, if not nil, reports whether the client at
+	// the given address is one of the few legacy clients that hang on
+	// the empty DATA block ending a file whose size is an exact
+	// multiple of the block size. The transfers of such clients end
+	// once the last full block is acknowledged, without the empty
+	// block. If nil, every transfer ends as defined in RFC 1350.
+	OmitEmptyFinalBlock func(remoteAddr net.Addr) bool
+
+	// FollowSymlinks allows requested filenames to resolve through
+	// symbolic links to files outside of Root. By default such
+	// requests are rejected with an access violation, while links
+	// that stay within Root are followed.
+	FollowSymlinks bool
+
+	// CreateDirs makes write requests for a file in a subdirectory of
+	// Root that does not exist yet, such as "pxelinux.cfg/01-aa-bb",
+	// create the missing directories rather than fail with a file not
+	// found error. The directories are kept if the transfer fails.
+	// Read requests may always name files in subdirectories.
+	CreateDirs bool
+
+	// DrainTimeout is the maximum amount of time a graceful shutdown
+	// waits for active connections to finish before forcing them to
+	// close. If zero, a graceful shutdown waits for as long as the
+	// connections take.
+	DrainTimeout time.Duration
+
+	// UploadModTime specifies an optional function that chooses the
+	// modification time of each file written by a WRQ transfer, such
+	// as a build timestamp known to deployment tooling. It is called
+	// with the name of the file once the transfer has completed, and
+	// the file keeps the time it was written at if it returns the
+	// zero time.
+	UploadModTime func(filename string) time.Time
+
+	// RetransmitTimeout is how long a connection waits for the client
+	// to answer a response before retransmitting it. If zero, a
+	// timeout of 1 second is used.
+	RetransmitTimeout time.Duration
+
+	// RetransmitBackoff specifies an optional function that chooses
+	// how long a connection waits for the client to answer a response
+	// that has already been retransmitted attempt times, such as one
+	// returned by ExponentialBackoff, which eases congestion on lossy
+	// links. If nil, or if it returns a duration that is not positive,
+	// every wait lasts RetransmitTimeout, as RFC 1350 expects.
+	RetransmitBackoff BackoffFunc
+
+	// MaxRetransmissions is the number of times a connection
+	// retransmits a response that the client does not answer before
+	// it gives up and aborts the transfer, which closes its socket and
+	// file and ends the connection, so that requests from clients that
+	// never answer hold no resources beyond the retransmission waits.
+	// If zero, a response is retransmitted up to 5 times, and if
+	// negative, it is never retransmitted.
+	MaxRetransmissions int
+
+	// MaxTransfersPerIP is the number of transfers that clients at a
+	// single IP address may have in progress at once, so that one
+	// misbehaving client cannot open thousands of transfers. Further
+	// requests from the address are answered with an error, and
+	// counted as rejected in the metrics of ExpvarName, until one of
+	// its transfers finishes. If zero, there is no limit.
+	MaxTransfersPerIP int
+
+	// GlobalRateLimit is the number of bytes per second that the DATA
+	// packets of all transfers may add up to, so that the server does
+	// not saturate a shared uplink however many clients it serves.
+	// Transfers take turns at the bandwidth, so a client that ACKs
+	// quickly does not starve the others. Retransmissions count
+	// towards the limit. If zero, the rate is not limited.
+	GlobalRateLimit int
+
+	// MaxDuplicates is the number of consecutive duplicate packets,
+	// ACKs of a block already acknowledged or DATA blocks already
+	// written, that a connection tolerates before it aborts the
+	// transfer, so that a client stuck resending the same packet
+	// cannot hold a transfer open forever. Any new block resets the
+	// count. If zero, up to 10 are tolerated, and if negative, there
+	// is no limit.
+	MaxDuplicates int
+
+	// OnRetransmit specifies an optional function that is called each
+	// time a connection retransmits a response, with the client's
+	// address, the block number of the response, and how many times
+	// the response has now been retransmitted. Frequent calls point
+	// to a lossy link. It is called from the goroutine handling the
+	// transfer, so it must be safe for concurrent use.
+	OnRetransmit func(remote net.Addr, block uint16, attempt int)
+
+	// OnTransferComplete specifies an optional function that is
+	// called when each transfer finishes, successfully or not, with
+	// a description of the transfer. It is called from the goroutine
+	// handling the transfer, so it must be safe for concurrent use.
+	OnTransferComplete func(TransferInfo)
+
+	// OnRequest specifies an optional function that is called with
+	// each packet received on Addr before a connection is started
+	// to handle it. If it returns false, the packet is dropped
+	// silently: no connection is started and no reply is sent. It
+	// is a cheap gate for blocking or rate-limiting noisy sources,
+	// and is called from the goroutine running Serve, so it should
+	// return quickly.
+	OnRequest func(Packet) bool
+
+	// HealthFilename, if not empty, is a reserved filename that a read
+	// request can ask for to check that the server is alive, such as
+	// "_healthz". It is answered from memory with a single block holding
+	// "OK\n", without touching Root, so it is a cheap liveness probe for
+	// load balancers and orchestration systems.
+	HealthFilename string
+
+	// FilenameRewrite specifies an optional function that maps each
+	// requested filename to the name of the file that is actually
+	// transferred, such as to strip a prefix, change the case, or
+	// redirect a magic name to a generated file. It is applied after
+	// the requested name has been validated, and its result is
+	// validated again before the file is opened.
+	FilenameRewrite func(filename string) string
+
+	// AllowMode specifies an optional function that reports whether
+	// the file named filename may be transferred in mode, which is
+	// "netascii" or "octet", such as to serve binaries in octet mode
+	// only, as netascii conversion would corrupt them. A request it
+	// refuses is rejected with an illegal TFTP operation error before
+	// the file is opened. It is called with the name produced by
+	// FilenameRewrite, and is not called if DisableNetascii has
+	// already rejected the request.
+	AllowMode func(filename, mode string) bool
+
+	// CaseInsensitiveFilenames makes a read request for a file that
+	// does not exist fall back to a file whose name differs only in
+	// case, such as "pxelinux.0" for a PXE client asking for
+	// "PXELINUX.0". A name that matches several files in this way is
+	// ambiguous, and is reported as not found. Write requests always
+	// use the exact name.
+	CaseInsensitiveFilenames bool
+
+	// DefaultFile, if not empty, names a file beneath Root that is
+	// served in place of any file that a read request asks for but
+	// that does not exist, such as a default configuration for PXE
+	// clients that first ask for one specific to their address. It is
+	// looked for in the FallbackRoots like any other file. If it does
+	// not exist either, the request is reported as not found. Write
+	// requests are not affected.
+	DefaultFile string
+
+	// ChecksumSuffix, if not empty, makes a read request for a name
+	// ending in the suffix, such as "firmware.bin.md5" for ".md5",
+	// answered with a checksum of the file that the rest of the name
+	// refers to, so that a client can verify its download. The
+	// checksum is computed when it is requested, and is sent as a
+	// line in the format of md5sum: the digest in hexadecimal, two
+	// spaces and the file's name. Requests for names without the
+	// suffix are not affected.
+	ChecksumSuffix string
+
+	// ChecksumHash returns the hash that computes the checksums of
+	// ChecksumSuffix, such as sha256.New. If nil, MD5 is used.
+	ChecksumHash func() hash.Hash
+
+	// MinTIDPort and MaxTIDPort restrict the UDP ports of the sockets
+	// that connections reply from, their transfer IDs (TIDs), to the
+	// range from MinTIDPort to MaxTIDPort inclusive, so that they can
+	// be allowed through a firewall. If both are zero, the operating
+	// system chooses any ephemeral port. A request that arrives while
+	// every port in the range is in use is rejected with an error.
+	MinTIDPort int
+	MaxTIDPort int
+
+	// RequestReaders is the number of goroutines that read requests
+	// from Addr at the same time, so that a burst of clients, such as
+	// a rack of machines PXE booting together, is taken off the socket
+	// before the operating system's receive buffer overflows and drops
+	// datagrams. If zero, a single goroutine reads requests.
+	RequestReaders int
+
+	// MaxWorkers is the number of goroutines that handle connections,
+	// which bounds the number of transfers in progress at once. A
+	// request that arrives while every worker is busy waits for one
+	// in a queue of up to MaxQueuedRequests requests, and is rejected
+	// with a "server is busy" error if the queue is full. If zero, a
+	// goroutine is started for each request, without any limit.
+	MaxWorkers int
+
+	// MaxQueuedRequests is the number of requests that wait for a
+	// worker when MaxWorkers is set. If zero, a request that arrives
+	// while every worker is busy is rejected at once.
+	MaxQueuedRequests int
+
+	// ExpvarName, if not empty, causes the server to publish its
+	// counters with the expvar package, as a map of that name holding
+	// the number of requests, requests rejected before a transfer
+	// started, active connections, bytes read from and written to
+	// files, and failed transfers and rejections by TFTP error code.
+	// They can then be scraped from any HTTP server that serves
+	// expvar's handler. Servers given the same name share the same
+	// counters.
+	ExpvarName string
+
+	// metrics holds the counters published when ExpvarName is set, or is nil.
+	metrics *serverMetrics
+
+	// rateLimiter is the bucket that DATA packets draw from when GlobalRateLimit is set, or is nil.
+	rateLimiter *rateLimiter
+
 	// requestReader listens on Addr for new Read and Write requests.
 	requestReader *Conn
 
+	// localAddr is the address requestReader is bound to, once Serve has set it up.
+	localAddr net.Addr
+
+	// ready is closed once Serve is accepting requests. It is created by the first call to Ready or Serve.
+	ready chan struct{}
+
 	// numActiveConnections is used to wait for connections to finish
 	// during graceful shutdown. It is incremented upon receiving a
 	// new request packet, and decremented after a client connection
 	// closes.
 	numActiveConns int
+
+	// mu guards serving, localAddr, ready, transfersPerIP, writeTargets, trackedRequests, shutdownRequests
+	// and serveDone.
+	mu sync.Mutex
+
+	// serving is set while Serve is running, from before it binds Addr until it has stopped.
+	serving bool
+
+	// shutdownRequests receives the requests of Close and Shutdown while Serve is running.
+	shutdownRequests chan<- shutdownRequest
+
+	// serveDone is closed when Serve stops running.
+	serveDone chan struct{}
+
+	// trackedRequests holds the requests being handled by active connections, keyed by requestKey,
+	// so that a retransmitted request is forwarded to its connection rather than starting another.
+	trackedRequests map[string]*trackedRequest
+
+	// transfersPerIP holds the number of transfers in progress for each client IP address that has
+	// any, when MaxTransfersPerIP is set.
+	transfersPerIP map[string]int
+
+	// writeTargets holds the names of the files that are being written
+	// by WRQ transfers, so that a concurrent upload to the same name
+	// can be rejected rather than interleaving its writes.
+	writeTargets map[string]struct{}
 }
 
 func NewServer(root, addr string, errorLog *log.Logger) *Server {
@@ -50,14 +379,20 @@ func NewServer(root, addr string, errorLog *log.Logger) *Server {
 }
 
 // setup prepares a new server value for use by:
-// - changing its Root directory
+// - checking its Root directory
 // - setting up a connection to listen for requests on its address
 // - writing an initial log statement.
 func (srv *Server) setup() error { // setup() is an instance of Sequential coupling...
-	err := srv.changeDir()
+	err := srv.checkRoot()
+	if err != nil {
+		return err
+	}
+
+	err = srv.setupMetrics()
 	if err != nil {
 		return err
 	}
+	srv.setupRateLimiter()
 
 	err = srv.setupRequestReader()
 	if err != nil {
@@ -68,50 +403,180 @@ func (srv *Server) setup() error { // setup() is an instance of Sequential coupl
 	return nil
 }
 
-func (srv *Server) changeDir() error {
-	return os.Chdir(srv.Root)
+// checkRoot returns an error if Root or any of the FallbackRoots is not a directory. Files are opened
+// by joining their names to Root rather than by changing the working directory, which is shared by the
+// whole process, so that servers with different roots can run side by side.
+func (srv *Server) checkRoot() error {
+	for _, root := range append([]string{srv.Root}, srv.FallbackRoots...) {
+		info, err := srv.fileSystem().Stat(root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &os.PathError{Op: "serve", Path: root, Err: errors.New("root is not a directory")}
+		}
+	}
+	return nil
+}
+
+// setupRateLimiter creates the bucket that transfers draw from, so that GlobalRateLimit counts the packets
+// of this run of Serve only.
+func (srv *Server) setupRateLimiter() {
+	srv.rateLimiter = nil
+	if srv.GlobalRateLimit > 0 {
+		srv.rateLimiter = newRateLimiter(srv.GlobalRateLimit)
+	}
+}
+
+func (srv *Server) setupMetrics() error {
+	if srv.ExpvarName == "" {
+		return nil
+	}
+	metrics, err := newServerMetrics(srv.ExpvarName)
+	if err != nil {
+		return err
+	}
+	srv.metrics = metrics
+	return nil
 }
 
 func (srv *Server) setupRequestReader() error {
-	conn, err := NewConn(srv.Addr)
+	newConn := NewConn
+	if srv.ReusePort {
+		newConn = NewReusePortConn
+	}
+	conn, err := newConn(srv.Addr)
+	if err != nil {
+		return err
+	}
+	err = srv.setBufferSizes(conn)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	srv.requestReader = conn
+	srv.mu.Lock()
+	srv.localAddr = conn.localAddr
+	srv.mu.Unlock()
 	return nil
 }
 
+// setBufferSizes applies ReadBufferSize and WriteBufferSize to conn.
+func (srv *Server) setBufferSizes(conn *Conn) error {
+	if srv.ReadBufferSize == 0 && srv.WriteBufferSize == 0 {
+		return nil
+	}
+	return conn.SetBufferSizes(srv.ReadBufferSize, srv.WriteBufferSize)
+}
+
+// Ready returns a channel that is closed once Serve has bound its address and is accepting
+// requests, so that a client started after it is closed never races the server. If Serve fails
+// to start, the channel is never closed, and the error is sent on the channel Serve returned.
+func (srv *Server) Ready() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.readyChan()
+}
+
+// markReady closes the channel returned by Ready.
+func (srv *Server) markReady() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	ready := srv.readyChan()
+	select {
+	case <-ready: // already closed by an earlier call to Serve
+	default:
+		close(ready)
+	}
+}
+
+// readyChan returns srv.ready, creating it if need be. srv.mu must be held.
+func (srv *Server) readyChan() chan struct{} {
+	if srv.ready == nil {
+		srv.ready = make(chan struct{})
+	}
+	return srv.ready
+}
+
+// LocalAddr returns the address the server listens on for requests, or nil if Serve has not yet
+// bound it. Unlike Addr, it holds the actual port, so a server listening on ":0" can tell its
+// clients which port the operating system assigned.
+func (srv *Server) LocalAddr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.localAddr
+}
+
 func (srv *Server) initializeLogger() {
 	srv.logf("tftp: starting server...\n\tRoot:\t%v\n\tRoot:\t%v", srv.Root, srv.Addr)
 }
 
+// Serve listens on Addr and serves requests until it is stopped through cancelChan, Close or Shutdown,
+// then sends the error it stopped with on the returned channel. Once it has stopped, Serve may be called
+// again to serve from a freshly bound socket, such as after a supervised restart. Calling Serve while the
+// server is already serving fails with ErrServerRunning.
 func (srv *Server) Serve(cancelChan <-chan CancelType) <-chan error {
 	// create a channel to send errors back to caller (so that this routine can be cancelled)
-	done := make(chan error)
+	done := make(chan error, 1) // buffered so that Serve can return to a caller who stopped it with Close or Shutdown
 	go func() {
+		if !srv.claimServing() {
+			done <- ErrServerRunning
+			return
+		}
+		defer srv.releaseServing()
 		err := srv.setup()
 		if err != nil {
 			done <- err
 			return
 		}
+		shutdownRequests, stopServing := srv.startServing()
+		defer stopServing()
+		srv.markReady()
 		ctxSrv := context.WithValue(context.Background(), LoggerContextKey, srv.ErrorLog)
-		ctxSrv, cancelServer := context.WithCancel(ctxSrv)
-		requests := srv.requestReader.ReadContinuously(ctxSrv)
-		connDone := make(chan error)
+		ctxSrv = context.WithValue(ctxSrv, ServerContextKey, srv)
+		ctxListen, cancelListen := context.WithCancel(ctxSrv) // cancelled to stop accepting new requests
+		stopListening := func() {
+			cancelListen()
+			_ = srv.requestReader.Close() // closed before Serve reports it has stopped, so Addr can be reused at once
+		}
+		ctxConns, closeConns := context.WithCancel(ctxSrv) // cancelled to force active connections to close
+		requests := srv.requestReader.ReadConcurrently(ctxListen, srv.RequestReaders)
+		connDone := make(chan TransferInfo)
+		queue := srv.startWorkers(connDone)
+		if queue != nil {
+			defer close(queue) // the workers stop once the connections they were handling have finished
+		}
 		for {
 			select {
 			case request := <-requests:
 				srv.logf("tftp: new request received:\n\tfrom: %v\n\tdata: %v\n", request.from, request.data)
-				srv.numActiveConns++
-				go HandleRequest(ctxSrv, request, connDone)
-			case err := <-connDone:
-				if err != nil {
-					srv.logf("tftp: connection finished with error - %v\n", err)
+				if srv.OnRequest != nil && !srv.OnRequest(request) {
+					continue
 				}
-				srv.numActiveConns--
+				tracked, ok := srv.trackRequest(request)
+				if !ok {
+					continue // the request was retransmitted, and has been forwarded to its connection
+				}
+				ctxConn := context.WithValue(ctxConns, trackedRequestContextKey, tracked)
+				if queue == nil {
+					go handleRequest(ctxConn, request, connDone)
+				} else if !srv.enqueue(queue, queuedRequest{ctx: ctxConn, request: request}) {
+					srv.untrackRequest(tracked)
+					continue
+				}
+				srv.numActiveConns++
+				srv.metrics.connStarted()
+			case info := <-connDone:
+				srv.connFinished(info)
 			case cancelType := <-cancelChan:
-				cancelServer()
-				done <- srv.cancel(cancelType)
+				stopListening()
+				done <- srv.cancel(cancelType, connDone, closeConns)
+				return
+			case req := <-shutdownRequests:
+				stopListening()
+				err := srv.shutdown(req.ctx, connDone, closeConns)
+				req.result <- err
+				done <- err
 				return
 			}
 		}
@@ -141,29 +606,440 @@ func Cancellation(closeType CloseType, duration time.Duration) CancelType {
 	}
 }
 
-func (srv *Server) cancel(cancel CancelType) error {
+// ShutdownResult is sent on the channel returned by Serve once the server has been cancelled.
+// It summarizes how the connections that were active at the time finished, so that operators
+// can log the quality of a shutdown. It wraps ErrServerClosed, so a server that stopped as
+// requested can be recognized with errors.Is(err, ErrServerClosed).
+type ShutdownResult struct {
+	// Drained is the number of connections that finished on their own while the server drained.
+	Drained int
+
+	// ForceClosed is the number of connections that were closed by the server, because
+	// the drain timeout expired or the server was shut down immediately.
+	ForceClosed int
+
+	err error
+}
+
+func (result *ShutdownResult) Error() string {
+	return fmt.Sprintf("%v: %v connections drained, %v connections force-closed", result.err, result.Drained, result.ForceClosed)
+}
+
+func (result *ShutdownResult) Unwrap() error {
+	return result.err
+}
+
+// cancel stops the server after it has stopped listening for new requests. Active connections
+// report on connDone when they finish, and closeConns forces them to close.
+func (srv *Server) cancel(cancel CancelType, connDone <-chan TransferInfo, closeConns context.CancelFunc) error {
 	switch cancel.CloseType {
 	case ShutdownGracefully:
-		return srv.shutdown()
+		ctx := context.Background()
+		if srv.DrainTimeout > 0 {
+			var cancelDrain context.CancelFunc
+			ctx, cancelDrain = context.WithTimeout(ctx, srv.DrainTimeout)
+			defer cancelDrain()
+		}
+		return srv.shutdown(ctx, connDone, closeConns)
 	case ShutdownWithTimeout:
-		return srv.shutdown(cancel.Duration)
+		ctx, cancelDrain := context.WithTimeout(context.Background(), cancel.Duration)
+		defer cancelDrain()
+		return srv.shutdown(ctx, connDone, closeConns)
 	case ShutdownImmediately:
-		return srv.close()
+		return srv.close(connDone, closeConns)
 	default:
+		_ = srv.close(connDone, closeConns)
 		return fmt.Errorf("tftp: Server shutdown with unexpected CancelType: %T\t%v\n", cancel, cancel)
 	}
 }
 
-func (srv *Server) shutdown(timeout ...time.Duration) error {
-	/* TODO Implement */
+// shutdown waits for active connections to finish until ctx is done,
+// and then forces any connections that remain to close.
+func (srv *Server) shutdown(ctx context.Context, connDone <-chan TransferInfo, closeConns context.CancelFunc) error {
+	if ctx.Err() != nil {
+		return srv.close(connDone, closeConns)
+	}
+
+	result := &ShutdownResult{err: ErrServerClosed}
+	for srv.numActiveConns > 0 {
+		select {
+		case info := <-connDone:
+			srv.connFinished(info)
+			result.Drained++
+		case <-ctx.Done():
+			result.ForceClosed = srv.forceClose(connDone, closeConns)
+		}
+	}
+	closeConns()
+	return result
+}
+
+// shutdownRequest asks the goroutine running Serve to shut down, as Close and Shutdown do.
+type shutdownRequest struct {
+	ctx    context.Context // once ctx is done, the remaining connections are forced to close
+	result chan error      // result receives the ShutdownResult
+}
+
+// claimServing marks the server as serving, reporting false if it already is.
+func (srv *Server) claimServing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.serving {
+		return false
+	}
+	srv.serving = true
+	return true
+}
+
+// releaseServing marks the server as no longer serving, and resets the state of the run that ended, so that
+// Serve can be called again: LocalAddr reports nil, and Ready returns a new channel until the next run binds
+// its socket.
+func (srv *Server) releaseServing() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.serving = false
+	srv.localAddr = nil
+	if srv.ready != nil {
+		select {
+		case <-srv.ready:
+			srv.ready = nil // closed by the run that ended
+		default: // still awaited by callers of Ready, to be closed by the next run
+		}
+	}
+	srv.numActiveConns = 0
+}
+
+// startServing makes the server reachable by Close and Shutdown while Serve is running. It returns the
+// channel on which their requests arrive and a function to call once Serve has stopped.
+func (srv *Server) startServing() (<-chan shutdownRequest, func()) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	shutdownRequests := make(chan shutdownRequest)
+	serveDone := make(chan struct{})
+	srv.shutdownRequests = shutdownRequests
+	srv.serveDone = serveDone
+	stopServing := func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		close(serveDone)
+		srv.shutdownRequests = nil
+		srv.serveDone = nil
+	}
+	return shutdownRequests, stopServing
+}
+
+// Close immediately stops the server from accepting requests and closes all active
+// connections, sending their clients an error. It has the same effect as sending a
+// Cancellation(ShutdownImmediately, 0) to Serve. Closing a server that is not serving
+// does nothing.
+func (srv *Server) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := srv.requestShutdown(ctx)
+	return err
+}
+
+// AbortTransfer aborts the transfers of the client at remoteAddr, without affecting any other transfer:
+// the client is sent an ERROR packet, and the connections handling its transfers are closed. It returns
+// an error if no transfer from remoteAddr is in progress.
+func (srv *Server) AbortTransfer(remoteAddr net.Addr) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	found := false
+	for _, tracked := range srv.trackedRequests {
+		if tracked.remoteAddr.String() == remoteAddr.String() {
+			tracked.abortOnce.Do(func() { close(tracked.aborted) })
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("tftp: no transfer from %v is in progress", remoteAddr)
+	}
 	return nil
 }
 
-func (srv *Server) close() error {
-	/* TODO Implement */
+// Shutdown gracefully stops the server: it stops accepting requests, then waits for the
+// active connections to finish. If ctx is done before they finish, the remaining
+// connections are closed and Shutdown returns ctx's error. Shutting down a server that is
+// not serving does nothing.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	result, err := srv.requestShutdown(ctx)
+	if err != nil {
+		return err
+	}
+	if result != nil && result.ForceClosed > 0 {
+		return ctx.Err()
+	}
 	return nil
 }
 
+// requestShutdown asks the running Serve goroutine to shut down, and waits for it to report how its connections finished.
+func (srv *Server) requestShutdown(ctx context.Context) (*ShutdownResult, error) {
+	srv.mu.Lock()
+	shutdownRequests, serveDone := srv.shutdownRequests, srv.serveDone
+	srv.mu.Unlock()
+	if shutdownRequests == nil {
+		return nil, nil
+	}
+
+	req := shutdownRequest{ctx: ctx, result: make(chan error, 1)}
+	select {
+	case shutdownRequests <- req:
+	case <-serveDone: // Serve was cancelled through its channel in the meantime
+		return nil, nil
+	}
+
+	err := <-req.result
+	result, ok := err.(*ShutdownResult)
+	if !ok {
+		return nil, err
+	}
+	return result, nil
+}
+
+// close forces all active connections to close.
+func (srv *Server) close(connDone <-chan TransferInfo, closeConns context.CancelFunc) error {
+	result := &ShutdownResult{err: ErrServerClosed}
+	result.ForceClosed = srv.forceClose(connDone, closeConns)
+	return result
+}
+
+// forceClose forces all active connections to close, waits for them to finish,
+// and returns how many there were.
+func (srv *Server) forceClose(connDone <-chan TransferInfo, closeConns context.CancelFunc) int {
+	closeConns()
+	forceClosed := 0
+	for srv.numActiveConns > 0 {
+		srv.connFinished(<-connDone)
+		forceClosed++
+	}
+	return forceClosed
+}
+
+// queuedRequest is a request waiting in the queue of the server's workers, with the context of its connection.
+type queuedRequest struct {
+	ctx     context.Context
+	request Packet
+}
+
+// startWorkers starts the MaxWorkers goroutines that handle the requests sent on the returned queue, each
+// reporting on connDone when it finishes with a request and taking the next request once its handler exits. It returns nil if MaxWorkers is not set, in which
+// case each request is handled by a goroutine of its own.
+func (srv *Server) startWorkers(connDone chan<- TransferInfo) chan queuedRequest {
+	if srv.MaxWorkers <= 0 {
+		return nil
+	}
+	queue := make(chan queuedRequest, srv.MaxQueuedRequests)
+	for i := 0; i < srv.MaxWorkers; i++ {
+		go func() {
+			for queued := range queue {
+				<-handleRequest(queued.ctx, queued.request, connDone) // the handler holds the worker until it exits
+			}
+		}()
+	}
+	return queue
+}
+
+// enqueue hands queued to an idle worker, or queues it for the next worker to become idle. If every worker is
+// busy and the queue is full, the client is sent a "server is busy" error instead, and enqueue reports false.
+func (srv *Server) enqueue(queue chan<- queuedRequest, queued queuedRequest) bool {
+	select {
+	case queue <- queued:
+		return true
+	default:
+	}
+	busyError := errNotDef.fmt("server is busy, try again later")
+	srv.metrics.requestRejected(busyError)
+	pak, err := createErrorPacket(busyError)
+	if err == nil {
+		err = srv.requestReader.writeTo(pak.raw, queued.request.from, srv.retransmitTimeout())
+	}
+	if err != nil {
+		srv.logf("tftp: error rejecting request from %v - %v\n", queued.request.from, err)
+	}
+	return false
+}
+
+// connFinished records that an active connection finished, logging the summary of its transfer.
+func (srv *Server) connFinished(info TransferInfo) {
+	srv.logf("tftp: connection finished - %v\n", info)
+	srv.numActiveConns--
+	srv.metrics.connFinished()
+}
+
+// trackedRequest is the server's record of a request that is being handled by an active connection.
+type trackedRequest struct {
+	key             string        // key identifies the request, see requestKey
+	remoteAddr      net.Addr      // remoteAddr is the address of the client that sent the request
+	retransmissions chan Packet   // retransmissions receives retransmissions of the request
+	aborted         chan struct{} // aborted is closed by AbortTransfer to abort the connection's transfer
+	abortOnce       sync.Once     // abortOnce makes sure aborted is closed only once
+}
+
+// requestKey identifies a request by its client's address and contents, which a retransmission repeats.
+func requestKey(request Packet) string {
+	return request.from.String() + "\x00" + string(request.data)
+}
+
+// trackRequest records that request is being handled. If the same request from the same client is already
+// being handled, the client retransmitted it because the response was lost: the retransmission is
+// forwarded to the connection handling it, and false is returned.
+func (srv *Server) trackRequest(request Packet) (*trackedRequest, bool) {
+	key := requestKey(request)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if tracked, ok := srv.trackedRequests[key]; ok {
+		select {
+		case tracked.retransmissions <- request:
+		default: // the connection has not yet answered an earlier retransmission, so one answer will do
+		}
+		return nil, false
+	}
+	if srv.trackedRequests == nil {
+		srv.trackedRequests = make(map[string]*trackedRequest)
+	}
+	tracked := &trackedRequest{
+		key:             key,
+		remoteAddr:      request.from,
+		retransmissions: make(chan Packet, 1),
+		aborted:         make(chan struct{}),
+	}
+	srv.trackedRequests[key] = tracked
+	return tracked, true
+}
+
+// untrackRequest removes a record made by trackRequest once its connection has finished.
+func (srv *Server) untrackRequest(tracked *trackedRequest) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.trackedRequests[tracked.key] == tracked {
+		delete(srv.trackedRequests, tracked.key)
+	}
+}
+
+// acquireWriteTarget reserves filename for writing by a single transfer, reporting
+// false if another transfer is already writing to it.
+func (srv *Server) acquireWriteTarget(filename string) bool {
+	filename = filepath.Clean(filename)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.writeTargets[filename]; ok {
+		return false
+	}
+	if srv.writeTargets == nil {
+		srv.writeTargets = make(map[string]struct{})
+	}
+	srv.writeTargets[filename] = struct{}{}
+	return true
+}
+
+// releaseWriteTarget releases a reservation made by acquireWriteTarget.
+func (srv *Server) releaseWriteTarget(filename string) {
+	filename = filepath.Clean(filename)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.writeTargets, filename)
+}
+
+// acquireTransferSlot counts another transfer for the client at ip, reporting false if the client
+// already has MaxTransfersPerIP transfers in progress.
+func (srv *Server) acquireTransferSlot(ip string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.transfersPerIP[ip] >= srv.MaxTransfersPerIP {
+		return false
+	}
+	if srv.transfersPerIP == nil {
+		srv.transfersPerIP = make(map[string]int)
+	}
+	srv.transfersPerIP[ip]++
+	return true
+}
+
+// releaseTransferSlot releases a transfer counted by acquireTransferSlot.
+func (srv *Server) releaseTransferSlot(ip string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.transfersPerIP[ip]--
+	if srv.transfersPerIP[ip] <= 0 {
+		delete(srv.transfersPerIP, ip)
+	}
+}
+
+// Defaults for the Server's retransmission settings.
+const (
+	defaultRetransmitTimeout  = time.Second
+	defaultMaxRetransmissions = 5
+	defaultMaxDuplicates      = 10
+)
+
+func (srv *Server) retransmitTimeout() time.Duration {
+	if srv.RetransmitTimeout > 0 {
+		return srv.RetransmitTimeout
+	}
+	return defaultRetransmitTimeout
+}
+
+// retransmitWait returns how long to wait for the client to answer a response that has been
+// retransmitted attempt times.
+func (srv *Server) retransmitWait(attempt int) time.Duration {
+	if srv.RetransmitBackoff != nil {
+		if wait := srv.RetransmitBackoff(attempt); wait > 0 {
+			return wait
+		}
+	}
+	return srv.retransmitTimeout()
+}
+
+// BackoffFunc returns how long to wait for an answer to a packet that has already been
+// retransmitted attempt times, where attempt is 0 for the wait after the packet is first sent.
+type BackoffFunc func(attempt int) time.Duration
+
+// ExponentialBackoff returns a BackoffFunc that waits base for an answer to a packet's first
+// transmission, and doubles the wait after each retransmission, up to max.
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(attempt int) time.Duration {
+		wait := base
+		for i := 0; i < attempt && wait < max; i++ {
+			wait *= 2
+		}
+		if wait > max {
+			wait = max
+		}
+		return wait
+	}
+}
+
+func (srv *Server) maxRetransmissions() int {
+	switch {
+	case srv.MaxRetransmissions < 0:
+		return 0
+	case srv.MaxRetransmissions == 0:
+		return defaultMaxRetransmissions
+	default:
+		return srv.MaxRetransmissions
+	}
+}
+
+func (srv *Server) maxDuplicates() int {
+	switch {
+	case srv.MaxDuplicates < 0:
+		return 0
+	case srv.MaxDuplicates == 0:
+		return defaultMaxDuplicates
+	default:
+		return srv.MaxDuplicates
+	}
+}
+
+// newChecksumHash returns a new hash of the kind given by ChecksumHash.
+func (srv *Server) newChecksumHash() hash.Hash {
+	if srv.ChecksumHash == nil {
+		return md5.New()
+	}
+	return srv.ChecksumHash()
+}
+
 func (srv *Server) logf(format string, args ...interface{}) {
 	if srv.ErrorLog != nil {
 		srv.ErrorLog.Printf(format, args...)
@@ -186,4 +1062,13 @@ var (
 	// logger. The associated value will be of
 	// type *log.Logger.
 	LoggerContextKey = &contextKey{"tftp-logger"}
+
+	// ServerContextKey is a context key. It can be used in TFTP
+	// handlers with context.WithValue to access the server that
+	// started the handler. The associated value will be of
+	// type *Server.
+	ServerContextKey = &contextKey{"tftp-server"}
+
+	// trackedRequestContextKey is a context key for the *trackedRequest of the request that started a connection.
+	trackedRequestContextKey = &contextKey{"tftp-tracked-request"}
 )
@@ -0,0 +1,33 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadFIFORefused(t *testing.T) {
+	srv := startServer(t, nil)
+	if err := syscall.Mkfifo(filepath.Join(srv.Root, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := fetch(srv, "fifo")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrAccessViolation) {
+			t.Errorf("download of a FIFO returned %v, want %v", err, ErrAccessViolation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download of a FIFO with no writer hung") // opening it blocks until a writer opens it too
+	}
+}
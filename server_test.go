@@ -0,0 +1,2305 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer starts a server rooted at a new temporary directory on an unused loopback port, after
+// configure has adjusted its settings, and stops it when the test ends.
+func startServer(t testing.TB, configure func(srv *Server)) *Server {
+	t.Helper()
+	srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+	if configure != nil {
+		configure(srv)
+	}
+	stop := make(chan CancelType)
+	done := srv.Serve(stop)
+	select {
+	case <-srv.Ready():
+	case err := <-done:
+		t.Fatalf("Serve failed: %v", err)
+	}
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return srv
+}
+
+// writeFile writes a file named name holding data beneath root.
+func writeFile(t testing.TB, root, name string, data []byte) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(root, name), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testData returns n bytes of data that differ from block to block, so that a block sent twice or out of
+// order changes the result.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i/512*7 + i)
+	}
+	return data
+}
+
+// rawClient exchanges hand-built packets with a server, for testing how the server answers packets that
+// Client never sends, such as a retransmitted request or a request with invalid options.
+type rawClient struct {
+	t    testing.TB
+	conn net.PacketConn
+}
+
+func newRawClient(t testing.TB) *rawClient {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn}
+}
+
+// sendRequest sends a request for filename carrying options to addr.
+func (client *rawClient) sendRequest(addr net.Addr, flag openFlag, filename string, options map[string]string) {
+	client.t.Helper()
+	req := createRequestPacket(flag, filename, octet)
+	req.options = options
+	raw, err := req.bytes()
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	client.send(addr, raw)
+}
+
+func (client *rawClient) send(addr net.Addr, raw []byte) {
+	client.t.Helper()
+	_, err := client.conn.WriteTo(raw, addr)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+// receive returns the next packet sent to the client, failing the test if none arrives within two seconds.
+func (client *rawClient) receive() Packet {
+	client.t.Helper()
+	buffer := make([]byte, bufferSize)
+	_ = client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := client.conn.ReadFrom(buffer)
+	if err != nil {
+		client.t.Fatalf("no packet received: %v", err)
+	}
+	return Packet{from: from, data: buffer[:n]}
+}
+
+// receiveData returns the next packet sent to the client, failing the test if it is not a DATA packet.
+func (client *rawClient) receiveData() (*DataPacket, net.Addr) {
+	client.t.Helper()
+	packet := client.receive()
+	dataPacket, err := parseDataPacket(packet)
+	if err != nil {
+		client.t.Fatalf("expected DATA, got %v: %v", packet.data, err)
+	}
+	return dataPacket, packet.from
+}
+
+func TestConcurrentUploadsToOneName(t *testing.T) {
+	srv := startServer(t, nil)
+
+	// The first upload stalls after its first block, holding the name while the second is requested.
+	firstData := testData(3 * 512)
+	reader, writer := io.Pipe()
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := newTestClient(srv.LocalAddr().String()).Upload(reader, "f")
+		firstDone <- err
+	}()
+	_, _ = writer.Write(firstData[:512])
+	waitForFile(t, filepath.Join(srv.Root, "f"))
+
+	_, err := newTestClient(srv.LocalAddr().String()).Upload(bytes.NewReader(testData(100)), "f")
+	if !errors.Is(err, ErrFileExists) || !strings.Contains(err.Error(), "already being written") {
+		t.Errorf("second upload to a name being written returned %v, want a file exists error from the write lock", err)
+	}
+
+	_, _ = writer.Write(firstData[512:])
+	_ = writer.Close()
+	if err := <-firstDone; err != nil {
+		t.Fatalf("first upload failed: %v", err)
+	}
+	waitForContent(t, filepath.Join(srv.Root, "f"), firstData)
+}
+
+func TestSimultaneousUploadsToOneName(t *testing.T) {
+	srv := startServer(t, nil)
+	const numUploads = 8
+
+	errs := make(chan error, numUploads)
+	var wg sync.WaitGroup
+	for i := 0; i < numUploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 10*512+i)
+			_, err := newTestClient(srv.LocalAddr().String()).Upload(bytes.NewReader(data), "f")
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrFileExists):
+			t.Errorf("upload failed with %v, want a file exists error", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%v uploads succeeded, want 1", succeeded)
+	}
+
+	// The file holds exactly one upload, whose length and contents identify it.
+	var got []byte
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		got, _ = os.ReadFile(filepath.Join(srv.Root, "f"))
+		i := len(got) - 10*512
+		if i >= 0 && i < numUploads && bytes.Equal(got, bytes.Repeat([]byte{byte(i)}, len(got))) {
+			return
+		}
+	}
+	t.Errorf("file of %v bytes does not hold exactly one of the uploads", len(got))
+}
+
+// waitForFile waits up to two seconds for the file at path to exist.
+func waitForFile(t testing.TB, path string) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+	}
+	t.Fatalf("%v was not created", path)
+}
+
+// waitForContent waits up to two seconds for the file at path to hold want, as the server closes an uploaded
+// file only after sending the ACK that completes the upload.
+func waitForContent(t testing.TB, path string, want []byte) {
+	t.Helper()
+	var got []byte
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		var err error
+		got, err = os.ReadFile(path)
+		if err == nil && bytes.Equal(got, want) {
+			return
+		}
+	}
+	t.Fatalf("%v holds %v bytes, want %v bytes", path, len(got), len(want))
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.ReadAhead = 2
+	})
+	const numTransfers = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < numTransfers; i++ {
+		data := testData(20*512 + i)
+		writeFile(t, srv.Root, fmt.Sprintf("download%v", i), data)
+
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			var buf bytes.Buffer
+			client := newTestClient(srv.LocalAddr().String())
+			client.BlockSize = 512 + 100*i
+			_, err := client.Download(fmt.Sprintf("download%v", i), &buf)
+			if err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("download %v: got %v bytes, %v, want %v bytes", i, buf.Len(), err, len(data))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, err := newTestClient(srv.LocalAddr().String()).Upload(bytes.NewReader(data), fmt.Sprintf("upload%v", i))
+			if err != nil {
+				t.Errorf("upload %v: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < numTransfers; i++ {
+		waitForContent(t, filepath.Join(srv.Root, fmt.Sprintf("upload%v", i)), testData(20*512+i))
+	}
+}
+
+// startStalledDownload requests a file from srv with a raw client that receives the first block and never
+// acknowledges it, leaving the transfer in progress. The address of the transfer's TID is returned with the client.
+func startStalledDownload(t *testing.T, srv *Server, filename string) (*rawClient, net.Addr) {
+	t.Helper()
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, filename, nil)
+	_, tid := client.receiveData()
+	return client, tid
+}
+
+// receiveError returns the next packet sent to client, failing the test if it is not an ERROR packet.
+func (client *rawClient) receiveError() *ErrorPacket {
+	client.t.Helper()
+	packet := client.receive()
+	errorPacket, err := parseErrorPacket(packet)
+	if err != nil {
+		client.t.Fatalf("expected ERROR, got %v", describe(packet.data))
+	}
+	return errorPacket
+}
+
+func TestAbortTransfer(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+	})
+	data := testData(50 * 512)
+	writeFile(t, srv.Root, "f", data)
+
+	stalled, _ := startStalledDownload(t, srv, "f")
+	other, otherTID := startStalledDownload(t, srv, "f")
+
+	// A transfer that is not aborted runs to completion alongside the aborted one.
+	downloaded := make(chan error, 1)
+	go func() {
+		var buf bytes.Buffer
+		_, err := newTestClient(srv.LocalAddr().String()).Download("f", &buf)
+		if err == nil && !bytes.Equal(buf.Bytes(), data) {
+			err = fmt.Errorf("downloaded %v bytes, want %v", buf.Len(), len(data))
+		}
+		downloaded <- err
+	}()
+
+	err := srv.AbortTransfer(stalled.conn.LocalAddr())
+	if err != nil {
+		t.Fatalf("AbortTransfer: %v", err)
+	}
+	if errorPacket := stalled.receiveError(); !strings.Contains(errorPacket.errorMsg, "aborted") {
+		t.Errorf("aborted client received %q", errorPacket.errorMsg)
+	}
+	if err := <-downloaded; err != nil {
+		t.Errorf("download alongside the aborted transfer: %v", err)
+	}
+
+	// The other stalled transfer is still in progress, and answers its client's ACK.
+	other.send(otherTID, mustBytes(createAckPacket(1).bytes()))
+	if dataPacket, _ := other.receiveData(); dataPacket.blockNumber != 2 {
+		t.Errorf("transfer that was not aborted sent DATA(%v), want DATA(2)", dataPacket.blockNumber)
+	}
+
+	if err := srv.AbortTransfer(newRawClient(t).conn.LocalAddr()); err == nil {
+		t.Error("AbortTransfer of a client with no transfer succeeded")
+	}
+}
+
+func TestAbortTransferRacesCompletion(t *testing.T) {
+	srv := startServer(t, nil)
+	writeFile(t, srv.Root, "f", testData(5*512))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		client := newTestClient(srv.LocalAddr().String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = client.Download("f", io.Discard) // aborted or not, the transfer must end without a race
+		}()
+	}
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+		srv.mu.Lock()
+		var addrs []net.Addr
+		for _, tracked := range srv.trackedRequests {
+			addrs = append(addrs, tracked.remoteAddr)
+		}
+		srv.mu.Unlock()
+		for _, addr := range addrs {
+			_ = srv.AbortTransfer(addr)
+		}
+	}
+	wg.Wait()
+}
+
+func TestCloseDuringTransfers(t *testing.T) {
+	srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+	srv.RetransmitTimeout = 5 * time.Second
+	done := srv.Serve(make(chan CancelType))
+	<-srv.Ready()
+	writeFile(t, srv.Root, "f", testData(50*512))
+
+	var stalled []*rawClient
+	for i := 0; i < 5; i++ {
+		client, _ := startStalledDownload(t, srv, "f")
+		stalled = append(stalled, client)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = newTestClient(srv.LocalAddr().String()).Download("f", io.Discard)
+		}()
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- srv.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the stalled transfers")
+	}
+	for _, client := range stalled {
+		client.receiveError()
+	}
+	wg.Wait()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not stop after Close")
+	}
+}
+
+func mustBytes(raw []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// waitForRemoval waits up to two seconds for the file at path to be removed, as the server removes the file
+// of a failed upload only after sending the ERROR that ends it.
+func waitForRemoval(t testing.TB, path string) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	t.Fatalf("%v was left behind", path)
+}
+
+func TestWrqTransferSizeMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		tsize    string
+		sizes    []int // sizes of the DATA blocks the client sends
+		blockErr int   // index of the block answered with an ERROR
+	}{
+		{"final block short of the transfer size", "1000", []int{512, 100}, 1},
+		{"single block short of the transfer size", "1000", []int{100}, 0},
+		{"empty file with a transfer size", "1000", []int{0}, 0},
+		{"block beyond the transfer size", "600", []int{512, 512, 100}, 1},
+		{"final block beyond the transfer size", "10", []int{100}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, nil)
+			client := newRawClient(t)
+			client.sendRequest(srv.LocalAddr(), write, "f", map[string]string{"tsize": test.tsize})
+			packet := client.receive()
+			if _, err := parseOackPacket(packet); err != nil {
+				t.Fatalf("expected OACK, got %v", describe(packet.data))
+			}
+			tid := packet.from
+
+			data := testData(1600)
+			for i, size := range test.sizes {
+				client.send(tid, mustBytes(createDataPacket(uint16(i+1), data[:size]).bytes()))
+				data = data[size:]
+				if i == test.blockErr {
+					if errorPacket := client.receiveError(); !strings.Contains(errorPacket.errorMsg, "transfer size") {
+						t.Errorf("client received %q", errorPacket.errorMsg)
+					}
+					break
+				}
+				packet := client.receive()
+				if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != uint16(i+1) {
+					t.Fatalf("expected ACK(%v), got %v", i+1, describe(packet.data))
+				}
+			}
+			waitForRemoval(t, filepath.Join(srv.Root, "f"))
+		})
+	}
+}
+
+func TestRetransmittedRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		flag openFlag
+	}{
+		{"RRQ answered with DATA(1)", read},
+		{"WRQ answered with ACK(0)", write},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.RetransmitTimeout = 5 * time.Second
+			})
+			data := testData(100)
+			if test.flag == read {
+				writeFile(t, srv.Root, "f", data)
+			}
+			client := newRawClient(t)
+			client.sendRequest(srv.LocalAddr(), test.flag, "f", nil)
+			first := client.receive()
+
+			// The response was lost, so the client sends its request again, and the connection that answered
+			// the first request answers it again rather than a second transfer starting.
+			client.sendRequest(srv.LocalAddr(), test.flag, "f", nil)
+			second := client.receive()
+			if second.from.String() != first.from.String() {
+				t.Errorf("retransmitted request answered from %v, want %v", second.from, first.from)
+			}
+			if !bytes.Equal(second.data, first.data) {
+				t.Errorf("retransmitted request answered with %v, want %v", describe(second.data), describe(first.data))
+			}
+			srv.mu.Lock()
+			transfers := len(srv.trackedRequests)
+			srv.mu.Unlock()
+			if transfers != 1 {
+				t.Errorf("%v transfers in progress, want 1", transfers)
+			}
+
+			// The transfer completes as if the request had been sent once.
+			tid := first.from
+			if test.flag == read {
+				client.send(tid, mustBytes(createAckPacket(1).bytes()))
+				if dataPacket, _ := parseDataPacket(first); !bytes.Equal(dataPacket.data, data) {
+					t.Errorf("downloaded %v bytes, want %v", len(dataPacket.data), len(data))
+				}
+				return
+			}
+			client.send(tid, mustBytes(createDataPacket(1, data).bytes()))
+			packet := client.receive()
+			if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != 1 {
+				t.Fatalf("expected ACK(1), got %v", describe(packet.data))
+			}
+			waitForContent(t, filepath.Join(srv.Root, "f"), data)
+		})
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	srv := startServer(b, nil)
+	data := testData(1 << 20)
+	writeFile(b, srv.Root, "f", data)
+	client := newTestClient(srv.LocalAddr().String())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Download("f", io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpload(b *testing.B) {
+	srv := startServer(b, nil)
+	data := testData(1 << 20)
+	client := newTestClient(srv.LocalAddr().String())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Upload(bytes.NewReader(data), fmt.Sprint(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tryReceive returns the next packet sent to the client, or reports false if none arrives within timeout.
+func (client *rawClient) tryReceive(timeout time.Duration) (Packet, bool) {
+	buffer := make([]byte, bufferSize)
+	_ = client.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, from, err := client.conn.ReadFrom(buffer)
+	if err != nil {
+		return Packet{}, false
+	}
+	return Packet{from: from, data: buffer[:n]}, true
+}
+
+// floodRequests sends a read request for filename from each of clients at once, and ends each transfer that the
+// server starts by answering its first block with an ERROR. It returns the number of requests answered with
+// DATA, and the number answered with an ERROR, such as that the server is busy. The rest were not answered within
+// a second, as their datagrams were dropped.
+func floodRequests(tb testing.TB, srv *Server, clients []*rawClient, filename string) (accepted, rejected int) {
+	tb.Helper()
+	cancel, err := createErrorPacket(errNotDef.fmt("cancelled"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *rawClient) {
+			defer wg.Done()
+			<-start
+			client.sendRequest(srv.LocalAddr(), read, filename, nil)
+			packet, ok := client.tryReceive(time.Second)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if _, err := parseDataPacket(packet); err == nil {
+				accepted++
+				client.send(packet.from, cancel.raw)
+			} else {
+				rejected++
+			}
+		}(client)
+	}
+	close(start)
+	wg.Wait()
+	return accepted, rejected
+}
+
+// waitForTransfers waits up to two seconds for the transfers in progress on srv to finish, so that a request
+// from a client whose last transfer was cancelled is not taken for a retransmission of its last request.
+func waitForTransfers(tb testing.TB, srv *Server) {
+	tb.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		transfers := len(srv.trackedRequests)
+		srv.mu.Unlock()
+		if transfers == 0 {
+			return
+		}
+	}
+	tb.Fatal("transfers did not finish")
+}
+
+// waitFor waits up to two seconds for condition to hold, failing the test with what it was waiting for if it
+// does not.
+func waitFor(tb testing.TB, what string, condition func() bool) {
+	tb.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	tb.Fatalf("timed out waiting for %v", what)
+}
+
+func newRawClients(tb testing.TB, n int) []*rawClient {
+	clients := make([]*rawClient, n)
+	for i := range clients {
+		clients[i] = newRawClient(tb)
+	}
+	return clients
+}
+
+// BenchmarkRequestBurst measures how many of a burst of simultaneous read requests the server accepts, with
+// requests read by one goroutine, as before RequestReaders, and by several.
+func BenchmarkRequestBurst(b *testing.B) {
+	for _, readers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("RequestReaders=%v", readers), func(b *testing.B) {
+			srv := startServer(b, func(srv *Server) {
+				srv.RequestReaders = readers
+				srv.RetransmitTimeout = 5 * time.Second
+			})
+			writeFile(b, srv.Root, "f", testData(512))
+			clients := newRawClients(b, 200)
+
+			var elapsed time.Duration
+			var accepted, lost int
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				n, rejected := floodRequests(b, srv, clients, "f")
+				elapsed += time.Since(start)
+				accepted += n
+				lost += len(clients) - n - rejected
+				waitForTransfers(b, srv)
+			}
+			b.ReportMetric(float64(accepted)/elapsed.Seconds(), "accepted/s")
+			b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+		})
+	}
+}
+
+// BenchmarkRequestFlood reports the most goroutines and heap in use above those in use before a flood of read
+// requests, with a goroutine started for each request, as before MaxWorkers, and with a pool of workers. The
+// goroutines of the clients sending the flood are not counted.
+func BenchmarkRequestFlood(b *testing.B) {
+	for _, workers := range []int{0, 10} {
+		b.Run(fmt.Sprintf("MaxWorkers=%v", workers), func(b *testing.B) {
+			srv := startServer(b, func(srv *Server) {
+				srv.MaxWorkers = workers
+				srv.MaxQueuedRequests = 5
+				srv.RetransmitTimeout = 5 * time.Second
+			})
+			writeFile(b, srv.Root, "f", testData(512))
+			clients := newRawClients(b, 200)
+
+			var peakGoroutines, peakHeap, rejected float64
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				goroutines, heap := runtime.NumGoroutine(), stats.HeapInuse
+
+				stop := make(chan struct{})
+				sampled := make(chan struct{})
+				go func() {
+					defer close(sampled)
+					for {
+						runtime.ReadMemStats(&stats)
+						peakGoroutines = math.Max(peakGoroutines, float64(runtime.NumGoroutine()-goroutines-len(clients)-1))
+						peakHeap = math.Max(peakHeap, float64(stats.HeapInuse)-float64(heap))
+						select {
+						case <-stop:
+							return
+						case <-time.After(time.Millisecond):
+						}
+					}
+				}()
+				_, n := floodRequests(b, srv, clients, "f")
+				close(stop)
+				<-sampled
+				rejected += float64(n)
+				waitForTransfers(b, srv)
+			}
+			b.ReportMetric(peakGoroutines, "goroutines")
+			b.ReportMetric(peakHeap/1024, "heap-KiB")
+			b.ReportMetric(rejected/float64(b.N), "rejected/op")
+		})
+	}
+}
+
+// BenchmarkReadAhead compares downloads whose blocks are read from the file as they are acknowledged, as before
+// ReadAhead, with downloads whose blocks are read ahead of the client.
+func BenchmarkReadAhead(b *testing.B) {
+	for _, readAhead := range []int{0, 4} {
+		b.Run(fmt.Sprintf("ReadAhead=%v", readAhead), func(b *testing.B) {
+			srv := startServer(b, func(srv *Server) {
+				srv.ReadAhead = readAhead
+			})
+			data := testData(1 << 20)
+			writeFile(b, srv.Root, "f", data)
+			client := newTestClient(srv.LocalAddr().String())
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := client.Download("f", io.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTransferSizes(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		blockSize int // blockSize is the blksize the client requests, if any.
+	}{
+		{"empty file", 0, 0},
+		{"empty file with blksize", 0, 1024},
+		{"one short block", 100, 0},
+		{"exactly one block", 512, 0},
+		{"exact multiple of the block size", 4 * 512, 0},
+		{"exact multiple of blksize", 3 * 1024, 1024},
+		{"short final block with blksize", 3*1024 + 1, 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, nil)
+			data := testData(test.size)
+			client := newTestClient(srv.LocalAddr().String())
+			client.BlockSize = test.blockSize
+
+			n, err := client.Upload(bytes.NewReader(data), "f")
+			if err != nil || n != int64(len(data)) {
+				t.Fatalf("Upload = %v, %v, want %v, nil", n, err, len(data))
+			}
+			waitForContent(t, filepath.Join(srv.Root, "f"), data)
+
+			var buf bytes.Buffer
+			n, err = client.Download("f", &buf)
+			if err != nil || n != int64(len(data)) {
+				t.Fatalf("Download = %v, %v, want %v, nil", n, err, len(data))
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("downloaded %v bytes that differ from the %v uploaded", buf.Len(), len(data))
+			}
+		})
+	}
+}
+
+func TestEmptyFileBlocks(t *testing.T) {
+	srv := startServer(t, nil)
+	writeFile(t, srv.Root, "empty", nil)
+
+	// A download of an empty file is a single empty DATA(1), completed by its ACK.
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "empty", nil)
+	dataPacket, tid := client.receiveData()
+	if dataPacket.blockNumber != 1 || len(dataPacket.data) != 0 {
+		t.Fatalf("expected an empty DATA(1), got DATA(%v) of %v bytes", dataPacket.blockNumber, len(dataPacket.data))
+	}
+	client.send(tid, mustBytes(createAckPacket(1).bytes()))
+	if packet, ok := client.tryReceive(100 * time.Millisecond); ok {
+		t.Errorf("server sent %v after the final ACK", describe(packet.data))
+	}
+	waitForTransfers(t, srv)
+
+	// An upload of an empty file is a WRQ followed at once by an empty DATA(1).
+	client = newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), write, "uploaded", nil)
+	packet := client.receive()
+	if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != 0 {
+		t.Fatalf("expected ACK(0), got %v", describe(packet.data))
+	}
+	client.send(packet.from, mustBytes(createDataPacket(1, nil).bytes()))
+	packet = client.receive()
+	if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != 1 {
+		t.Fatalf("expected ACK(1), got %v", describe(packet.data))
+	}
+	waitForContent(t, filepath.Join(srv.Root, "uploaded"), []byte{})
+}
+
+func TestRateLimitedTransferStops(t *testing.T) {
+	tests := []struct {
+		name    string
+		stop    func(srv *Server, client *rawClient) error
+		message string
+	}{
+		{"AbortTransfer", func(srv *Server, client *rawClient) error { return srv.AbortTransfer(client.conn.LocalAddr()) }, "aborted"},
+		{"Close", func(srv *Server, client *rawClient) error { return srv.Close() }, "shutting down"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.GlobalRateLimit = 100 // each further block of 512 bytes waits for about five seconds
+			})
+			writeFile(t, srv.Root, "f", testData(3*512))
+
+			// The first block is sent at once, and the second waits for the rate limit after its ACK.
+			client, tid := startStalledDownload(t, srv, "f")
+			client.send(tid, mustBytes(createAckPacket(1).bytes()))
+			time.Sleep(50 * time.Millisecond)
+
+			start := time.Now()
+			err := test.stop(srv, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet, ok := client.tryReceive(time.Second)
+			if !ok {
+				t.Fatalf("no ERROR within a second of %v", test.name)
+			}
+			errorPacket, err := parseErrorPacket(packet)
+			if err != nil || !strings.Contains(errorPacket.errorMsg, test.message) {
+				t.Fatalf("expected an ERROR containing %q, got %v", test.message, describe(packet.data))
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("transfer stopped %v after %v", elapsed, test.name)
+			}
+		})
+	}
+}
+
+func TestNothingLoggedToStandardLogger(t *testing.T) {
+	var standard, supplied bytes.Buffer
+	log.SetOutput(&standard)
+	defer log.SetOutput(os.Stderr)
+
+	srv := startServer(t, func(srv *Server) {
+		srv.ErrorLog = log.New(&supplied, "", 0)
+	})
+	writeFile(t, srv.Root, "f", testData(3*512))
+	client := NewClient(srv.LocalAddr().String(), log.New(&supplied, "", 0))
+	client.Timeout = 100 * time.Millisecond
+
+	_, err := client.Download("f", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Upload(bytes.NewReader(testData(700)), "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Download("missing", io.Discard) // a failed transfer logs its error
+	if err == nil {
+		t.Fatal("download of a missing file succeeded")
+	}
+	waitForTransfers(t, srv)
+	if standard.Len() > 0 {
+		t.Errorf("the standard logger received %q", standard.String())
+	}
+}
+
+// download completes a download of blockSize blocks from tid whose first DATA packet client has received,
+// acknowledging each block, and returns the data of all the blocks.
+func (client *rawClient) download(tid net.Addr, first *DataPacket, blockSize int) []byte {
+	client.t.Helper()
+	data := append([]byte(nil), first.data...)
+	dataPacket := first
+	for {
+		client.send(tid, mustBytes(createAckPacket(dataPacket.blockNumber).bytes()))
+		if len(dataPacket.data) < blockSize {
+			return data
+		}
+		dataPacket, _ = client.receiveData()
+		data = append(data, dataPacket.data...)
+	}
+}
+
+func TestResumeFromOffset(t *testing.T) {
+	data := testData(3*512 + 100)
+	tests := []struct {
+		offset     string
+		wantOffset int
+	}{
+		{"600", 600},
+		{"512", 512},
+		{"1636", 1636},
+		{"5000", 1636}, // an offset beyond the end of the file is clamped to its size
+	}
+	for _, test := range tests {
+		t.Run(test.offset, func(t *testing.T) {
+			srv := startServer(t, nil)
+			writeFile(t, srv.Root, "f", data)
+			client := newRawClient(t)
+			client.sendRequest(srv.LocalAddr(), read, "f", map[string]string{"offset": test.offset, "tsize": "0"})
+			packet := client.receive()
+			oackPacket, err := parseOackPacket(packet)
+			if err != nil {
+				t.Fatalf("expected OACK, got %v", describe(packet.data))
+			}
+			want := map[string]string{
+				"offset": fmt.Sprint(test.wantOffset),
+				"tsize":  fmt.Sprint(len(data) - test.wantOffset), // the size of what is sent, not of the whole file
+			}
+			for name, value := range want {
+				if oackPacket.options[name] != value {
+					t.Errorf("OACK %v = %q, want %q", name, oackPacket.options[name], value)
+				}
+			}
+
+			client.send(packet.from, mustBytes(createAckPacket(0).bytes()))
+			first, _ := client.receiveData()
+			got := client.download(packet.from, first, defaultBlockSize)
+			if !bytes.Equal(got, data[test.wantOffset:]) {
+				t.Errorf("received %v bytes, want the last %v bytes of the file", len(got), len(data)-test.wantOffset)
+			}
+		})
+	}
+}
+
+func TestMaxTransfersPerIP(t *testing.T) {
+	const limit = 3
+	srv := startServer(t, func(srv *Server) {
+		srv.MaxTransfersPerIP = limit
+		srv.ExpvarName = newExpvarName(t)
+	})
+	writeFile(t, srv.Root, "f", testData(2000))
+
+	for i := 0; i < limit; i++ {
+		startStalledDownload(t, srv, "f")
+	}
+
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", nil)
+	errorPacket := client.receiveError()
+	if errorPacket.errorCode != errNotDef.errorCode || !strings.Contains(errorPacket.errorMsg, "too many transfers") {
+		t.Errorf("request over the limit got ERROR %v %q, want a too many transfers error", errorPacket.errorCode, errorPacket.errorMsg)
+	}
+	waitFor(t, "the rejection to be counted", func() bool { return metricValue(t, srv.ExpvarName, rejectedMetric) == 1 })
+	if got := metricValue(t, srv.ExpvarName, "errors.0"); got != 1 {
+		t.Errorf("errors.0 = %v, want 1", got)
+	}
+}
+
+func TestOversizedRequest(t *testing.T) {
+	srv := startServer(t, nil)
+	writeFile(t, srv.Root, "f", []byte("data"))
+
+	// request returns an RRQ for "f" padded with an unknown option to size bytes.
+	request := func(size int) []byte {
+		raw := append([]byte{0, byte(RRQ)}, "f\x00octet\x00pad\x00"...)
+		raw = append(raw, strings.Repeat("x", size-len(raw)-1)...)
+		return append(raw, 0)
+	}
+	tests := []struct {
+		size      int
+		truncated bool
+	}{
+		{bufferSize - 1, false},
+		{bufferSize, false},
+		{bufferSize + 1, true},
+		{2000, true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.size), func(t *testing.T) {
+			client := newRawClient(t)
+			client.send(srv.LocalAddr(), request(test.size))
+			packet := client.receive()
+			errorPacket, err := parseErrorPacket(packet)
+			if !test.truncated {
+				if err == nil {
+					t.Fatalf("request of %v bytes got ERROR %q", test.size, errorPacket.errorMsg)
+				}
+				return
+			}
+			if err != nil || !strings.Contains(errorPacket.errorMsg, "larger than") {
+				t.Fatalf("request of %v bytes got %v, want an ERROR saying it is too large", test.size, describe(packet.data))
+			}
+		})
+	}
+}
+
+// countingFileSystem is the operating system's file system, counting the files that are open.
+type countingFileSystem struct {
+	osFileSystem
+	open int64
+}
+
+func (fsys *countingFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := fsys.osFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&fsys.open, 1)
+	return &countedFile{File: file, fsys: fsys}, nil
+}
+
+type countedFile struct {
+	File
+	fsys   *countingFileSystem
+	closed int32
+}
+
+func (file *countedFile) Close() error {
+	if atomic.CompareAndSwapInt32(&file.closed, 0, 1) {
+		atomic.AddInt64(&file.fsys.open, -1)
+	}
+	return file.File.Close()
+}
+
+// openFDs returns the number of file descriptors the process has open, and how many of them are sockets.
+func openFDs(t testing.TB) (fds, sockets int) {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err != nil {
+			continue // the descriptor ReadDir used to list the directory, closed since
+		}
+		fds++
+		if strings.HasPrefix(target, "socket:") {
+			sockets++
+		}
+	}
+	return fds, sockets
+}
+
+// TestUnansweredTransfersReleaseResources checks that transfers whose client never answers give up once their
+// retransmissions run out, closing their file and the socket of their TID.
+func TestUnansweredTransfersReleaseResources(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("counting file descriptors needs /proc/self/fd")
+	}
+	const transfers = 50
+	fsys := &countingFileSystem{}
+	srv := startServer(t, func(srv *Server) {
+		srv.FileSystem = fsys
+		srv.RetransmitTimeout = 20 * time.Millisecond
+		srv.MaxRetransmissions = 2
+		srv.ExpvarName = newExpvarName(t)
+	})
+	writeFile(t, srv.Root, "f", testData(2000))
+	clients := newRawClients(t, transfers)
+	fdsBefore, socketsBefore := openFDs(t)
+
+	for _, client := range clients {
+		client.sendRequest(srv.LocalAddr(), read, "f", nil) // and never acknowledge the first block
+	}
+	waitFor(t, "the transfers to start", func() bool { return metricValue(t, srv.ExpvarName, requestsMetric) == transfers })
+	waitFor(t, "the transfers to time out", func() bool {
+		return metricValue(t, srv.ExpvarName, activeConnectionsMetric) == 0
+	})
+	if got := metricValue(t, srv.ExpvarName, "errors.0"); got != transfers {
+		t.Errorf("%v transfers failed, want %v", got, transfers)
+	}
+	if open := atomic.LoadInt64(&fsys.open); open != 0 {
+		t.Errorf("%v files are still open", open)
+	}
+	waitFor(t, "the descriptors to be closed", func() bool {
+		fds, sockets := openFDs(t)
+		return fds <= fdsBefore && sockets <= socketsBefore
+	})
+
+	result, err := srv.requestShutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Drained != 0 || result.ForceClosed != 0 {
+		t.Errorf("shutdown found %v active connections, want none", result.Drained+result.ForceClosed)
+	}
+}
+
+func TestServersWithDifferentRoots(t *testing.T) {
+	servers := []*Server{startServer(t, nil), startServer(t, nil)}
+	contents := [][]byte{testData(3000), []byte("the second server's file")}
+	for i, srv := range servers {
+		writeFile(t, srv.Root, "f", contents[i])
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, len(servers))
+	errs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv *Server) {
+			defer wg.Done()
+			var got bytes.Buffer
+			_, errs[i] = newTestClient(srv.LocalAddr().String()).Download("f", &got)
+			results[i] = got.Bytes()
+		}(i, srv)
+	}
+	wg.Wait()
+	for i := range servers {
+		if errs[i] != nil {
+			t.Errorf("download from server %v failed: %v", i, errs[i])
+		} else if !bytes.Equal(results[i], contents[i]) {
+			t.Errorf("server %v served %v bytes, want its own file of %v bytes", i, len(results[i]), len(contents[i]))
+		}
+	}
+}
+
+func TestTIDPortRange(t *testing.T) {
+	port := freePort(t)
+	srv := startServer(t, func(srv *Server) {
+		srv.MinTIDPort = port
+		srv.MaxTIDPort = port
+	})
+	writeFile(t, srv.Root, "f", testData(2000))
+
+	_, tid := startStalledDownload(t, srv, "f")
+	if got := tid.(*net.UDPAddr).Port; got != port {
+		t.Fatalf("transfer replied from port %v, want %v", got, port)
+	}
+
+	client := newRawClient(t) // the only port of the range is taken by the stalled download
+	client.sendRequest(srv.LocalAddr(), read, "f", nil)
+	errorPacket := client.receiveError()
+	if errorPacket.errorCode != errNotDef.errorCode || !strings.Contains(errorPacket.errorMsg, "failed to assign TID") {
+		t.Errorf("got ERROR %v %q, want a failure to assign a TID", errorPacket.errorCode, errorPacket.errorMsg)
+	}
+}
+
+// fetch downloads filename from srv with a Client, returning the bytes received.
+func fetch(srv *Server, filename string) ([]byte, error) {
+	var got bytes.Buffer
+	_, err := newTestClient(srv.LocalAddr().String()).Download(filename, &got)
+	return got.Bytes(), err
+}
+
+func TestDefaultFile(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.DefaultFile = "pxelinux.cfg/default"
+	})
+	if err := os.Mkdir(filepath.Join(srv.Root, "pxelinux.cfg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defaultConfig, ownConfig := []byte("default config"), []byte("config of aa-bb")
+	writeFile(t, srv.Root, "pxelinux.cfg/default", defaultConfig)
+	writeFile(t, srv.Root, "pxelinux.cfg/01-aa-bb", ownConfig)
+	writeFile(t, srv.Root, "file", nil)
+
+	tests := []struct {
+		filename string
+		want     []byte
+	}{
+		{"pxelinux.cfg/01-aa-bb", ownConfig},
+		{"pxelinux.cfg/01-cc-dd", defaultConfig},
+		{"missing-dir/01-cc-dd", defaultConfig},
+		{"file/01-cc-dd", defaultConfig}, // a file in place of a directory
+	}
+	for _, test := range tests {
+		got, err := fetch(srv, test.filename)
+		if err != nil {
+			t.Errorf("download of %q failed: %v", test.filename, err)
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("download of %q received %q, want %q", test.filename, got, test.want)
+		}
+	}
+
+	client := newTestClient(srv.LocalAddr().String())
+	if _, err := client.Upload(strings.NewReader("new"), "pxelinux.cfg/01-ee-ff"); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	waitForContent(t, filepath.Join(srv.Root, "pxelinux.cfg", "01-ee-ff"), []byte("new"))
+}
+
+func TestChecksumSuffix(t *testing.T) {
+	tests := []struct {
+		name string
+		hash func() hash.Hash
+	}{
+		{"MD5 by default", nil},
+		{"SHA-256", sha256.New},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.ChecksumSuffix = ".sum"
+				srv.ChecksumHash = test.hash
+			})
+			data := testData(3000)
+			writeFile(t, srv.Root, "firmware.bin", data)
+
+			var h hash.Hash = md5.New()
+			if test.hash != nil {
+				h = test.hash()
+			}
+			h.Write(data)
+			want := fmt.Sprintf("%x  firmware.bin\n", h.Sum(nil))
+
+			got, err := fetch(srv, "firmware.bin.sum")
+			if err != nil {
+				t.Fatalf("download of the checksum failed: %v", err)
+			}
+			if string(got) != want {
+				t.Errorf("checksum is %q, want %q", got, want)
+			}
+			if got, err := fetch(srv, "firmware.bin"); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("download of the file itself received %v bytes, %v, want %v bytes", len(got), err, len(data))
+			}
+			if _, err := fetch(srv, "missing.sum"); !errors.Is(err, ErrFileNotFound) {
+				t.Errorf("download of the checksum of a missing file returned %v, want %v", err, ErrFileNotFound)
+			}
+		})
+	}
+}
+
+func TestCreateDirs(t *testing.T) {
+	for _, createDirs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("CreateDirs=%v", createDirs), func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.CreateDirs = createDirs
+			})
+			data := testData(1000)
+			_, err := newTestClient(srv.LocalAddr().String()).Upload(bytes.NewReader(data), "pxelinux.cfg/01/aa-bb")
+			path := filepath.Join(srv.Root, "pxelinux.cfg", "01", "aa-bb")
+			if createDirs {
+				if err != nil {
+					t.Fatalf("upload failed: %v", err)
+				}
+				waitForContent(t, path, data)
+				return
+			}
+			if !errors.Is(err, ErrFileNotFound) {
+				t.Errorf("upload returned %v, want %v", err, ErrFileNotFound)
+			}
+			if _, err := os.Stat(filepath.Join(srv.Root, "pxelinux.cfg")); !os.IsNotExist(err) {
+				t.Errorf("the missing directory was created: %v", err)
+			}
+		})
+	}
+}
+
+func TestAllowMode(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.AllowMode = func(filename, mode string) bool {
+			return mode == "octet" || !strings.HasSuffix(filename, ".bin")
+		}
+	})
+	writeFile(t, srv.Root, "boot.bin", testData(100))
+	writeFile(t, srv.Root, "motd.txt", []byte("hello\n"))
+
+	tests := []struct {
+		filename string
+		mode     encodingFlag
+		allowed  bool
+	}{
+		{"boot.bin", octet, true},
+		{"boot.bin", netascii, false},
+		{"motd.txt", netascii, true},
+	}
+	for _, test := range tests {
+		client := newRawClient(t)
+		client.send(srv.LocalAddr(), mustBytes(createRequestPacket(read, test.filename, test.mode).bytes()))
+		packet := client.receive()
+		errorPacket, err := parseErrorPacket(packet)
+		switch {
+		case test.allowed && err == nil:
+			t.Errorf("request for %q in mode %v was refused: %v", test.filename, test.mode, errorPacket.tftpError)
+		case !test.allowed && err != nil:
+			t.Errorf("request for %q in mode %v was answered with %v, want an ERROR", test.filename, test.mode, describe(packet.data))
+		case !test.allowed && errorPacket.errorCode != uint16(CodeIllegalOperation):
+			t.Errorf("request for %q in mode %v was refused with code %v, want %v",
+				test.filename, test.mode, errorPacket.errorCode, CodeIllegalOperation)
+		}
+	}
+}
+
+func TestFallbackRoots(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	srv := startServer(t, func(srv *Server) {
+		srv.FallbackRoots = []string{first, second}
+	})
+	writeFile(t, srv.Root, "override", []byte("from Root"))
+	writeFile(t, second, "override", []byte("from the second root"))
+	writeFile(t, first, "shared", []byte("from the first root"))
+	writeFile(t, second, "shared", []byte("from the second root"))
+	writeFile(t, second, "default", []byte("from the second root"))
+
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"override", "from Root"},
+		{"shared", "from the first root"},
+		{"default", "from the second root"},
+	}
+	for _, test := range tests {
+		got, err := fetch(srv, test.filename)
+		if err != nil {
+			t.Errorf("download of %q failed: %v", test.filename, err)
+		} else if string(got) != test.want {
+			t.Errorf("download of %q received %q, want %q", test.filename, got, test.want)
+		}
+	}
+	if _, err := fetch(srv, "missing"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("download of a file in no root returned %v, want %v", err, ErrFileNotFound)
+	}
+
+	if _, err := newTestClient(srv.LocalAddr().String()).Upload(strings.NewReader("uploaded"), "default"); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	waitForContent(t, filepath.Join(srv.Root, "default"), []byte("uploaded"))
+	if data, _ := os.ReadFile(filepath.Join(second, "default")); string(data) != "from the second root" {
+		t.Errorf("upload changed the file in the second root to %q", data)
+	}
+}
+
+func TestTransferIDs(t *testing.T) {
+	infos := make(chan TransferInfo, 2)
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+		srv.OnTransferComplete = func(info TransferInfo) { infos <- info }
+	})
+	data := testData(2000)
+	writeFile(t, srv.Root, "f", data)
+
+	// Both transfers are in progress at once, and the later one finishes first.
+	first, second := newRawClient(t), newRawClient(t)
+	first.sendRequest(srv.LocalAddr(), read, "f", nil)
+	firstBlock, firstTID := first.receiveData()
+	second.sendRequest(srv.LocalAddr(), read, "f", nil)
+	secondBlock, secondTID := second.receiveData()
+	for _, client := range []struct {
+		*rawClient
+		block *DataPacket
+		tid   net.Addr
+	}{{second, secondBlock, secondTID}, {first, firstBlock, firstTID}} {
+		if got := client.download(client.tid, client.block, defaultBlockSize); !bytes.Equal(got, data) {
+			t.Fatalf("received %v bytes, want %v", len(got), len(data))
+		}
+	}
+
+	ids := make(map[string]uint64)
+	for i := 0; i < 2; i++ {
+		select {
+		case info := <-infos:
+			ids[info.RemoteAddr.String()] = info.ID
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnTransferComplete was not called for both transfers")
+		}
+	}
+	firstID, secondID := ids[first.conn.LocalAddr().String()], ids[second.conn.LocalAddr().String()]
+	if firstID == 0 || secondID <= firstID {
+		t.Errorf("transfers have IDs %v and %v, want distinct IDs increasing in the order of the requests", firstID, secondID)
+	}
+}
+
+func TestServeAgainAfterShutdown(t *testing.T) {
+	srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+	data := testData(1000)
+	writeFile(t, srv.Root, "f", data)
+
+	for run := 1; run <= 2; run++ {
+		done := srv.Serve(make(chan CancelType))
+		select {
+		case <-srv.Ready():
+		case err := <-done:
+			t.Fatalf("run %v: Serve failed: %v", run, err)
+		}
+		if got, err := fetch(srv, "f"); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("run %v: download received %v bytes, %v, want %v bytes", run, len(got), err, len(data))
+		}
+		if err := <-srv.Serve(make(chan CancelType)); err != ErrServerRunning {
+			t.Errorf("run %v: Serve while serving returned %v, want %v", run, err, ErrServerRunning)
+		}
+
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatalf("run %v: Shutdown: %v", run, err)
+		}
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrServerClosed) {
+				t.Errorf("run %v: Serve returned %v, want %v", run, err, ErrServerClosed)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("run %v: Serve did not stop after Shutdown", run)
+		}
+		if addr := srv.LocalAddr(); addr != nil {
+			t.Errorf("run %v: LocalAddr is %v after Shutdown, want nil", run, addr)
+		}
+	}
+}
+
+func TestShutdownWaitsForTransfers(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+	})
+	data := testData(2000)
+	writeFile(t, srv.Root, "f", data)
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", nil)
+	first, tid := client.receiveData()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v while a transfer was in progress", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if got := client.download(tid, first, defaultBlockSize); !bytes.Equal(got, data) {
+		t.Fatalf("received %v bytes, want %v", len(got), len(data))
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown returned %v once the transfer finished, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return once the transfer finished")
+	}
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+	})
+	writeFile(t, srv.Root, "f", testData(2000))
+	client, _ := startStalledDownload(t, srv, "f")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v, long after its context expired", elapsed)
+	}
+	client.receiveError() // the stalled transfer was closed
+}
+
+func TestShutdownResult(t *testing.T) {
+	tests := []struct {
+		name            string
+		cancel          CancelType
+		wantDrained     int
+		wantForceClosed int
+	}{
+		{"graceful with DrainTimeout", Cancellation(ShutdownGracefully, 0), 1, 1},
+		{"with timeout", Cancellation(ShutdownWithTimeout, 300*time.Millisecond), 1, 1},
+		{"immediately", Cancellation(ShutdownImmediately, 0), 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+			srv.RetransmitTimeout = 5 * time.Second
+			srv.DrainTimeout = 300 * time.Millisecond
+			data := testData(2000)
+			writeFile(t, srv.Root, "f", data)
+			stop := make(chan CancelType)
+			done := srv.Serve(stop)
+			<-srv.Ready()
+
+			finishing := newRawClient(t)
+			finishing.sendRequest(srv.LocalAddr(), read, "f", nil)
+			first, tid := finishing.receiveData()
+			stalled, _ := startStalledDownload(t, srv, "f")
+
+			stop <- test.cancel // Serve is shutting down once it has received the cancellation
+			if test.wantDrained > 0 {
+				if got := finishing.download(tid, first, defaultBlockSize); !bytes.Equal(got, data) {
+					t.Fatalf("received %v bytes, want %v", len(got), len(data))
+				}
+			}
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Serve did not stop")
+			}
+			var result *ShutdownResult
+			if !errors.As(err, &result) || !errors.Is(err, ErrServerClosed) {
+				t.Fatalf("Serve returned %v, want a *ShutdownResult wrapping %v", err, ErrServerClosed)
+			}
+			if result.Drained != test.wantDrained || result.ForceClosed != test.wantForceClosed {
+				t.Errorf("%v connections drained and %v force-closed, want %v and %v",
+					result.Drained, result.ForceClosed, test.wantDrained, test.wantForceClosed)
+			}
+			stalled.receiveError()
+		})
+	}
+}
+
+func TestDuplicateAckFlood(t *testing.T) {
+	const maxDuplicates = 3
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+		srv.MaxDuplicates = maxDuplicates
+	})
+	writeFile(t, srv.Root, "f", testData(5*defaultBlockSize))
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", nil)
+	_, tid := client.receiveData()
+	ack := func(block uint16) { client.send(tid, mustBytes(createAckPacket(block).bytes())) }
+
+	// Up to maxDuplicates duplicates in a row are ignored, and any new block resets the count.
+	for block := uint16(1); block <= 2; block++ {
+		ack(block)
+		if dataPacket, _ := client.receiveData(); dataPacket.blockNumber != block+1 {
+			t.Fatalf("received DATA(%v), want DATA(%v)", dataPacket.blockNumber, block+1)
+		}
+		for i := 0; i < maxDuplicates; i++ {
+			ack(block)
+		}
+		if packet, ok := client.tryReceive(100 * time.Millisecond); ok {
+			t.Fatalf("server answered %v duplicate ACKs with %v", maxDuplicates, describe(packet.data))
+		}
+	}
+
+	ack(2) // one duplicate too many
+	errorPacket := client.receiveError()
+	if !strings.Contains(errorPacket.errorMsg, "duplicate") {
+		t.Errorf("got ERROR %q, want one about duplicate packets", errorPacket.errorMsg)
+	}
+	ack(3)
+	if packet, ok := client.tryReceive(100 * time.Millisecond); ok {
+		t.Errorf("the aborted transfer answered an ACK with %v", describe(packet.data))
+	}
+}
+
+func TestRetransmitBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(20*time.Millisecond, 80*time.Millisecond)
+	for attempt, want := range []time.Duration{20, 40, 80, 80} {
+		if got := backoff(attempt); got != want*time.Millisecond {
+			t.Errorf("backoff(%v) = %v, want %v", attempt, got, want*time.Millisecond)
+		}
+	}
+
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 20 * time.Millisecond
+		srv.RetransmitBackoff = backoff
+		srv.MaxRetransmissions = 3
+	})
+	writeFile(t, srv.Root, "f", testData(2000))
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", nil)
+	client.receiveData()
+	last := time.Now()
+	for attempt := 0; attempt < 3; attempt++ { // allowing for a late read of the previous block
+		if dataPacket, _ := client.receiveData(); dataPacket.blockNumber != 1 {
+			t.Fatalf("received DATA(%v), want a retransmission of DATA(1)", dataPacket.blockNumber)
+		}
+		if wait, want := time.Since(last), backoff(attempt); wait < want/2 {
+			t.Errorf("retransmission %v came after %v, want about %v", attempt+1, wait, want)
+		}
+		last = time.Now()
+	}
+	client.receiveError() // the retransmissions ran out
+}
+
+func TestOmitEmptyFinalBlock(t *testing.T) {
+	legacy := newRawClient(t)
+	infos := make(chan TransferInfo, 2)
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+		srv.OmitEmptyFinalBlock = func(remoteAddr net.Addr) bool {
+			return remoteAddr.String() == legacy.conn.LocalAddr().String()
+		}
+		srv.OnTransferComplete = func(info TransferInfo) { infos <- info }
+	})
+	data := testData(2 * defaultBlockSize)
+	writeFile(t, srv.Root, "f", data)
+
+	for _, test := range []struct {
+		client     *rawClient
+		wantBlocks int
+	}{
+		{newRawClient(t), 3}, // the file ends with an empty block
+		{legacy, 2},
+	} {
+		test.client.sendRequest(srv.LocalAddr(), read, "f", nil)
+		var received []byte
+		blocks := 0
+		for {
+			dataPacket, tid := test.client.receiveData()
+			blocks++
+			received = append(received, dataPacket.data...)
+			test.client.send(tid, mustBytes(createAckPacket(dataPacket.blockNumber).bytes()))
+			if len(dataPacket.data) < defaultBlockSize || (blocks == test.wantBlocks && len(received) == len(data)) {
+				break
+			}
+		}
+		if packet, ok := test.client.tryReceive(100 * time.Millisecond); ok {
+			t.Errorf("after %v blocks, received %v", blocks, describe(packet.data))
+		}
+		if blocks != test.wantBlocks || !bytes.Equal(received, data) {
+			t.Errorf("received %v bytes in %v blocks, want %v bytes in %v blocks", len(received), blocks, len(data), test.wantBlocks)
+		}
+		select {
+		case info := <-infos:
+			if info.Err != nil {
+				t.Errorf("transfer of %v blocks failed: %v", test.wantBlocks, info.Err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnTransferComplete was not called")
+		}
+	}
+}
+
+func TestMaxRoundTrips(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 5 * time.Second
+		srv.MaxRoundTrips = 3
+	})
+	small := testData(defaultBlockSize + 100) // the request and two ACKs
+	writeFile(t, srv.Root, "small", small)
+	writeFile(t, srv.Root, "large", testData(10*defaultBlockSize))
+
+	if got, err := fetch(srv, "small"); err != nil || !bytes.Equal(got, small) {
+		t.Errorf("download within the limit received %v bytes, %v, want %v bytes", len(got), err, len(small))
+	}
+
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "large", nil)
+	dataPacket, tid := client.receiveData()
+	for dataPacket.blockNumber < 3 {
+		client.send(tid, mustBytes(createAckPacket(dataPacket.blockNumber).bytes()))
+		dataPacket, _ = client.receiveData()
+	}
+	client.send(tid, mustBytes(createAckPacket(3).bytes()))
+	errorPacket := client.receiveError()
+	if !strings.Contains(errorPacket.errorMsg, "limit of 3 round trips") {
+		t.Errorf("got ERROR %q, want one about the round trip limit", errorPacket.errorMsg)
+	}
+}
+
+// receiveErrorAfterRetransmissions returns the next ERROR packet sent to client, skipping any retransmissions that
+// arrive before it, and fails the test if none arrives.
+func (client *rawClient) receiveErrorAfterRetransmissions() *ErrorPacket {
+	client.t.Helper()
+	for {
+		packet := client.receive()
+		if errorPacket, err := parseErrorPacket(packet); err == nil {
+			return errorPacket
+		}
+	}
+}
+
+func TestAbortedUploadLeavesNoFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		abort func(srv *Server, client *rawClient, tid net.Addr)
+	}{
+		{"client sends an ERROR", func(srv *Server, client *rawClient, tid net.Addr) {
+			client.send(tid, rawErrorPacket(errNotDef.fmt("upload cancelled")))
+		}},
+		{"client stops answering", func(srv *Server, client *rawClient, tid net.Addr) {
+			client.receiveErrorAfterRetransmissions() // of ACK(1), until they run out
+		}},
+		{"AbortTransfer", func(srv *Server, client *rawClient, tid net.Addr) {
+			if err := srv.AbortTransfer(client.conn.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			client.receiveErrorAfterRetransmissions()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.RetransmitTimeout = 20 * time.Millisecond
+				srv.MaxRetransmissions = 2
+			})
+			client := newRawClient(t)
+			client.sendRequest(srv.LocalAddr(), write, "f", nil)
+			packet := client.receive()
+			if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != 0 {
+				t.Fatalf("expected ACK(0), got %v", describe(packet.data))
+			}
+			client.send(packet.from, mustBytes(createDataPacket(1, testData(defaultBlockSize)).bytes()))
+			if ackPacket, err := parseAckPacket(client.receive()); err != nil || ackPacket.blockNumber != 1 {
+				t.Fatalf("expected ACK(1), got %v", err)
+			}
+			waitForFile(t, filepath.Join(srv.Root, "f"))
+
+			test.abort(srv, client, packet.from)
+			waitForRemoval(t, filepath.Join(srv.Root, "f"))
+		})
+	}
+}
+
+func TestSymlinksOutOfRoot(t *testing.T) {
+	outside := t.TempDir()
+	writeFile(t, outside, "secret", []byte("outside of the root"))
+	for _, followSymlinks := range []bool{false, true} {
+		t.Run(fmt.Sprintf("FollowSymlinks=%v", followSymlinks), func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.FollowSymlinks = followSymlinks
+			})
+			writeFile(t, srv.Root, "inside", []byte("inside of the root"))
+			for link, target := range map[string]string{
+				"outside-file": filepath.Join(outside, "secret"),
+				"outside-dir":  outside,
+				"inside-link":  "inside",
+			} {
+				if err := os.Symlink(target, filepath.Join(srv.Root, link)); err != nil {
+					t.Skipf("cannot create symbolic links: %v", err)
+				}
+			}
+
+			if got, err := fetch(srv, "inside-link"); err != nil || string(got) != "inside of the root" {
+				t.Errorf("download through a link within the root received %q, %v", got, err)
+			}
+			for _, filename := range []string{"outside-file", "outside-dir/secret"} {
+				got, err := fetch(srv, filename)
+				if followSymlinks && (err != nil || string(got) != "outside of the root") {
+					t.Errorf("download of %q received %q, %v, want the file outside of the root", filename, got, err)
+				}
+				if !followSymlinks && !errors.Is(err, ErrAccessViolation) {
+					t.Errorf("download of %q returned %q, %v, want %v", filename, got, err, ErrAccessViolation)
+				}
+			}
+			if !followSymlinks {
+				_, err := newTestClient(srv.LocalAddr().String()).Upload(strings.NewReader("overwritten"), "outside-dir/secret")
+				if !errors.Is(err, ErrAccessViolation) {
+					t.Errorf("upload through a link out of the root returned %v, want %v", err, ErrAccessViolation)
+				}
+			}
+		})
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "outside of the root" {
+		t.Errorf("the file outside of the root was changed to %q", data)
+	}
+}
+
+func TestReadDirectoryRefused(t *testing.T) {
+	srv := startServer(t, nil)
+	if err := os.Mkdir(filepath.Join(srv.Root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{"dir", "dir/", "."} {
+		if _, err := fetch(srv, filename); !errors.Is(err, ErrAccessViolation) {
+			t.Errorf("download of the directory %q returned %v, want an access violation", filename, err)
+		}
+	}
+}
+
+func TestFilenameRewrite(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.FilenameRewrite = func(filename string) string {
+			switch filename {
+			case "config":
+				return "config.txt"
+			case "escape":
+				return "../escape"
+			}
+			return filename
+		}
+	})
+	writeFile(t, srv.Root, "config.txt", []byte("rewritten"))
+	writeFile(t, srv.Root, "other", []byte("not rewritten"))
+
+	for filename, want := range map[string]string{"config": "rewritten", "config.txt": "rewritten", "other": "not rewritten"} {
+		if got, err := fetch(srv, filename); err != nil || string(got) != want {
+			t.Errorf("download of %q received %q, %v, want %q", filename, got, err, want)
+		}
+	}
+	if _, err := fetch(srv, "escape"); !errors.Is(err, ErrAccessViolation) {
+		t.Errorf("download of a name rewritten out of the root returned %v, want %v", err, ErrAccessViolation)
+	}
+
+	client := newTestClient(srv.LocalAddr().String())
+	if _, err := client.Upload(strings.NewReader("uploaded"), "config"); !errors.Is(err, ErrFileExists) {
+		t.Errorf("upload of \"config\" over the existing config.txt returned %v, want %v", err, ErrFileExists)
+	}
+	if err := os.Remove(filepath.Join(srv.Root, "config.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Upload(strings.NewReader("uploaded"), "config"); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	waitForContent(t, filepath.Join(srv.Root, "config.txt"), []byte("uploaded"))
+	if _, err := os.Stat(filepath.Join(srv.Root, "config")); !os.IsNotExist(err) {
+		t.Errorf("the upload wrote the name requested rather than the rewritten one: %v", err)
+	}
+}
+
+// recordingFileSystem is the operating system's file system, recording the names of the files it is asked about.
+type recordingFileSystem struct {
+	osFileSystem
+	mu    sync.Mutex
+	names []string
+}
+
+func (fsys *recordingFileSystem) record(name string) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.names = append(fsys.names, name)
+}
+
+// touched returns the names recorded since the last call, and forgets them.
+func (fsys *recordingFileSystem) touched() []string {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	names := fsys.names
+	fsys.names = nil
+	return names
+}
+
+func (fsys *recordingFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fsys.record(name)
+	return fsys.osFileSystem.OpenFile(name, flag, perm)
+}
+
+func (fsys *recordingFileSystem) Stat(name string) (os.FileInfo, error) {
+	fsys.record(name)
+	return fsys.osFileSystem.Stat(name)
+}
+
+func (fsys *recordingFileSystem) Remove(name string) error {
+	fsys.record(name)
+	return fsys.osFileSystem.Remove(name)
+}
+
+func TestHealthFilename(t *testing.T) {
+	fsys := &recordingFileSystem{}
+	srv := startServer(t, func(srv *Server) {
+		srv.FileSystem = fsys
+		srv.HealthFilename = "_healthz"
+	})
+	writeFile(t, srv.Root, "_healthz", []byte("a file that must not be served"))
+	writeFile(t, srv.Root, "f", []byte("an ordinary file"))
+	fsys.touched() // the server checked its root when it started
+
+	got, err := fetch(srv, "_healthz")
+	if err != nil || string(got) != healthPayload {
+		t.Errorf("download of the health file received %q, %v, want %q", got, err, healthPayload)
+	}
+	if names := fsys.touched(); len(names) != 0 {
+		t.Errorf("the health check touched the file system: %q", names)
+	}
+
+	if got, err := fetch(srv, "f"); err != nil || string(got) != "an ordinary file" {
+		t.Errorf("download of an ordinary file received %q, %v", got, err)
+	}
+	if names := fsys.touched(); len(names) == 0 {
+		t.Error("an ordinary download did not touch the file system, so the test cannot tell")
+	}
+}
+
+func TestUploadModTime(t *testing.T) {
+	buildTime := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	srv := startServer(t, func(srv *Server) {
+		srv.UploadModTime = func(filename string) time.Time {
+			if filename == "build.img" {
+				return buildTime
+			}
+			return time.Time{}
+		}
+	})
+	client := newTestClient(srv.LocalAddr().String())
+	before := time.Now().Add(-time.Minute) // allowing for a coarse file system clock
+	for _, filename := range []string{"build.img", "other"} {
+		if _, err := client.Upload(strings.NewReader("data"), filename); err != nil {
+			t.Fatalf("upload of %q failed: %v", filename, err)
+		}
+	}
+
+	waitFor(t, "the modification time to be set", func() bool {
+		info, err := os.Stat(filepath.Join(srv.Root, "build.img"))
+		return err == nil && info.ModTime().Equal(buildTime)
+	})
+	info, err := os.Stat(filepath.Join(srv.Root, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Before(before) {
+		t.Errorf("file for which UploadModTime returned the zero time was modified at %v, want the time it was written", info.ModTime())
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	blocked := newRawClient(t)
+	var mu sync.Mutex
+	var seen []string
+	srv := startServer(t, func(srv *Server) {
+		srv.ExpvarName = newExpvarName(t)
+		srv.OnRequest = func(packet Packet) bool {
+			req, err := parseRequestPacket(packet, false)
+			if err != nil {
+				t.Errorf("OnRequest was called with %v: %v", describe(packet.data), err)
+				return false
+			}
+			mu.Lock()
+			seen = append(seen, req.Filename())
+			mu.Unlock()
+			return packet.from.String() != blocked.conn.LocalAddr().String()
+		}
+	})
+	writeFile(t, srv.Root, "f", []byte("data"))
+
+	blocked.sendRequest(srv.LocalAddr(), read, "f", nil)
+	if packet, ok := blocked.tryReceive(200 * time.Millisecond); ok {
+		t.Errorf("a request that OnRequest dropped was answered with %v", describe(packet.data))
+	}
+	if got := metricValue(t, srv.ExpvarName, requestsMetric); got != 0 {
+		t.Errorf("a request that OnRequest dropped started %v connections", got)
+	}
+
+	if got, err := fetch(srv, "f"); err != nil || string(got) != "data" {
+		t.Errorf("download of an allowed request received %q, %v", got, err)
+	}
+	if got := metricValue(t, srv.ExpvarName, requestsMetric); got != 1 {
+		t.Errorf("an allowed request started %v connections, want 1", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "f" || seen[1] != "f" {
+		t.Errorf("OnRequest saw requests for %q, want both requests for \"f\"", seen)
+	}
+}
+
+func TestOnRetransmit(t *testing.T) {
+	type retransmission struct {
+		remote  string
+		block   uint16
+		attempt int
+	}
+	retransmissions := make(chan retransmission, 10)
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 200 * time.Millisecond
+		srv.OnRetransmit = func(remote net.Addr, block uint16, attempt int) {
+			retransmissions <- retransmission{remote.String(), block, attempt}
+		}
+	})
+	data := testData(2 * defaultBlockSize)
+	writeFile(t, srv.Root, "f", data)
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", nil)
+	client.receiveData() // and drop it, as if the ACK were lost
+
+	first, tid := client.receiveData()
+	want := retransmission{client.conn.LocalAddr().String(), 1, 1}
+	select {
+	case got := <-retransmissions:
+		if got != want {
+			t.Errorf("OnRetransmit was called with %+v, want %+v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnRetransmit was not called")
+	}
+	if got := client.download(tid, first, defaultBlockSize); !bytes.Equal(got, data) {
+		t.Fatalf("received %v bytes, want %v", len(got), len(data))
+	}
+	select {
+	case got := <-retransmissions:
+		t.Errorf("OnRetransmit was called again with %+v, though no further packet was lost", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDisableNetascii(t *testing.T) {
+	srv := startServer(t, func(srv *Server) {
+		srv.DisableNetascii = true
+	})
+	writeFile(t, srv.Root, "f", []byte("text\n"))
+
+	for _, flag := range []openFlag{read, write} {
+		client := newRawClient(t)
+		client.send(srv.LocalAddr(), mustBytes(createRequestPacket(flag, "f", netascii).bytes()))
+		if errorPacket := client.receiveError(); errorPacket.errorCode != uint16(CodeIllegalOperation) {
+			t.Errorf("netascii request with flag %v was refused with code %v, want %v", flag, errorPacket.errorCode, CodeIllegalOperation)
+		}
+	}
+	if got, err := fetch(srv, "f"); err != nil || string(got) != "text\n" {
+		t.Errorf("octet download received %q, %v", got, err)
+	}
+}
+
+func TestNetasciiLineEnding(t *testing.T) {
+	tests := []struct {
+		name       string
+		lineEnding LineEnding
+		disk       string
+		wire       string
+	}{
+		{"LF", LFLineEnding, "a\nb\rc\n", "a\r\nb\r\x00c\r\n"},
+		{"CRLF", CRLFLineEnding, "a\r\nb\rc\r\n", "a\r\nb\r\x00c\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.NetasciiLineEnding = test.lineEnding
+			})
+			writeFile(t, srv.Root, "download", []byte(test.disk))
+
+			client := newRawClient(t)
+			client.send(srv.LocalAddr(), mustBytes(createRequestPacket(read, "download", netascii).bytes()))
+			first, tid := client.receiveData()
+			if got := client.download(tid, first, defaultBlockSize); string(got) != test.wire {
+				t.Errorf("download of %q sent %q, want %q", test.disk, got, test.wire)
+			}
+
+			client.send(srv.LocalAddr(), mustBytes(createRequestPacket(write, "upload", netascii).bytes()))
+			packet := client.receive()
+			if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != 0 {
+				t.Fatalf("expected ACK(0), got %v", describe(packet.data))
+			}
+			client.send(packet.from, mustBytes(createDataPacket(1, []byte(test.wire)).bytes()))
+			if ackPacket, err := parseAckPacket(client.receive()); err != nil || ackPacket.blockNumber != 1 {
+				t.Fatalf("expected ACK(1), got %v", err)
+			}
+			waitForContent(t, filepath.Join(srv.Root, "upload"), []byte(test.disk))
+		})
+	}
+}
+
+func TestLenientModes(t *testing.T) {
+	tests := []struct {
+		mode         string
+		wantStrict   bool // wantStrict reports whether the mode is accepted without LenientModes
+		wantNetascii bool
+	}{
+		{"octet", true, false},
+		{"OcTeT", true, false}, // RFC 1350 modes are case-insensitive
+		{"NETASCII", true, true},
+		{"binary", false, false},
+		{"BINARY", false, false},
+		{"mail", false, false},
+	}
+	for _, lenient := range []bool{false, true} {
+		srv := startServer(t, func(srv *Server) {
+			srv.LenientModes = lenient
+		})
+		writeFile(t, srv.Root, "f", []byte("line\n"))
+		for _, test := range tests {
+			client := newRawClient(t)
+			client.send(srv.LocalAddr(), []byte("\x00\x01f\x00"+test.mode+"\x00"))
+			packet := client.receive()
+			dataPacket, err := parseDataPacket(packet)
+			accepted := err == nil
+			if accepted != (test.wantStrict || lenient) {
+				t.Errorf("LenientModes=%v: request in mode %q was answered with %v", lenient, test.mode, describe(packet.data))
+			}
+			if !accepted {
+				continue
+			}
+			want := "line\n"
+			if test.wantNetascii {
+				want = "line\r\n"
+			}
+			if string(dataPacket.data) != want {
+				t.Errorf("LenientModes=%v: request in mode %q received %q, want %q", lenient, test.mode, dataPacket.data, want)
+			}
+			client.send(packet.from, mustBytes(createAckPacket(1).bytes()))
+		}
+	}
+}
+
+func TestNetasciiFilenames(t *testing.T) {
+	const filename = "résumé.txt"
+	for _, netasciiOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NetasciiFilenames=%v", netasciiOnly), func(t *testing.T) {
+			srv := startServer(t, func(srv *Server) {
+				srv.NetasciiFilenames = netasciiOnly
+			})
+			writeFile(t, srv.Root, filename, []byte("data"))
+			writeFile(t, srv.Root, "plain.txt", []byte("data"))
+
+			got, err := fetch(srv, filename)
+			if netasciiOnly {
+				if err == nil || !strings.Contains(err.Error(), "not netascii") {
+					t.Errorf("download of %q returned %q, %v, want an error that it is not netascii", filename, got, err)
+				}
+			} else if err != nil || string(got) != "data" {
+				t.Errorf("download of %q received %q, %v", filename, got, err)
+			}
+			if got, err := fetch(srv, "plain.txt"); err != nil || string(got) != "data" {
+				t.Errorf("download of a netascii filename received %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use, for capturing the log of a server.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestTransferLogPrefix(t *testing.T) {
+	var logged syncBuffer
+	srv := startServer(t, func(srv *Server) {
+		srv.ErrorLog = log.New(&logged, "", 0)
+		srv.DefaultFile = "default"
+	})
+	writeFile(t, srv.Root, "default", []byte("data"))
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "missing", nil) // logs that the default file is served instead
+	_, tid := client.receiveData()
+	client.send(tid, mustBytes(createAckPacket(1).bytes()))
+	waitForTransfers(t, srv)
+
+	prefix := fmt.Sprintf(`(?m)^\[#\d+ %v "missing" tid=%v\] tftp: "missing" does not exist`,
+		regexp.QuoteMeta(client.conn.LocalAddr().String()), tid.(*net.UDPAddr).Port)
+	if !regexp.MustCompile(prefix).MatchString(logged.String()) {
+		t.Errorf("no line of the log has the transfer's ID, client address, filename and TID as its prefix:\n%v", logged.String())
+	}
+}
+
+func TestWrqOackThenData(t *testing.T) {
+	srv := startServer(t, nil)
+	data := testData(1000)
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), write, "f", map[string]string{"tsize": fmt.Sprint(len(data))})
+	packet := client.receive()
+	oackPacket, err := parseOackPacket(packet)
+	if err != nil {
+		t.Fatalf("expected OACK, got %v", describe(packet.data))
+	}
+	if oackPacket.options["tsize"] != fmt.Sprint(len(data)) {
+		t.Errorf("OACK tsize = %q, want %v", oackPacket.options["tsize"], len(data))
+	}
+	tid := packet.from
+
+	// The OACK stands in for ACK(0): the server must wait for DATA(1) rather than send an ACK of its own.
+	if packet, ok := client.tryReceive(100 * time.Millisecond); ok {
+		t.Fatalf("server sent %v after its OACK instead of waiting for DATA(1)", describe(packet.data))
+	}
+	for i, block := range [][]byte{data[:defaultBlockSize], data[defaultBlockSize:]} {
+		client.send(tid, mustBytes(createDataPacket(uint16(i+1), block).bytes()))
+		packet := client.receive()
+		if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != uint16(i+1) {
+			t.Fatalf("expected ACK(%v), got %v", i+1, describe(packet.data))
+		}
+	}
+	waitForContent(t, filepath.Join(srv.Root, "f"), data)
+}
+
+func TestLocalAddr(t *testing.T) {
+	srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+	if addr := srv.LocalAddr(); addr != nil {
+		t.Fatalf("LocalAddr returned %v before Serve", addr)
+	}
+	writeFile(t, srv.Root, "f", []byte("data"))
+	stop := make(chan CancelType)
+	done := srv.Serve(stop)
+	<-srv.Ready()
+
+	addr, ok := srv.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.Port == 0 || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("LocalAddr returned %v, want the loopback address with the port assigned to :0", srv.LocalAddr())
+	}
+	client := newRawClient(t)
+	client.sendRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.Port}, read, "f", nil)
+	if dataPacket, tid := client.receiveData(); string(dataPacket.data) != "data" {
+		t.Errorf("download from port %v received %q", addr.Port, dataPacket.data)
+	} else {
+		client.send(tid, mustBytes(createAckPacket(1).bytes()))
+	}
+
+	close(stop)
+	<-done
+	if addr := srv.LocalAddr(); addr != nil {
+		t.Errorf("LocalAddr returned %v after the server stopped", addr)
+	}
+}
+
+func TestReady(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		srv := NewServer(t.TempDir(), "127.0.0.1:0", log.New(io.Discard, "", 0))
+		writeFile(t, srv.Root, "f", []byte("data"))
+		ready := srv.Ready() // taken before Serve, as a caller starting the server in another goroutine would
+		stop := make(chan CancelType)
+		done := srv.Serve(stop)
+		<-ready
+		// No sleep, and a single request that is never retransmitted: it must be answered as soon as Ready is
+		// closed.
+		client := newRawClient(t)
+		client.sendRequest(srv.LocalAddr(), read, "f", nil)
+		if dataPacket, tid := client.receiveData(); string(dataPacket.data) != "data" {
+			t.Errorf("download right after Ready received %q", dataPacket.data)
+		} else {
+			client.send(tid, mustBytes(createAckPacket(1).bytes()))
+		}
+		close(stop)
+		<-done
+	}
+
+	srv := NewServer(t.TempDir(), "127.0.0.1:-1", log.New(io.Discard, "", 0))
+	done := srv.Serve(make(chan CancelType))
+	if err := <-done; err == nil {
+		t.Fatal("Serve on an invalid address succeeded")
+	}
+	select {
+	case <-srv.Ready():
+		t.Error("Ready was closed though Serve failed to start")
+	default:
+	}
+}
+
+func TestTransferSummaryLogged(t *testing.T) {
+	var logged syncBuffer
+	srv := startServer(t, func(srv *Server) {
+		srv.ErrorLog = log.New(&logged, "", 0) // no OnTransferComplete is set: the summary is logged regardless
+	})
+	writeFile(t, srv.Root, "f", testData(1000))
+	if _, err := fetch(srv, "f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestClient(srv.LocalAddr().String()).Upload(bytes.NewReader(testData(600)), "up"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch(srv, "missing"); err == nil {
+		t.Fatal("download of a missing file succeeded")
+	}
+	waitForTransfers(t, srv)
+
+	for _, summary := range []string{
+		`RRQ "f" from 127\.0\.0\.1:\d+: 1000 bytes, ok`,
+		`WRQ "up" from 127\.0\.0\.1:\d+: 600 bytes, ok`,
+		`RRQ "missing" from 127\.0\.0\.1:\d+: 0 bytes, TFTP error 1 occurred: file not found`,
+	} {
+		if !regexp.MustCompile(`(?m)tftp: connection finished - #\d+ ` + summary).MatchString(logged.String()) {
+			t.Errorf("no summary matching %#q was logged:\n%v", summary, logged.String())
+		}
+	}
+}
+
+func TestLargeBlockSize(t *testing.T) {
+	srv := startServer(t, nil)
+	data := testData(5*maxAcceptedBlockSize + 7) // larger than the 4096-byte buffer between a file and its blocks
+	writeFile(t, srv.Root, "f", data)
+	wantOack := fmt.Sprint(maxAcceptedBlockSize) // a blksize of 16384 is capped to what fits in a packet
+
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", map[string]string{"blksize": "16384"})
+	packet := client.receive()
+	if oackPacket, err := parseOackPacket(packet); err != nil || oackPacket.options["blksize"] != wantOack {
+		t.Fatalf("expected OACK with blksize %v, got %v", wantOack, describe(packet.data))
+	}
+	client.send(packet.from, mustBytes(createAckPacket(0).bytes()))
+	var got []byte
+	for block := uint16(1); ; block++ {
+		dataPacket, tid := client.receiveData()
+		want := len(data) - len(got)
+		if want > maxAcceptedBlockSize {
+			want = maxAcceptedBlockSize
+		}
+		if dataPacket.blockNumber != block || len(dataPacket.data) != want {
+			t.Fatalf("received DATA(%v) of %v bytes, want DATA(%v) of %v bytes", dataPacket.blockNumber, len(dataPacket.data), block, want)
+		}
+		got = append(got, dataPacket.data...)
+		client.send(tid, mustBytes(createAckPacket(block).bytes()))
+		if len(dataPacket.data) < maxAcceptedBlockSize {
+			break
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("download received %v bytes that differ from the file", len(got))
+	}
+
+	client.sendRequest(srv.LocalAddr(), write, "up", map[string]string{"blksize": "16384"})
+	packet = client.receive()
+	if oackPacket, err := parseOackPacket(packet); err != nil || oackPacket.options["blksize"] != wantOack {
+		t.Fatalf("expected OACK with blksize %v, got %v", wantOack, describe(packet.data))
+	}
+	tid := packet.from
+	for block, rest := uint16(1), data; ; block++ {
+		n := len(rest)
+		if n > maxAcceptedBlockSize {
+			n = maxAcceptedBlockSize
+		}
+		client.send(tid, mustBytes(createDataPacket(block, rest[:n]).bytes()))
+		rest = rest[n:]
+		packet := client.receive()
+		if ackPacket, err := parseAckPacket(packet); err != nil || ackPacket.blockNumber != block {
+			t.Fatalf("expected ACK(%v), got %v", block, describe(packet.data))
+		}
+		if n < maxAcceptedBlockSize {
+			break
+		}
+	}
+	waitForContent(t, filepath.Join(srv.Root, "up"), data)
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (linux && !(386 || amd64 || arm)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import "syscall"
+
+// soReusePort is the SO_REUSEPORT socket option.
+const soReusePort = syscall.SO_REUSEPORT
@@ -16,6 +16,15 @@ const bufferSize = 1468
 
 const sizeOfOpCode = 2
 
+// defaultBlockSize is the number of bytes of file data carried by each DATA packet as defined in RFC 1350. A DATA
+// packet carrying fewer bytes than this signals the end of a transfer.
+const defaultBlockSize = 512
+
+// maxErrorMessageSize is the largest number of bytes of an error message that is sent in an ERROR packet, not
+// counting its null terminator. Longer messages are truncated, so that an ERROR packet always fits in a DATA
+// packet of the default block size.
+const maxErrorMessageSize = 500
+
 // bufferSize defines the minimum size of a TFTP Read Request or Write Request packet. This accommodates the
 // opCode (2 bytes) plus filename (2 bytes) plus mode (2 bytes). The filename and mode are at least 1 byte and
 // are also terminated by a null byte.
@@ -23,7 +32,8 @@ const minRequestPacketSize = 6
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-// opCode specifies one of the five types of packets supported by TFTP. OpCodes are two bytes with values from 1 to 5.
+// opCode specifies one of the six types of packets supported by TFTP. OpCodes are two bytes with values from 1 to 5
+// as defined in RFC 1350, plus 6 for the option acknowledgment defined in RFC 2347.
 type opCode uint16
 
 const (
@@ -33,40 +43,132 @@ const (
 	DATA                // Data				3
 	ACK                 // Acknowledgment	4
 	ERROR               // Error			5
+	OACK                // Option ack		6
 )
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 var (
-	ErrServerClosed = errors.New("the server is closed")
+	ErrServerClosed  = errors.New("the server is closed")
+	ErrServerRunning = errors.New("the server is already serving") // returned by Serve while the server is serving
+
+	// ErrTransferSizeMismatch is wrapped by the error a download returns when it received a different number
+	// of bytes than the server announced with the tsize option.
+	ErrTransferSizeMismatch = errors.New("received size does not match the transfer size")
 )
 
 type tftpError struct {
 	errorCode uint16
-	errorMsg  error // TODO should this just be a string?
+	errorMsg  string // errorMsg is the message sent to the client in an ERROR packet
+	cause     error  // cause is the underlying error that led to this one, if any
+}
+
+// newTFTPError returns an error with the given error code and message, and no cause.
+func newTFTPError(errorCode uint16, errorMsg string) tftpError {
+	return tftpError{
+		errorCode: errorCode,
+		errorMsg:  errorMsg,
+	}
 }
 
 func (e tftpError) fmt(format string, a ...interface{}) tftpError {
 	fmtMsg := fmt.Sprintf(format, a...)
-	fmtErr := errors.New(e.errorMsg.Error() + ": " + fmtMsg)
 	formattedError := tftpError{
 		errorCode: e.errorCode,
-		errorMsg:  fmtErr,
+		errorMsg:  e.errorMsg + ": " + fmtMsg,
+		cause:     e.cause,
 	}
 	return formattedError
 }
 
+// undefinedError returns an undefined (code 0) error whose message is msg alone, for sending an
+// operator-supplied description to the client. Any byte of msg that is not printable netascii,
+// including a NUL that would end the message early, is replaced with '?'.
+func undefinedError(msg string) tftpError {
+	safeMsg := []byte(msg)
+	for i, b := range safeMsg {
+		if b < 0x20 || b > 0x7e {
+			safeMsg[i] = '?'
+		}
+	}
+	return newTFTPError(errNotDef.errorCode, string(safeMsg))
+}
+
+// wrap returns a copy of e caused by err, so that errors.Is and errors.As can match err.
+// The message sent to the client is unchanged.
+func (e tftpError) wrap(err error) tftpError {
+	wrappedError := tftpError{
+		errorCode: e.errorCode,
+		errorMsg:  e.errorMsg,
+		cause:     err,
+	}
+	return wrappedError
+}
+
 func (e tftpError) Error() string {
 	return fmt.Sprintf("TFTP error %v occurred: %v", e.errorCode, e.errorMsg)
 }
 
+func (e tftpError) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is a TFTP error with the same error code as e, so that an error whose
+// message has been extended with fmt still matches the sentinel it was made from, as in
+// errors.Is(err, ErrFileNotFound).
+func (e tftpError) Is(target error) bool {
+	t, ok := target.(tftpError)
+	return ok && t.errorCode == e.errorCode
+}
+
+// ErrorCode is the error code carried by an ERROR packet, as defined in RFC 1350 and RFC 2347.
+type ErrorCode uint16
+
+const (
+	CodeNotDefined        ErrorCode = 0 // Not defined, see error message (if any).
+	CodeFileNotFound      ErrorCode = 1 // File not found.
+	CodeAccessViolation   ErrorCode = 2 // Access violation.
+	CodeDiskFull          ErrorCode = 3 // Disk full or allocation exceeded.
+	CodeIllegalOperation  ErrorCode = 4 // Illegal TFTP operation.
+	CodeUnknownTID        ErrorCode = 5 // Unknown transfer ID.
+	CodeFileExists        ErrorCode = 6 // File already exists.
+	CodeNoSuchUser        ErrorCode = 7 // No such user.
+	CodeOptionNegotiation ErrorCode = 8 // Option negotiation failed, defined in RFC 2347.
+)
+
+// ErrorCodeOf returns the TFTP error code of err, and false if err is not a TFTP error sent to or
+// received from the other side of a transfer, such as a network error.
+func ErrorCodeOf(err error) (ErrorCode, bool) {
+	var tftpErr tftpError
+	if !errors.As(err, &tftpErr) {
+		return 0, false
+	}
+	return ErrorCode(tftpErr.errorCode), true
+}
+
+var (
+	errNotDef     = newTFTPError(uint16(CodeNotDefined), "undefined")
+	errNoFile     = newTFTPError(uint16(CodeFileNotFound), "file not found")
+	errAccess     = newTFTPError(uint16(CodeAccessViolation), "access violation")
+	errMemory     = newTFTPError(uint16(CodeDiskFull), "disk full or allocation exceeded")
+	errOperation  = newTFTPError(uint16(CodeIllegalOperation), "illegal TFTP operation")
+	errTID        = newTFTPError(uint16(CodeUnknownTID), "unknown transfer ID")
+	errFileExists = newTFTPError(uint16(CodeFileExists), "file already exists")
+	errNoUser     = newTFTPError(uint16(CodeNoSuchUser), "no such user")
+	errOptions    = newTFTPError(uint16(CodeOptionNegotiation), "option negotiation failed")
+)
+
+// The errors sent in ERROR packets, as defined in RFC 1350 and RFC 2347. An error returned by this package that
+// was sent to or received from the other side of a transfer matches one of these with errors.Is,
+// whatever detail has been added to its message.
 var (
-	errNotDef     = tftpError{0, errors.New("undefined")}
-	errNoFile     = tftpError{1, errors.New("file not found")}
-	errAccess     = tftpError{3, errors.New("access violation")}
-	errMemory     = tftpError{4, errors.New("disk full or allocation exceeded")}
-	errOperation  = tftpError{5, errors.New("illegal TFTP operation")}
-	errTID        = tftpError{6, errors.New("unknown transfer ID")}
-	errFileExists = tftpError{7, errors.New("file already exists")}
-	errNoUser     = tftpError{8, errors.New("no such user")}
+	ErrUndefined        error = errNotDef
+	ErrFileNotFound     error = errNoFile
+	ErrAccessViolation  error = errAccess
+	ErrDiskFull         error = errMemory
+	ErrIllegalOperation error = errOperation
+	ErrUnknownTID       error = errTID
+	ErrFileExists       error = errFileExists
+	ErrNoSuchUser       error = errNoUser
+	ErrOptionRefused    error = errOptions
 )
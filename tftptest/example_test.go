@@ -0,0 +1,81 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftptest_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/benshields/tftp/tftptest"
+)
+
+func ExampleHarness() {
+	// A temporary directory stands in for an in-memory root.
+	root, err := ioutil.TempDir("", "tftptest")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	err = ioutil.WriteFile(filepath.Join(root, "boot.bin"), []byte("hello"), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h, err := tftptest.NewHarness(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer h.Close()
+
+	downloaded, err := h.Download("boot.bin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("downloaded %q\n", downloaded)
+
+	uploaded, err := h.Upload("config.txt", []byte("timeout 10"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("uploaded %q\n", uploaded)
+
+	// Output:
+	// downloaded "hello"
+	// uploaded "timeout 10"
+}
+
+func ExampleNewMemHarness() {
+	fsys := &tftptest.MemFS{}
+	fsys.WriteFile("pxelinux.0", []byte("boot loader"))
+
+	h, err := tftptest.NewMemHarness(fsys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer h.Close()
+
+	downloaded, err := h.Download("pxelinux.0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("downloaded %q\n", downloaded)
+
+	_, err = h.Upload("pxelinux.cfg/default", []byte("default linux"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	stored, err := fsys.ReadFile("pxelinux.cfg/default")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("stored %q\n", stored)
+
+	// Output:
+	// downloaded "boot loader"
+	// stored "default linux"
+}
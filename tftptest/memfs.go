@@ -0,0 +1,206 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftptest
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benshields/tftp"
+)
+
+// MemFS is an in-memory tftp.FileSystem, for serving files without touching
+// the disk. Its zero value is an empty file system ready to use, whose root
+// directory is named both "/" and ".". A file's directories exist as long as
+// the file does. A MemFS may be used by several goroutines at once.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// WriteFile stores data as the named file, replacing any file of that name.
+func (fsys *MemFS) WriteFile(name string, data []byte) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.files == nil {
+		fsys.files = make(map[string][]byte)
+	}
+	fsys.files[memName(name)] = append([]byte(nil), data...)
+}
+
+// ReadFile returns the contents of the named file.
+func (fsys *MemFS) ReadFile(name string) ([]byte, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	data, ok := fsys.files[memName(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// OpenFile opens the named file for reading, or creates it for writing if
+// flag includes os.O_WRONLY. Each write appends to the file.
+func (fsys *MemFS) OpenFile(name string, flag int, perm os.FileMode) (tftp.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key := memName(name)
+	if fsys.isDir(key) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	data, exists := fsys.files[key]
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return &memFile{name: key, reader: bytes.NewReader(data)}, nil
+	}
+	if exists && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if fsys.files == nil {
+		fsys.files = make(map[string][]byte)
+	}
+	if !exists || flag&os.O_TRUNC != 0 {
+		fsys.files[key] = nil
+	}
+	return &memFile{name: key, fsys: fsys}, nil
+}
+
+// Stat describes the named file or directory.
+func (fsys *MemFS) Stat(name string) (os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key := memName(name)
+	if fsys.isDir(key) {
+		return memFileInfo{name: path.Base(key), dir: true}, nil
+	}
+	data, ok := fsys.files[key]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{name: path.Base(key), size: int64(len(data))}, nil
+}
+
+// Remove removes the named file.
+func (fsys *MemFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key := memName(name)
+	if _, ok := fsys.files[key]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fsys.files, key)
+	return nil
+}
+
+// isDir reports whether key names the root or a directory holding a file. The caller must hold fsys.mu.
+func (fsys *MemFS) isDir(key string) bool {
+	if key == "." {
+		return true
+	}
+	for name := range fsys.files {
+		if strings.HasPrefix(name, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// memName returns the key of the file named name, which is relative to the root and separated by slashes.
+func memName(name string) string {
+	key := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if key == "" {
+		return "."
+	}
+	return key
+}
+
+// memFile is a file of a MemFS open for reading, when reader is set, or for writing.
+type memFile struct {
+	name   string
+	reader *bytes.Reader // reader reads the contents the file had when it was opened.
+	fsys   *MemFS        // fsys is the file system that writes are appended to.
+	closed bool
+}
+
+var errMemFileMode = errors.New("file not opened for this operation")
+
+func (f *memFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.reader == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errMemFileMode}
+	}
+	return f.reader.Read(b)
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.fsys == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errMemFileMode}
+	}
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if _, ok := f.fsys.files[f.name]; !ok {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrNotExist} // removed while open
+	}
+	f.fsys.files[f.name] = append(f.fsys.files[f.name], b...)
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errMemFileMode}
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.reader != nil {
+		return memFileInfo{name: path.Base(f.name), size: f.reader.Size()}, nil
+	}
+	return f.fsys.Stat(f.name)
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo describes a file or directory of a MemFS.
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) ModTime() time.Time { return time.Time{} }
+func (info memFileInfo) IsDir() bool        { return info.dir }
+func (info memFileInfo) Sys() interface{}   { return nil }
+
+func (info memFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftptest provides utilities for TFTP testing.
+//
+// A Harness runs a tftp.Server and a tftp.Client against each other over the
+// UDP loopback interface, so that a full RRQ download or WRQ upload can be
+// performed in a single call:
+//
+//	root, _ := ioutil.TempDir("", "tftptest")
+//	_ = ioutil.WriteFile(filepath.Join(root, "boot.bin"), []byte("hello"), 0644)
+//
+//	h, err := tftptest.NewHarness(root)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer h.Close()
+//
+//	data, err := h.Download("boot.bin") // data == []byte("hello")
+//
+// NewHarness serves the files of a directory on disk. NewMemHarness serves
+// the files of a MemFS instead, so that a test can populate and inspect the
+// server's files without touching the disk. Either way, the client's side of
+// each transfer is kept in a scratch directory of the Harness, which Close
+// removes.
+package tftptest
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/benshields/tftp"
+)
+
+// Harness pairs a tftp.Server with a tftp.Client on the loopback interface.
+type Harness struct {
+	// Root is the directory the Server reads files from and writes files to.
+	// It is "/" for a Harness created by NewMemHarness.
+	Root string
+
+	// Server is the server under test. It is already serving when
+	// NewHarness returns. Its OnTransferComplete hook is set by
+	// NewHarness, as Upload uses it to learn when the server has
+	// finished writing a file.
+	Server *tftp.Server
+
+	// Client is a client that sends its requests to Server.
+	Client *tftp.Client
+
+	// local is a scratch directory holding the client's side of each transfer.
+	local string
+
+	// written receives the name of each file the server finishes writing, once it has closed the file.
+	written chan string
+
+	stop chan tftp.CancelType
+	done <-chan error
+
+	closeOnce sync.Once
+	closeErr  error // closeErr is the result of the first call to Close.
+}
+
+// NewHarness starts a server rooted at root on an unused loopback port and
+// returns a Harness whose Client is connected to it. The caller should call
+// Close when finished.
+func NewHarness(root string) (*Harness, error) {
+	root, err := filepath.Abs(root) // so that Root stays valid if the caller changes its working directory
+	if err != nil {
+		return nil, err
+	}
+	return newHarness(root, nil)
+}
+
+// NewMemHarness is like NewHarness, but the server reads files from and
+// writes files to fsys, rooted at "/".
+func NewMemHarness(fsys *MemFS) (*Harness, error) {
+	return newHarness("/", fsys)
+}
+
+// newHarness starts a server rooted at root of fsys, or of the disk if fsys is nil.
+func newHarness(root string, fsys tftp.FileSystem) (*Harness, error) {
+	local, err := ioutil.TempDir("", "tftptest")
+	if err != nil {
+		return nil, err
+	}
+
+	errorLog := log.New(ioutil.Discard, "", 0)
+	h := &Harness{
+		Root:    root,
+		Server:  tftp.NewServer(root, "127.0.0.1:0", errorLog), // :0 tells the OS to assign an unused port
+		local:   local,
+		written: make(chan string, 16),
+		stop:    make(chan tftp.CancelType),
+	}
+	h.Server.FileSystem = fsys
+	h.Server.OnTransferComplete = func(info tftp.TransferInfo) {
+		if info.Write && info.Err == nil {
+			select {
+			case h.written <- info.Filename:
+			default: // nobody is waiting for this upload
+			}
+		}
+	}
+	h.done = h.Server.Serve(h.stop)
+
+	err = h.waitForServer()
+	if err != nil {
+		_ = os.RemoveAll(local)
+		return nil, err
+	}
+	h.Client = tftp.NewClient(h.Server.LocalAddr().String(), errorLog)
+	return h, nil
+}
+
+// Download performs a full RRQ transfer of filename from the server and
+// returns the bytes the client received.
+func (h *Harness) Download(filename string) ([]byte, error) {
+	local, err := h.localFile()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(local)
+
+	_, err = h.Client.DownloadFile(filename, local)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(local)
+}
+
+// Upload performs a full WRQ transfer of data to the server as filename and
+// returns the bytes the server stored.
+func (h *Harness) Upload(filename string, data []byte) ([]byte, error) {
+	local, err := h.localFile()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(local)
+
+	err = ioutil.WriteFile(local, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = h.Client.UploadFile(local, filename)
+	if err != nil {
+		return nil, err
+	}
+	err = h.waitForWrite(filename)
+	if err != nil {
+		return nil, err
+	}
+	return h.readServerFile(filename)
+}
+
+// readServerFile returns the contents of the server's file named filename.
+func (h *Harness) readServerFile(filename string) ([]byte, error) {
+	path := filepath.Join(h.Root, filename)
+	if h.Server.FileSystem == nil {
+		return ioutil.ReadFile(path)
+	}
+	f, err := h.Server.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// waitForWrite blocks until the server has finished writing filename. The server acknowledges the final block
+// of an upload before it closes the file, so the file may not be complete yet when the client returns.
+func (h *Harness) waitForWrite(filename string) error {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case written := <-h.written:
+			if written == filename {
+				return nil
+			}
+		case <-timeout:
+			return errors.New("tftptest: timed out waiting for server to write " + filename)
+		}
+	}
+}
+
+// Close shuts down the server immediately and removes the client's scratch directory. It may be called
+// more than once, and after the server has been stopped by other means, returning the same result each time.
+func (h *Harness) Close() error {
+	h.closeOnce.Do(func() {
+		var err error
+		select {
+		case h.stop <- tftp.Cancellation(tftp.ShutdownImmediately, 0):
+			err = <-h.done
+		case err = <-h.done: // Serve has already returned, such as after Server.Close
+		}
+		removeErr := os.RemoveAll(h.local)
+		if err != nil && !errors.Is(err, tftp.ErrServerClosed) {
+			h.closeErr = err
+			return
+		}
+		h.closeErr = removeErr
+	})
+	return h.closeErr
+}
+
+// localFile returns the name of a file in the client's scratch directory that does not exist yet.
+func (h *Harness) localFile() (string, error) {
+	f, err := ioutil.TempFile(h.local, "transfer")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return name, os.Remove(name) // the client refuses to overwrite an existing local file
+}
+
+// waitForServer blocks until the server is ready, or returns the error it failed to start with.
+func (h *Harness) waitForServer() error {
+	select {
+	case <-h.Server.Ready():
+		return nil
+	case err := <-h.done:
+		return err
+	case <-time.After(5 * time.Second):
+		return errors.New("tftptest: timed out waiting for server to start")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftptest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseReturns(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(h *Harness)
+	}{
+		{"twice", func(h *Harness) { _ = h.Close() }},
+		{"after Server.Close", func(h *Harness) { _ = h.Server.Close() }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := NewMemHarness(&MemFS{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.close(h)
+
+			closed := make(chan error, 1)
+			go func() { closed <- h.Close() }()
+			select {
+			case err := <-closed:
+				if err != nil {
+					t.Errorf("Close returned %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close did not return")
+			}
+		})
+	}
+}
+
+func TestMemHarnessNotFound(t *testing.T) {
+	fsys := &MemFS{}
+	h, err := NewMemHarness(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	_, err = h.Download("missing.bin")
+	if err == nil {
+		t.Fatal("download of a missing file succeeded")
+	}
+	_, err = fsys.ReadFile("missing.bin")
+	if err == nil {
+		t.Error("the failed download created the file")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftp implements the Trivial File Transfer Protocol as defined in RFC 1350.
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TransferInfo describes a transfer handled by a Server, as reported to Server.OnTransferComplete and
+// logged when the connection handling it finishes.
+type TransferInfo struct {
+	// ID is the transfer ID, which is unique among the transfers of the process
+	// and prefixes the log lines of the transfer, such as "[#42 ...]".
+	ID uint64
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+
+	// Filename is the name of the file transferred, which is the name requested
+	// by the client after any Server.FilenameRewrite has been applied.
+	Filename string
+
+	// Write is true for a write request (WRQ) and false for a read request (RRQ).
+	Write bool
+
+	// BlockSize is the number of data bytes carried by each DATA packet. It is
+	// the negotiated blksize if the client requested one, and 512 otherwise.
+	BlockSize int
+
+	// WindowSize is the number of DATA packets sent before waiting for an ACK. It is always 1, because the
+	// server does not negotiate the windowsize option of RFC 7440 and ignores it if requested.
+	WindowSize int
+
+	// Timeout is how long the server waited for each answer before retransmitting. The server does not
+	// negotiate the timeout option of RFC 2349, so it is Server.RetransmitTimeout, or its default.
+	Timeout time.Duration
+
+	// Bytes is the number of bytes of the file sent or received, which is the
+	// size of the file if the transfer succeeded.
+	Bytes int64
+
+	// Options holds each option the server accepted and the value it sent in
+	// its OACK. It is empty if the transfer used no options.
+	Options map[string]string
+
+	// Err is the error the transfer failed with, or nil if it succeeded.
+	Err error
+}
+
+// String returns a one-line summary of the transfer, such as `#42 RRQ "boot.bin" from 10.0.0.2:1234: 4096 bytes, ok`.
+func (info TransferInfo) String() string {
+	direction := "RRQ"
+	if info.Write {
+		direction = "WRQ"
+	}
+	outcome := "ok"
+	if info.Err != nil {
+		outcome = info.Err.Error()
+	}
+	return fmt.Sprintf("#%v %v %q from %v: %v bytes, %v", info.ID, direction, info.Filename, info.RemoteAddr, info.Bytes, outcome)
+}
+
+// transferInfo describes the transfer of this connection, which finished with err. If the request could not be
+// parsed, only the client's address and the error are known.
+func (handlerObject *HandlerObject) transferInfo(err error) TransferInfo {
+	info := TransferInfo{ID: handlerObject.id, RemoteAddr: handlerObject.remoteAddr, Err: err}
+	if handlerObject.request == nil {
+		return info
+	}
+	if handlerObject.ResponseWriter != nil {
+		info.Bytes = handlerObject.ResponseWriter.BytesTransferred()
+	}
+	options := make(map[string]string, len(handlerObject.options.accepted))
+	for name, value := range handlerObject.options.accepted {
+		options[name] = value
+	}
+	info.Filename = handlerObject.request.filename
+	info.Write = handlerObject.request.openFlag == write
+	info.BlockSize = handlerObject.options.blockSize
+	info.WindowSize = 1
+	info.Timeout = handlerObject.settings().retransmitTimeout()
+	info.Options = options
+	return info
+}
+
+// transferComplete reports the finished transfer to the server's metrics and OnTransferComplete hook. A request
+// that was refused before it was parsed, such as one over MaxTransfersPerIP, is counted as rejected in the
+// metrics, but is not reported to the hook, as there is no transfer to describe.
+func (handlerObject *HandlerObject) transferComplete(info TransferInfo) {
+	srv := handlerObject.settings()
+	if handlerObject.request == nil {
+		if info.Err != nil {
+			srv.metrics.requestRejected(info.Err)
+		}
+		return
+	}
+	srv.metrics.transferFinished(info.Write, info.Bytes, info.Err)
+	if srv.OnTransferComplete != nil {
+		srv.OnTransferComplete(info)
+	}
+}
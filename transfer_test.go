@@ -0,0 +1,61 @@
+// Copyright (c) 2019, Benjamin Shields. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTransferCompleteReportsNegotiatedOptions(t *testing.T) {
+	infos := make(chan TransferInfo, 1)
+	srv := startServer(t, func(srv *Server) {
+		srv.RetransmitTimeout = 300 * time.Millisecond
+		srv.OnTransferComplete = func(info TransferInfo) { infos <- info }
+	})
+	data := testData(3000)
+	writeFile(t, srv.Root, "f", data)
+
+	client := newRawClient(t)
+	client.sendRequest(srv.LocalAddr(), read, "f", map[string]string{"blksize": "1024", "windowsize": "4", "timeout": "3"})
+	packet := client.receive()
+	oackPacket, err := parseOackPacket(packet)
+	if err != nil {
+		t.Fatalf("expected OACK, got %v", describe(packet.data))
+	}
+	if len(oackPacket.options) != 1 || oackPacket.options["blksize"] != "1024" {
+		t.Fatalf("OACK options = %v, want only blksize 1024", oackPacket.options)
+	}
+	client.send(packet.from, mustBytes(createAckPacket(0).bytes()))
+	first, _ := client.receiveData()
+	if got := client.download(packet.from, first, 1024); !bytes.Equal(got, data) {
+		t.Fatalf("received %v bytes, want %v", len(got), len(data))
+	}
+
+	select {
+	case info := <-infos:
+		if info.Err != nil {
+			t.Fatalf("transfer failed: %v", info.Err)
+		}
+		if info.BlockSize != 1024 {
+			t.Errorf("BlockSize = %v, want 1024", info.BlockSize)
+		}
+		if info.WindowSize != 1 {
+			t.Errorf("WindowSize = %v, want 1", info.WindowSize)
+		}
+		if info.Timeout != srv.RetransmitTimeout {
+			t.Errorf("Timeout = %v, want %v", info.Timeout, srv.RetransmitTimeout)
+		}
+		if len(info.Options) != 1 || info.Options["blksize"] != "1024" {
+			t.Errorf("Options = %v, want only blksize 1024", info.Options)
+		}
+		if info.Bytes != int64(len(data)) {
+			t.Errorf("Bytes = %v, want %v", info.Bytes, len(data))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnTransferComplete was not called")
+	}
+}